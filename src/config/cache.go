@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// DefaultImageCacheMB is the processed-image cache size used
+// when IMAGE_CACHE_MB is not set
+const DefaultImageCacheMB = 256
+
+// ImageCacheBytes returns the memory the processed-image cache may
+// hold, set in megabytes by IMAGE_CACHE_MB. 0 disables the cache.
+func ImageCacheBytes() (int64, error) {
+	value := os.Getenv("IMAGE_CACHE_MB")
+	if value == "" {
+		return DefaultImageCacheMB << 20, nil
+	}
+
+	mb, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || mb < 0 {
+		return 0, fmt.Errorf("invalid IMAGE_CACHE_MB %q", value)
+	}
+	return mb << 20, nil
+}
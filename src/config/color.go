@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// AutoColor returns the strengths of the automatic color correction
+// set by AUTO_COLOR: "on" for the editors' defaults, or strengths
+// from 0 to 1 written "levels,white_balance,contrast,saturation".
+// It is off when AUTO_COLOR is not set.
+func AutoColor() (imaging.AutoColor, error) {
+	value := strings.TrimSpace(os.Getenv("AUTO_COLOR"))
+	switch strings.ToLower(value) {
+	case "", "off", "none":
+		return imaging.AutoColor{}, nil
+	case "on", "auto":
+		return imaging.DefaultAutoColor, nil
+	}
+
+	strengths, err := imaging.ParseAutoColor(value)
+	if err != nil {
+		return imaging.AutoColor{}, fmt.Errorf("invalid AUTO_COLOR: %w", err)
+	}
+	return strengths, nil
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -14,6 +16,13 @@ import (
 
 var dynamoClient *dynamodb.Client
 
+// Order statuses recorded in photo_status. An order is pending
+// until every expected photo has been uploaded and verified.
+const (
+	StatusPendingUpload = "pending_upload"
+	StatusUploaded      = "uploaded"
+)
+
 // InitDynamoDB initializes the DynamoDB instance
 func InitDynamoDB() {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
@@ -24,7 +33,9 @@ func InitDynamoDB() {
 }
 
 // InsertMetadata inserts metadata for a new photo upload.
-func InsertMetadata(customerFullName, customerEmail, paperType, paperSize, photoID string, timestamp int64) error {
+// expectedPhotos is the number of photos the order waits
+// for before it is sent to print.
+func InsertMetadata(customerFullName, customerEmail, paperType, paperSize, photoID string, expectedPhotos int, timestamp int64) error {
 	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
 
 	_, err := dynamoClient.PutItem(context.Background(), &dynamodb.PutItemInput{
@@ -49,14 +60,115 @@ func InsertMetadata(customerFullName, customerEmail, paperType, paperSize, photo
 				Value: strconv.FormatInt(timestamp, 10),
 			},
 			"photo_status": &types.AttributeValueMemberS{
-				Value: "uploaded",
+				Value: StatusPendingUpload,
+			},
+			"expected_photos": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(expectedPhotos),
 			},
 		},
 	})
 
 	if err != nil {
-		log.Printf("unable to insert metadata for photo %s: %v", photoID, err)
+		return fmt.Errorf("unable to insert metadata for order %s: %w", photoID, err)
 	}
 
 	return nil
 }
+
+// DynamoOrderTracker tracks the verified uploads of
+// an order in the DynamoDB table DYNAMODB_TABLE_NAME.
+type DynamoOrderTracker struct{}
+
+// orderKey returns the table key of an order
+func orderKey(customerEmail, orderID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"customer_email": &types.AttributeValueMemberS{Value: customerEmail},
+		"photo_id":       &types.AttributeValueMemberS{Value: orderID},
+	}
+}
+
+// RecordVerifiedPhoto adds key to the order's set of verified photos
+// and returns how many are verified and how many the order expects.
+// Recording the same key twice is a no-op, so redelivered events
+// are not counted again.
+func (DynamoOrderTracker) RecordVerifiedPhoto(ctx context.Context, customerEmail, orderID, key string) (int, int, error) {
+	if dynamoClient == nil {
+		InitDynamoDB()
+	}
+
+	output, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(os.Getenv("DYNAMODB_TABLE_NAME")),
+		Key:                 orderKey(customerEmail, orderID),
+		UpdateExpression:    aws.String("ADD verified_photos :k"),
+		ConditionExpression: aws.String("attribute_exists(photo_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k": &types.AttributeValueMemberSS{Value: []string{key}},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return 0, 0, fmt.Errorf("order %s does not exist", orderID)
+		}
+		return 0, 0, fmt.Errorf("failed to record photo %s for order %s: %w", key, orderID, err)
+	}
+
+	verified := 0
+	if set, ok := output.Attributes["verified_photos"].(*types.AttributeValueMemberSS); ok {
+		verified = len(set.Value)
+	}
+
+	// Orders created before expected_photos was recorded
+	// cannot be checked, so they are treated as complete
+	expected := verified
+	if count, ok := output.Attributes["expected_photos"].(*types.AttributeValueMemberN); ok {
+		if expected, err = strconv.Atoi(count.Value); err != nil {
+			return 0, 0, fmt.Errorf("invalid expected_photos for order %s: %w", orderID, err)
+		}
+	}
+
+	return verified, expected, nil
+}
+
+// MarkOrderUploaded moves a pending order to StatusUploaded. It
+// returns false when the order was not pending, e.g. because a
+// concurrent event already completed it.
+func (DynamoOrderTracker) MarkOrderUploaded(ctx context.Context, customerEmail, orderID string) (bool, error) {
+	return setOrderStatus(ctx, customerEmail, orderID, StatusPendingUpload, StatusUploaded)
+}
+
+// ResetOrderUpload moves an uploaded order back to
+// StatusPendingUpload, so a failed print request can be retried.
+func (DynamoOrderTracker) ResetOrderUpload(ctx context.Context, customerEmail, orderID string) error {
+	_, err := setOrderStatus(ctx, customerEmail, orderID, StatusUploaded, StatusPendingUpload)
+	return err
+}
+
+// setOrderStatus changes the order's status from one to the other.
+// It returns false when the order's status was not from.
+func setOrderStatus(ctx context.Context, customerEmail, orderID, from, to string) (bool, error) {
+	if dynamoClient == nil {
+		InitDynamoDB()
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(os.Getenv("DYNAMODB_TABLE_NAME")),
+		Key:                 orderKey(customerEmail, orderID),
+		UpdateExpression:    aws.String("SET photo_status = :to"),
+		ConditionExpression: aws.String("photo_status = :from"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":from": &types.AttributeValueMemberS{Value: from},
+			":to":   &types.AttributeValueMemberS{Value: to},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to set status of order %s to %s: %w", orderID, to, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"log"
+	"os"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// InitDecoders registers the optional image decoders. HEIC photos are
+// accepted once HEIC_CONVERTER names a command that converts them.
+func InitDecoders() error {
+	command := os.Getenv("HEIC_CONVERTER")
+	if command == "" {
+		log.Printf("HEIC_CONVERTER not set; HEIC uploads are rejected")
+		return nil
+	}
+
+	if err := imaging.RegisterHEICConverter(command); err != nil {
+		return err
+	}
+	log.Printf("Decoding HEIC uploads with %s", command)
+	return nil
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// Processing memory budget used when DECODE_BUDGET_MB and DECODE_WAIT
+// are not set: room for a few of the largest images at once, with the
+// processed-image cache, waited for up to 30s
+const (
+	DefaultDecodeBudgetMB = 4096
+	DefaultDecodeWait     = 30 * time.Second
+)
+
+// DecodeBudget returns the bytes all images being processed may hold
+// at once, set in megabytes by DECODE_BUDGET_MB, and how long an image
+// may wait for its share, set by DECODE_WAIT as e.g. "30s". The
+// processed-image cache is part of the budget, so it must be larger
+// than IMAGE_CACHE_MB. A budget of 0 disables the limit.
+func DecodeBudget() (int64, time.Duration, error) {
+	budget := int64(DefaultDecodeBudgetMB) << 20
+	if value := os.Getenv("DECODE_BUDGET_MB"); value != "" {
+		mb, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || mb < 0 {
+			return 0, 0, fmt.Errorf("invalid DECODE_BUDGET_MB %q", value)
+		}
+		budget = mb << 20
+	}
+
+	wait := DefaultDecodeWait
+	if value := os.Getenv("DECODE_WAIT"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return 0, 0, fmt.Errorf("invalid DECODE_WAIT %q", value)
+		}
+		wait = duration
+	}
+
+	if budget > 0 {
+		cacheBytes, err := ImageCacheBytes()
+		if err != nil {
+			return 0, 0, err
+		}
+		if cacheBytes >= budget {
+			return 0, 0, fmt.Errorf("DECODE_BUDGET_MB (%d) must be larger than IMAGE_CACHE_MB (%d)", budget>>20, cacheBytes>>20)
+		}
+	}
+
+	return budget, wait, nil
+}
+
+var (
+	memoryGovernor     *imaging.MemoryGovernor
+	memoryGovernorOnce sync.Once
+)
+
+// MemoryGovernor returns the governor every image processed in the
+// process reserves its memory from, sized by DecodeBudget less the
+// processed-image cache, which holds its images for as long as it likes
+func MemoryGovernor() *imaging.MemoryGovernor {
+	memoryGovernorOnce.Do(func() {
+		budget, wait, err := DecodeBudget()
+		if err != nil {
+			log.Printf("Using default decode budget: %v", err)
+			budget, wait = int64(DefaultDecodeBudgetMB)<<20, DefaultDecodeWait
+		}
+		if budget > 0 {
+			cacheBytes, err := ImageCacheBytes()
+			if err != nil {
+				cacheBytes = DefaultImageCacheMB << 20
+			}
+			// -> DecodeBudget keeps the cache below the budget; when
+			// its values were refused, leave at least half the default
+			budget -= min(cacheBytes, budget/2)
+		}
+		memoryGovernor = imaging.NewMemoryGovernor(budget, wait)
+	})
+	return memoryGovernor
+}
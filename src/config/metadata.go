@@ -0,0 +1,20 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// MetadataPolicy returns the metadata kept in processed photos, listed
+// in PRESERVE_METADATA as any of "capture_date", "copyright" and "icc",
+// or "all". Nothing is kept when it is not set. GPS position and device
+// serials are always stripped.
+func MetadataPolicy() (imaging.MetadataPolicy, error) {
+	policy, err := imaging.ParseMetadataPolicy(os.Getenv("PRESERVE_METADATA"))
+	if err != nil {
+		return imaging.MetadataPolicy{}, fmt.Errorf("invalid PRESERVE_METADATA: %w", err)
+	}
+	return policy, nil
+}
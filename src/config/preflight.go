@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Actions for photos too small to print well
+const (
+	PoorPrintFlag   = "flag"   // -> print it, with a warning in the response
+	PoorPrintReject = "reject" // -> refuse the upload
+)
+
+// PoorPrintPolicy decides, per store, what happens to photos
+// whose effective DPI grades them poor
+type PoorPrintPolicy struct {
+	Default string
+	Stores  map[string]string // -> lower-case store name to action
+}
+
+// RejectsPoor reports whether the store refuses poor photos
+func (p PoorPrintPolicy) RejectsPoor(store string) bool {
+	if action, ok := p.Stores[strings.ToLower(strings.TrimSpace(store))]; ok {
+		return action == PoorPrintReject
+	}
+	return p.Default == PoorPrintReject
+}
+
+// PrintQualityPolicy reads PRINT_QUALITY_POLICY: a comma-separated
+// list of a default action and "store=action" overrides, for example
+// "flag,downtown=reject". Poor photos are flagged when it is not set.
+func PrintQualityPolicy() (PoorPrintPolicy, error) {
+	policy := PoorPrintPolicy{Default: PoorPrintFlag, Stores: make(map[string]string)}
+
+	value := os.Getenv("PRINT_QUALITY_POLICY")
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		store, action, perStore := strings.Cut(entry, "=")
+		if !perStore {
+			store, action = "", entry
+		}
+		action = strings.ToLower(strings.TrimSpace(action))
+		if action != PoorPrintFlag && action != PoorPrintReject {
+			return PoorPrintPolicy{}, fmt.Errorf("invalid PRINT_QUALITY_POLICY entry %q, expected %s or %s", entry, PoorPrintFlag, PoorPrintReject)
+		}
+
+		if perStore {
+			policy.Stores[strings.ToLower(strings.TrimSpace(store))] = action
+		} else {
+			policy.Default = action
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"image/color"
+	"os"
+	"strconv"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// PrintDPI returns the print resolution set by PRINT_DPI,
+// or imaging.DefaultDPI when it is not set.
+func PrintDPI() (int, error) {
+	value := os.Getenv("PRINT_DPI")
+	if value == "" {
+		return imaging.DefaultDPI, nil
+	}
+
+	dpi, err := strconv.Atoi(value)
+	if err != nil || dpi <= 0 {
+		return 0, fmt.Errorf("invalid PRINT_DPI %q", value)
+	}
+	return dpi, nil
+}
+
+// PrintBackground returns the paper color set by PRINT_BACKGROUND as
+// "#rrggbb", which transparent areas and letterboxing are printed
+// on, or imaging.PaperWhite when it is not set.
+func PrintBackground() (color.NRGBA, error) {
+	value := os.Getenv("PRINT_BACKGROUND")
+	if value == "" {
+		return imaging.PaperWhite, nil
+	}
+
+	background, err := imaging.ParseColor(value)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid PRINT_BACKGROUND: %w", err)
+	}
+	return background, nil
+}
+
+// ResamplingKernel returns the kernel photos are resized with, set by
+// RESAMPLING_KERNEL, or imaging.DefaultKernel when it is not set.
+func ResamplingKernel() (imaging.Kernel, error) {
+	kernel, err := imaging.ParseKernel(os.Getenv("RESAMPLING_KERNEL"))
+	if err != nil {
+		return "", fmt.Errorf("invalid RESAMPLING_KERNEL: %w", err)
+	}
+	return kernel, nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// anyMatch matches any store or paper in PRINT_PROFILES
+const anyMatch = "*"
+
+// PrintProfiles holds the ICC profile of each store's printer for
+// each paper, which print masters are converted to
+type PrintProfiles map[string]*imaging.ICCProfile // -> keyed by "store/paper", lower case
+
+// For returns the profile for a paper on a store's printer, trying
+// the store's own entry first, then any store, then any paper
+func (p PrintProfiles) For(store, paper string) *imaging.ICCProfile {
+	store = strings.ToLower(strings.TrimSpace(store))
+	paper = strings.ToLower(strings.TrimSpace(paper))
+	for _, key := range []string{store + "/" + paper, anyMatch + "/" + paper, store + "/" + anyMatch, anyMatch + "/" + anyMatch} {
+		if profile, ok := p[key]; ok {
+			return profile
+		}
+	}
+	return nil
+}
+
+// OutputProfiles reads PRINT_PROFILES: a comma-separated list of
+// "store/paper=path" entries naming RGB ICC profiles, where "*"
+// matches any store or paper, for example
+// "downtown/glossy=/etc/icc/downtown-glossy.icc,*/matte=/etc/icc/matte.icc".
+// Print masters stay in sRGB when it is not set. The profiles are
+// read once, and every later call returns the same profiles or error.
+func OutputProfiles() (PrintProfiles, error) {
+	outputProfilesOnce.Do(func() {
+		outputProfiles, outputProfilesErr = loadOutputProfiles()
+	})
+	return outputProfiles, outputProfilesErr
+}
+
+var (
+	outputProfiles     PrintProfiles
+	outputProfilesErr  error
+	outputProfilesOnce sync.Once
+)
+
+// loadOutputProfiles reads and parses the profiles in PRINT_PROFILES
+func loadOutputProfiles() (PrintProfiles, error) {
+	profiles := make(PrintProfiles)
+
+	for _, entry := range strings.Split(os.Getenv("PRINT_PROFILES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		target, path, ok := strings.Cut(entry, "=")
+		store, paper, hasPaper := strings.Cut(target, "/")
+		if !ok || !hasPaper || strings.TrimSpace(store) == "" || strings.TrimSpace(paper) == "" {
+			return nil, fmt.Errorf("invalid PRINT_PROFILES entry %q, expected store/paper=path", entry)
+		}
+
+		data, err := os.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PRINT_PROFILES entry %q: %w", entry, err)
+		}
+		profile, err := imaging.ParseICCProfile(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PRINT_PROFILES entry %q: %w", entry, err)
+		}
+		if profile.ColorSpace != imaging.ColorSpaceRGB {
+			return nil, fmt.Errorf("invalid PRINT_PROFILES entry %q: %s profile, printers take RGB", entry, profile.ColorSpace)
+		}
+
+		key := strings.ToLower(strings.TrimSpace(store) + "/" + strings.TrimSpace(paper))
+		profiles[key] = profile
+	}
+	return profiles, nil
+}
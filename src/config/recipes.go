@@ -0,0 +1,46 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/30Piraten/snapflow/imaging"
+	"gopkg.in/yaml.v3"
+)
+
+// Recipes returns the processing recipes listed in the JSON or YAML
+// file named by RECIPES_FILE. The file is read on every call, so
+// edited recipes apply to the next order. Without it there are no
+// recipes, and photos are processed as the other settings say.
+func Recipes() ([]imaging.Recipe, error) {
+	path := strings.TrimSpace(os.Getenv("RECIPES_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RECIPES_FILE: %w", err)
+	}
+
+	var recipes []imaging.Recipe
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &recipes)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &recipes)
+	default:
+		return nil, fmt.Errorf("RECIPES_FILE %s must be .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid RECIPES_FILE %s: %w", path, err)
+	}
+
+	if err := imaging.ValidateRecipes(recipes); err != nil {
+		return nil, fmt.Errorf("invalid RECIPES_FILE %s: %w", path, err)
+	}
+	return recipes, nil
+}
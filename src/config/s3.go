@@ -1,13 +1,12 @@
 package config
 
 import (
-	"bytes"
 	"context"
-	"fmt"
+	"io"
 	"log"
 	"os"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/30Piraten/snapflow/storage"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
@@ -34,19 +33,18 @@ type S3Bucket struct {
 }
 
 // UploadToS3 uploads a file to an S3 bucket. UploadToS3 takes an S3 client,
-// the bucketName, key for the uploaded file, fileData and region the bucket,
-// is in. It returns an error if the upload fails.
-func UploadToS3(s3Client *s3.Client, bucketName, key string, fileData []byte, region string) error {
-
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(fileData),
-	}
+// the bucketName, key for the uploaded file, a reader for the file and
+// the region the bucket is in. The body is streamed with a multipart
+// upload, so it is never held in memory as a whole. It returns an error
+// if the upload fails. New code should write through the storage.Storage
+// returned by ObjectStore instead.
+func UploadToS3(s3Client *s3.Client, bucketName, key string, body io.Reader, region string) error {
+
+	store := storage.NewS3Storage(s3Client, bucketName)
 
-	_, err := s3Client.PutObject(context.TODO(), input)
+	err := store.Put(context.TODO(), key, body, storage.PutOptions{})
 	if err != nil {
-		return fmt.Errorf("error uploading to S3: %w", err)
+		return err
 	}
 
 	log.Printf("File successfully uploaded to S3: s3://%s/%s\n", bucketName, key)
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// Sharpening reports whether resized photos are sharpened, as set by
+// SHARPEN. "off" disables it and "radius,amount,threshold" uses one
+// mask for every print. When it is not set, photos are sharpened with
+// the mask tuned for their print size, returned here as a zero mask.
+func Sharpening() (bool, imaging.UnsharpMask, error) {
+	value := strings.TrimSpace(os.Getenv("SHARPEN"))
+	switch strings.ToLower(value) {
+	case "", "on", "auto":
+		return true, imaging.UnsharpMask{}, nil
+	case "off", "none":
+		return false, imaging.UnsharpMask{}, nil
+	}
+
+	mask, err := imaging.ParseUnsharpMask(value)
+	if err != nil {
+		return false, imaging.UnsharpMask{}, fmt.Errorf("invalid SHARPEN: %w", err)
+	}
+	return true, mask, nil
+}
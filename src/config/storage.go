@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
+)
+
+var objectStore storage.Storage
+
+// Key templates for processed photos and presigned uploads
+var (
+	objectKeys *storage.KeyTemplate
+	uploadKeys *storage.KeyTemplate
+)
+
+// InitStorage initializes the storage backend selected by
+// STORAGE_BACKEND. "s3" (the default) stores objects in BUCKET_NAME,
+// "local" stores them on disk below models.ProcessedImageDir.
+func InitStorage() error {
+	if err := initKeyTemplates(); err != nil {
+		return err
+	}
+
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "s3":
+		bucketName := os.Getenv("BUCKET_NAME")
+		if os.Getenv("AWS_REGION") == "" || bucketName == "" {
+			return fmt.Errorf("AWS_REGION and BUCKET_NAME must be set for the s3 storage backend")
+		}
+
+		s3Client, err := S3Client()
+		if err != nil {
+			return fmt.Errorf("failed to initialize s3 client: %w", err)
+		}
+		s3Store := storage.NewS3Storage(s3Client, bucketName)
+
+		// Multipart tuning for large uploads
+		if s3Store.Multipart, err = multipartConfig(s3Store.Multipart); err != nil {
+			return err
+		}
+		objectStore = s3Store
+
+	case "local":
+		// LOCAL_STORAGE_URL is where the local storage
+		// handler is reachable, e.g. http://127.0.0.1:1234/local-storage
+		secret := os.Getenv("LOCAL_STORAGE_SECRET")
+		if secret == "" {
+			return fmt.Errorf("LOCAL_STORAGE_SECRET must be set for the local storage backend")
+		}
+
+		local, err := storage.NewLocalStorage(models.ProcessedImageDir, os.Getenv("LOCAL_STORAGE_URL"), []byte(secret))
+		if err != nil {
+			return err
+		}
+		objectStore = local
+
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND: %q", backend)
+	}
+
+	log.Printf("Storage backend initialized: %T", objectStore)
+	return nil
+}
+
+// ObjectStore returns the configured storage backend,
+// initializing it on first use.
+func ObjectStore() storage.Storage {
+	if objectStore == nil {
+		if err := InitStorage(); err != nil {
+			log.Fatalf("Failed to initialize storage: %v", err)
+		}
+	}
+	return objectStore
+}
+
+// multipartConfig overrides the defaults with STORAGE_PART_SIZE_MB
+// and STORAGE_UPLOAD_CONCURRENCY when they are set.
+func multipartConfig(defaults storage.MultipartConfig) (storage.MultipartConfig, error) {
+	cfg := defaults
+
+	if value := os.Getenv("STORAGE_PART_SIZE_MB"); value != "" {
+		partSizeMB, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid STORAGE_PART_SIZE_MB %q: %w", value, err)
+		}
+		cfg.PartSize = partSizeMB * 1024 * 1024
+	}
+
+	if value := os.Getenv("STORAGE_UPLOAD_CONCURRENCY"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid STORAGE_UPLOAD_CONCURRENCY %q: %w", value, err)
+		}
+		cfg.Concurrency = concurrency
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// initKeyTemplates parses OBJECT_KEY_TEMPLATE and UPLOAD_KEY_TEMPLATE,
+// falling back to the defaults, so a bad layout fails at startup
+// rather than on the first upload.
+func initKeyTemplates() error {
+	objectTemplate, err := keyTemplate("OBJECT_KEY_TEMPLATE", storage.DefaultObjectKeyTemplate)
+	if err != nil {
+		return err
+	}
+
+	uploadTemplate, err := keyTemplate("UPLOAD_KEY_TEMPLATE", storage.DefaultUploadKeyTemplate)
+	if err != nil {
+		return err
+	}
+	// Presigned uploads are keyed before their bytes are known
+	if uploadTemplate.Uses(storage.FieldHash) {
+		return fmt.Errorf("UPLOAD_KEY_TEMPLATE cannot use {%s}: the upload is not hashed until it arrives", storage.FieldHash)
+	}
+	// Each order uploads below its own directory
+	if !uploadTemplate.DirUses(storage.FieldOrderID) {
+		return fmt.Errorf("UPLOAD_KEY_TEMPLATE must use {%s} in its directory, so orders never share one", storage.FieldOrderID)
+	}
+
+	objectKeys, uploadKeys = objectTemplate, uploadTemplate
+	return nil
+}
+
+// keyTemplate parses the key template in the named environment
+// variable, or fallback when it is not set.
+func keyTemplate(name, fallback string) (*storage.KeyTemplate, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		raw = fallback
+	}
+
+	tmpl, err := storage.ParseKeyTemplate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// ObjectKeyTemplate returns the key template of processed photos
+func ObjectKeyTemplate() *storage.KeyTemplate {
+	if objectKeys == nil {
+		if err := initKeyTemplates(); err != nil {
+			log.Fatalf("Failed to initialize key templates: %v", err)
+		}
+	}
+	return objectKeys
+}
+
+// UploadKeyTemplate returns the key template of presigned uploads
+func UploadKeyTemplate() *storage.KeyTemplate {
+	if uploadKeys == nil {
+		if err := initKeyTemplates(); err != nil {
+			log.Fatalf("Failed to initialize key templates: %v", err)
+		}
+	}
+	return uploadKeys
+}
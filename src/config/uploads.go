@@ -0,0 +1,36 @@
+package config
+
+import (
+	"context"
+	"os"
+
+	"github.com/30Piraten/snapflow/upload"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+var uploadCompletion *upload.CompletionHandler
+
+// UploadCompletion returns the handler that verifies uploaded photos
+// and sends an order to print once every photo has arrived. It handles
+// only the keys laid out by UploadKeyTemplate, tracks orders in
+// DynamoDB, enqueues print jobs with SendPrintRequest, and decodes
+// within the process's MemoryGovernor budget.
+func UploadCompletion() *upload.CompletionHandler {
+	if uploadCompletion == nil {
+		uploadCompletion = upload.NewCompletionHandler(ObjectStore(), UploadKeyTemplate(), DynamoOrderTracker{}, SendPrintRequest, MemoryGovernor())
+	}
+	return uploadCompletion
+}
+
+// SQSClient returns an SQS client for AWS_REGION
+func SQSClient() (*sqs.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(os.Getenv("AWS_REGION")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqs.NewFromConfig(cfg), nil
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/services"
+	"github.com/30Piraten/snapflow/storage"
+	"github.com/30Piraten/snapflow/url"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Headers that identify who asks for an order's download URLs
+const (
+	CustomerEmailHeader = "X-Customer-Email"
+	StaffTokenHeader    = "X-Staff-Token"
+)
+
+// Download configures the route that returns CloudFront signed
+// download URLs for the processed photos of an order. The route is
+// left out when CloudFront signing is not configured. Store staff
+// authenticate with the token in DOWNLOAD_STAFF_TOKEN.
+func Download(app *fiber.App) {
+	signer, err := url.NewCloudFrontSignerFromEnv()
+	if err != nil {
+		log.Printf("CloudFront signed download URLs disabled: %v", err)
+		return
+	}
+
+	app.Get("/orders/:orderID/download-urls", HandleDownloadURLs(signer, os.Getenv("DOWNLOAD_STAFF_TOKEN")))
+}
+
+// canDownload reports whether the request comes from the customer
+// who placed the order or from staff holding staffToken. An empty
+// staffToken lets no one in as staff.
+func canDownload(c *fiber.Ctx, manifest *models.OrderManifest, staffToken string) bool {
+	if token := c.Get(StaffTokenHeader); staffToken != "" && token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(staffToken)) == 1 {
+			return true
+		}
+	}
+
+	email := strings.TrimSpace(c.Get(CustomerEmailHeader))
+	return email != "" && manifest.CustomerEmail != "" && strings.EqualFold(email, manifest.CustomerEmail)
+}
+
+// HandleDownloadURLs returns a signed URL for every photo linked to
+// the order's manifest. The caller must send the order's email in
+// the X-Customer-Email header, or staffToken in X-Staff-Token. Pass
+// ?policy=custom to sign with a custom policy, and &bind_ip=true to
+// restrict the URLs to the caller's IP address. ?rendition=preview or
+// thumbnail signs the smaller renditions instead of the print master;
+// photos without one are left out.
+//
+// Only photos processed by the server are in a manifest. An order
+// uploaded straight to storage with presigned URLs has none, so it
+// gets a 404 saying there are no processed photos to download.
+func HandleDownloadURLs(signer *url.CloudFrontSigner, staffToken string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		orderID := c.Params("orderID")
+
+		manifest, err := services.LoadOrderManifest(c.Context(), config.ObjectStore(), orderID)
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "order has no processed photos to download; photos uploaded with presigned URLs are not processed by the server",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if !canDownload(c, manifest, staffToken) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "not allowed to download this order",
+			})
+		}
+
+		custom := c.Query("policy") == "custom"
+		renditionName := c.Query("rendition", services.RenditionPrint)
+		switch renditionName {
+		case services.RenditionPrint, services.RenditionPreview, services.RenditionThumbnail:
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unknown rendition " + renditionName,
+			})
+		}
+
+		var policy url.CustomPolicy
+		if c.QueryBool("bind_ip") {
+			policy.SourceIP = sourceIPRange(c.IP())
+		}
+
+		signedURLs := make([]*models.SignedURLInfo, 0, len(manifest.Photos))
+		for _, photo := range manifest.Photos {
+			rendition, ok := services.FindRendition(photo, renditionName)
+			if !ok {
+				continue
+			}
+
+			var info *models.SignedURLInfo
+			if custom {
+				info, err = signer.SignCustom(rendition.Key, policy)
+			} else {
+				info, err = signer.SignCanned(rendition.Key)
+			}
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+
+			info.OrderID = orderID
+			info.CustomerName = manifest.CustomerName
+			info.Rendition = rendition.Name
+			signedURLs = append(signedURLs, info)
+		}
+
+		return c.JSON(fiber.Map{
+			"order_id": orderID,
+			"urls":     signedURLs,
+		})
+	}
+}
+
+// sourceIPRange returns the CIDR range matching only ip, which is
+// /32 for an IPv4 address and /128 for an IPv6 one
+func sourceIPRange(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip + "/32"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String() + "/32"
+	}
+	return parsed.String() + "/128"
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/30Piraten/snapflow/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCanDownload(t *testing.T) {
+	manifest := &models.OrderManifest{OrderID: "42", CustomerEmail: "Ada@Example.com"}
+
+	tests := []struct {
+		name       string
+		staffToken string
+		headers    map[string]string
+		want       bool
+	}{
+		{"no credentials", "staff-secret", nil, false},
+		{"customer email", "", map[string]string{CustomerEmailHeader: "ada@example.com"}, true},
+		{"other email", "", map[string]string{CustomerEmailHeader: "eve@example.com"}, false},
+		{"staff token", "staff-secret", map[string]string{StaffTokenHeader: "staff-secret"}, true},
+		{"wrong staff token", "staff-secret", map[string]string{StaffTokenHeader: "guess"}, false},
+		{"staff disabled", "", map[string]string{StaffTokenHeader: ""}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				if canDownload(c, manifest, test.staffToken) {
+					return c.SendStatus(fiber.StatusOK)
+				}
+				return c.SendStatus(fiber.StatusForbidden)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if got := resp.StatusCode == fiber.StatusOK; got != test.want {
+				t.Errorf("canDownload = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// An order saved before emails were recorded is staff only
+	t.Run("manifest without email", func(t *testing.T) {
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			if canDownload(c, &models.OrderManifest{OrderID: "7"}, "") {
+				return c.SendStatus(fiber.StatusOK)
+			}
+			return c.SendStatus(fiber.StatusForbidden)
+		})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(CustomerEmailHeader, " ")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		if resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("status = %d, want 403", resp.StatusCode)
+		}
+	})
+}
+
+func TestSourceIPRange(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.7":           "203.0.113.7/32",
+		"2001:db8::1":           "2001:db8::1/128",
+		"2001:0db8:0:0:0:0:0:1": "2001:db8::1/128",
+		"::ffff:203.0.113.7":    "203.0.113.7/32",
+	}
+	for ip, want := range tests {
+		if got := sourceIPRange(ip); got != want {
+			t.Errorf("sourceIPRange(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
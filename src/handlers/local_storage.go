@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/url"
+
+	"github.com/30Piraten/snapflow/storage"
+	"github.com/30Piraten/snapflow/upload"
+	"github.com/gofiber/fiber/v2"
+)
+
+// LocalStorage registers the endpoints that serve presigned URLs
+// issued by the local storage backend. It is only mounted when
+// STORAGE_BACKEND is "local" and stands in for S3 during development.
+// Stored uploads are handed to completion in-process, the way S3
+// ObjectCreated events reach it in production.
+func LocalStorage(app *fiber.App, store *storage.LocalStorage, completion *upload.CompletionHandler) {
+	app.Post("/local-storage", handleLocalPost(store, completion))
+	app.Put("/local-storage/*", handleLocalPut(store, completion))
+	app.Get("/local-storage/*", handleLocalGet(store))
+}
+
+// handleLocalPut stores the request body under the presigned key
+func handleLocalPut(store *storage.LocalStorage, completion *upload.CompletionHandler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key, err := url.PathUnescape(c.Params("*"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid key"})
+		}
+
+		metadata, err := store.VerifyPresigned(fiber.MethodPut, key, queryValues(c))
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		err = store.Put(c.Context(), key, bytes.NewReader(c.Body()), storage.PutOptions{
+			ContentType: c.Get(fiber.HeaderContentType),
+			Metadata:    metadata,
+		})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		completeUpload(c, completion, key)
+
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
+
+// handleLocalPost stores the file of a form POST once its fields
+// satisfy the policy issued by LocalStorage.PresignPost
+func handleLocalPost(store *storage.LocalStorage, completion *upload.CompletionHandler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid multipart form"})
+		}
+
+		files := form.File["file"]
+		if len(files) != 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "exactly one file is required"})
+		}
+
+		fields := make(map[string]string, len(form.Value))
+		for name, values := range form.Value {
+			if len(values) > 0 {
+				fields[name] = values[0]
+			}
+		}
+
+		key, opts, err := store.VerifyPost(fields, files[0].Size)
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		file, err := files[0].Open()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer file.Close()
+
+		if err := store.Put(c.Context(), key, file, opts); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		completeUpload(c, completion, key)
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// handleLocalGet streams the object stored under the presigned key
+func handleLocalGet(store *storage.LocalStorage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key, err := url.PathUnescape(c.Params("*"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid key"})
+		}
+
+		if _, err := store.VerifyPresigned(fiber.MethodGet, key, queryValues(c)); err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		body, info, err := store.Get(c.Context(), key)
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if info.ContentType != "" {
+			c.Set(fiber.HeaderContentType, info.ContentType)
+		}
+		return c.SendStream(body, int(info.Size))
+	}
+}
+
+// completeUpload hands a stored upload to the completion handler.
+// The upload itself succeeded, so a failure is only logged.
+func completeUpload(c *fiber.Ctx, completion *upload.CompletionHandler, key string) {
+	if err := completion.HandleObject(c.Context(), key); err != nil {
+		log.Printf("Upload completion failed for %s: %v", key, err)
+	}
+}
+
+// queryValues copies the request's query string into url.Values
+func queryValues(c *fiber.Ctx) url.Values {
+	values, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	return values
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"github.com/30Piraten/snapflow/config"
 	"github.com/30Piraten/snapflow/models"
 	"github.com/30Piraten/snapflow/url"
 	"github.com/gofiber/fiber/v2"
@@ -17,6 +18,8 @@ func Upload(app *fiber.App) {
 // HandleGenerateUploadURL handles the request to generate a
 // presigned URL for uploading a photo to S3. It expects a JSON body
 // containing the required fields for generating a presigned URL.
+// With ?method=post it returns presigned POST policies instead,
+// which constrain the size and type of the uploaded photos.
 func HandleGenerateUploadURL(c *fiber.Ctx) error {
 
 	// Parse the form data from the page into the defined struct.
@@ -28,7 +31,12 @@ func HandleGenerateUploadURL(c *fiber.Ctx) error {
 		})
 	}
 
-	response, err := url.GeneratePresignedURL(order)
+	generate := url.GeneratePresignedURL
+	if c.Query("method") == "post" {
+		generate = url.GeneratePresignedPost
+	}
+
+	response, err := generate(order, config.ObjectStore())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
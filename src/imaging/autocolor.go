@@ -0,0 +1,261 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AutoColor sets the strength, from 0 to 1, of each automatic color
+// correction. The zero value corrects nothing.
+type AutoColor struct {
+	Levels       float64 // -> stretch each channel to the full tonal range
+	WhiteBalance float64 // -> neutralise casts so the average is grey
+	Contrast     float64 // -> lift flat photos towards a typical contrast
+	Saturation   float64 // -> lift dull photos towards a typical colorfulness
+}
+
+// DefaultAutoColor is the correction the editors applied by hand
+var DefaultAutoColor = AutoColor{Levels: 1, WhiteBalance: 0.8, Contrast: 0.5, Saturation: 0.5}
+
+// Limits keeping the automatic correction gentle
+const (
+	levelsClip      = 0.005 // -> fraction of each channel clipped at either end
+	maxLevelsScale  = 2     // -> a nearly flat channel is not stretched further
+	maxWhiteGain    = 1.25  // -> a channel is not scaled further to neutralise a cast
+	maxAutoContrast = 0.25
+	maxAutoSaturate = 0.2
+	targetLumaSD    = 0.22 // -> luma standard deviation of a typical photo
+	targetChroma    = 0.25 // -> average chroma of a typical photo
+	maxColorSamples = 1 << 19
+)
+
+// ParseAutoColor parses strengths written "levels,white_balance,contrast,saturation"
+func ParseAutoColor(value string) (AutoColor, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return AutoColor{}, fmt.Errorf("auto color %q must be levels,white_balance,contrast,saturation", value)
+	}
+
+	var strengths [4]float64
+	for i, part := range parts {
+		strength, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return AutoColor{}, fmt.Errorf("invalid auto color strength %q", part)
+		}
+		strengths[i] = strength
+	}
+
+	a := AutoColor{Levels: strengths[0], WhiteBalance: strengths[1], Contrast: strengths[2], Saturation: strengths[3]}
+	return a, a.validate()
+}
+
+// validate reports whether every strength is between 0 and 1
+func (a AutoColor) validate() error {
+	for _, strength := range []float64{a.Levels, a.WhiteBalance, a.Contrast, a.Saturation} {
+		if strength < 0 || strength > 1 {
+			return fmt.Errorf("auto color strength %g is outside 0 to 1", strength)
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether any correction is applied
+func (a AutoColor) Enabled() bool {
+	return a.Levels > 0 || a.WhiteBalance > 0 || a.Contrast > 0 || a.Saturation > 0
+}
+
+// ColorCorrection records the corrections applied to a photo, so they
+// can be audited and undone. Levels and white balance are applied as
+// out = in*Scale + Offset per channel, on 0-255 values, followed by
+// the Contrast and Saturation of a ColorAdjustment.
+type ColorCorrection struct {
+	Black      [3]uint8   `json:"black"` // -> measured black point of red, green and blue
+	White      [3]uint8   `json:"white"` // -> measured white point
+	Gain       [3]float64 `json:"gain"`  // -> white-balance gain
+	Scale      [3]float64 `json:"scale"`
+	Offset     [3]float64 `json:"offset"`
+	Contrast   float64    `json:"contrast"`
+	Saturation float64    `json:"saturation"`
+}
+
+// AutoCorrectColor measures img and returns it corrected as a says,
+// with the corrections applied
+func AutoCorrectColor(img image.Image, a AutoColor) (image.Image, *ColorCorrection, error) {
+	if err := a.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	correction := measureColor(img, a)
+	corrected, err := correction.Apply(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	return corrected, correction, nil
+}
+
+// measureColor works out the correction for img from a sample of
+// its pixels
+func measureColor(img image.Image, a AutoColor) *ColorCorrection {
+	samples := sampleRGB(img)
+	correction := &ColorCorrection{Scale: [3]float64{1, 1, 1}, Gain: [3]float64{1, 1, 1}}
+	if len(samples) == 0 {
+		return correction
+	}
+
+	// Auto-levels: stretch each channel between its percentiles
+	var sums [3]float64
+	for c := 0; c < 3; c++ {
+		var histogram [256]int
+		for i := c; i < len(samples); i += 3 {
+			histogram[samples[i]]++
+			sums[c] += float64(samples[i])
+		}
+		black, white := percentiles(histogram, len(samples)/3)
+		correction.Black[c], correction.White[c] = black, white
+
+		if white > black {
+			scale := math.Min(255/float64(white-black), maxLevelsScale)
+			correction.Scale[c] = 1 + a.Levels*(scale-1)
+			correction.Offset[c] = -a.Levels * float64(black) * scale
+		}
+	}
+
+	// Gray-world white balance on the levelled means, which follow
+	// from the linear levels without another pass
+	pixels := float64(len(samples) / 3)
+	var means [3]float64
+	for c := range means {
+		means[c] = sums[c]/pixels*correction.Scale[c] + correction.Offset[c]
+	}
+	grey := (means[0] + means[1] + means[2]) / 3
+	for c := range means {
+		if means[c] > 0 && grey > 0 {
+			gain := math.Min(math.Max(grey/means[c], 1/maxWhiteGain), maxWhiteGain)
+			correction.Gain[c] = 1 + a.WhiteBalance*(gain-1)
+		}
+		correction.Scale[c] *= correction.Gain[c]
+		correction.Offset[c] *= correction.Gain[c]
+	}
+
+	// Contrast and saturation, only for photos flatter or duller
+	// than is typical once levelled and balanced
+	if a.Contrast > 0 || a.Saturation > 0 {
+		var lumaSum, lumaSquares, chroma float64
+		for i := 0; i+2 < len(samples); i += 3 {
+			var rgb [3]float64
+			for c := range rgb {
+				rgb[c] = math.Min(math.Max(float64(samples[i+c])*correction.Scale[c]+correction.Offset[c], 0), 255) / 255
+			}
+			luma := 0.299*rgb[0] + 0.587*rgb[1] + 0.114*rgb[2]
+			lumaSum += luma
+			lumaSquares += luma * luma
+			chroma += math.Max(rgb[0], math.Max(rgb[1], rgb[2])) - math.Min(rgb[0], math.Min(rgb[1], rgb[2]))
+		}
+		mean := lumaSum / pixels
+		sd := math.Sqrt(math.Max(lumaSquares/pixels-mean*mean, 0))
+		chroma /= pixels
+
+		correction.Contrast = a.Contrast * maxAutoContrast * math.Max(0, (targetLumaSD-sd)/targetLumaSD)
+		correction.Saturation = a.Saturation * maxAutoSaturate * math.Max(0, (targetChroma-chroma)/targetChroma)
+	}
+	return correction
+}
+
+// sampleRGB returns the 8-bit red, green and blue of up to
+// maxColorSamples pixels of img, spread evenly over it
+func sampleRGB(img image.Image) []uint8 {
+	bounds := img.Bounds()
+	total := bounds.Dx() * bounds.Dy()
+	step := 1
+	for total/(step*step) > maxColorSamples {
+		step++
+	}
+
+	samples := make([]uint8, 0, min(total, maxColorSamples)*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			// -> measure the color, not its premultiplied value
+			samples = append(samples, uint8(r*0xff/a), uint8(g*0xff/a), uint8(b*0xff/a))
+		}
+	}
+	return samples
+}
+
+// percentiles returns the values below which levelsClip of a channel's
+// count values lie, and above which they lie
+func percentiles(histogram [256]int, count int) (uint8, uint8) {
+	clip := int(float64(count) * levelsClip)
+
+	black, seen := 0, 0
+	for ; black < 255; black++ {
+		if seen += histogram[black]; seen > clip {
+			break
+		}
+	}
+	white, seen := 255, 0
+	for ; white > 0; white-- {
+		if seen += histogram[white]; seen > clip {
+			break
+		}
+	}
+	return uint8(black), uint8(max(white, black))
+}
+
+// Apply returns a copy of img with the correction applied
+func (c *ColorCorrection) Apply(img image.Image) (image.Image, error) {
+	img = applyChannelCurves(img, c.Scale, c.Offset)
+	return AdjustColor(img, ColorAdjustment{Contrast: c.Contrast, Saturation: c.Saturation})
+}
+
+// Undo returns a copy of img with the correction reversed, as far as
+// values clipped by it allow
+func (c *ColorCorrection) Undo(img image.Image) (image.Image, error) {
+	// -> saturation scales chroma by 1+s around an unchanged luma
+	img, err := AdjustColor(img, ColorAdjustment{Saturation: 1/(1+c.Saturation) - 1})
+	if err != nil {
+		return nil, err
+	}
+
+	// -> contrast scales tones around mid-grey by tan((c+1)π/4)
+	inverse := 4/math.Pi*math.Atan(1/math.Tan((c.Contrast+1)*math.Pi/4)) - 1
+	if img, err = AdjustColor(img, ColorAdjustment{Contrast: inverse}); err != nil {
+		return nil, err
+	}
+
+	var scale, offset [3]float64
+	for i := range scale {
+		scale[i] = 1 / c.Scale[i]
+		offset[i] = -c.Offset[i] / c.Scale[i]
+	}
+	return applyChannelCurves(img, scale, offset), nil
+}
+
+// applyChannelCurves returns a copy of img with each channel mapped
+// through in*scale + offset
+func applyChannelCurves(img image.Image, scale, offset [3]float64) image.Image {
+	var luts [3][256]uint8
+	for c := range luts {
+		for v := range luts[c] {
+			luts[c][v] = clampUint8(float32(float64(v)*scale[c] + offset[c]))
+		}
+	}
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+bounds.Dx()*4]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2] = luts[0][row[i]], luts[1][row[i+1]], luts[2][row[i+2]]
+		}
+	}
+	return out
+}
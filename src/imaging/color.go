@@ -0,0 +1,89 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// ColorAdjustment is a tonal and color correction. The zero value
+// leaves an image unchanged.
+type ColorAdjustment struct {
+	Brightness float64 // -> -1 to 1, added to every channel
+	Contrast   float64 // -> -1 to 1, stretching tones away from mid-grey
+	Saturation float64 // -> -1 to 1, -1 turns the image grey
+	Gamma      float64 // -> above 1 lightens the midtones, 0 means 1
+}
+
+// validate reports whether the adjustment is within its ranges
+func (a ColorAdjustment) validate() error {
+	for name, value := range map[string]float64{"brightness": a.Brightness, "contrast": a.Contrast, "saturation": a.Saturation} {
+		if value < -1 || value > 1 {
+			return fmt.Errorf("%s %g is outside -1 to 1", name, value)
+		}
+	}
+	if a.Gamma < 0 || a.Gamma > 10 {
+		return fmt.Errorf("gamma %g is outside 0 to 10", a.Gamma)
+	}
+	return nil
+}
+
+// identity reports whether the adjustment changes nothing
+func (a ColorAdjustment) identity() bool {
+	return a.Brightness == 0 && a.Contrast == 0 && a.Saturation == 0 && (a.Gamma == 0 || a.Gamma == 1)
+}
+
+// AdjustColor returns a copy of img with the adjustment applied.
+// Brightness, contrast and gamma are applied through a lookup table
+// per channel, then saturation against each pixel's luma.
+func AdjustColor(img image.Image, a ColorAdjustment) (image.Image, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	if a.identity() {
+		return img, nil
+	}
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+
+	lut := toneCurve(a)
+	saturation := 1 + a.Saturation
+	for y := 0; y < bounds.Dy(); y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+bounds.Dx()*4]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := lut[row[i]], lut[row[i+1]], lut[row[i+2]]
+			if saturation != 1 {
+				luma := 0.299*float32(r) + 0.587*float32(g) + 0.114*float32(b)
+				s := float32(saturation)
+				r = clampUint8(luma + (float32(r)-luma)*s)
+				g = clampUint8(luma + (float32(g)-luma)*s)
+				b = clampUint8(luma + (float32(b)-luma)*s)
+			}
+			row[i], row[i+1], row[i+2] = r, g, b
+		}
+	}
+	return out, nil
+}
+
+// toneCurve returns the lookup table for the brightness, contrast
+// and gamma of an adjustment
+func toneCurve(a ColorAdjustment) [256]uint8 {
+	gamma := a.Gamma
+	if gamma == 0 {
+		gamma = 1
+	}
+	// -> a contrast of 1 is a hard threshold, so it is capped short of it
+	contrast := math.Tan((math.Min(a.Contrast, 0.99) + 1) * math.Pi / 4)
+
+	var lut [256]uint8
+	for i := range lut {
+		v := float64(i) / 255
+		v = math.Pow(v, 1/gamma)
+		v = (v-0.5)*contrast + 0.5 + a.Brightness
+		lut[i] = clampUint8(float32(v * 255))
+	}
+	return lut
+}
@@ -0,0 +1,374 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// D50 XYZ, the ICC profile connection space, to and from linear
+// sRGB, Bradford-adapted from sRGB's D65 white
+var (
+	xyzToLinearSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+	linearSRGBToXYZ = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	d50White = [3]float64{0.9642, 1, 0.8249}
+)
+
+// linearTableSize is the precision of the tables that encode
+// linear values back to 8 bits
+const linearTableSize = 4096
+
+// ConvertToSRGB returns img converted from the color space of the
+// embedded profile to sRGB. Images without a profile, or already in
+// sRGB, are returned as they are; so are untagged CMYK images, which
+// the JPEG encoder converts naively. ErrUnsupportedProfile is returned
+// for profiles that cannot be evaluated.
+func ConvertToSRGB(img image.Image, profile *ICCProfile) (image.Image, error) {
+	if profile == nil || profile.IsSRGB() {
+		return img, nil
+	}
+
+	cmyk, isCMYK := img.(*image.CMYK)
+	switch {
+	case isCMYK != (profile.ColorSpace == ColorSpaceCMYK):
+		return nil, fmt.Errorf("%w: %s profile for a %T", ErrUnsupportedProfile, profile.ColorSpace, img)
+	case isCMYK && profile.toPCS != nil:
+		return cmykToSRGB(cmyk, profile)
+	case profile.ColorSpace == ColorSpaceRGB && profile.matrix != nil:
+		return matrixToSRGB(img, profile), nil
+	case profile.ColorSpace == ColorSpaceRGB && profile.toPCS != nil:
+		return lutToSRGB(img, profile), nil
+	case profile.ColorSpace == ColorSpaceGray && len(profile.curves) == 1:
+		return grayToSRGB(img, profile.curves[0]), nil
+	}
+	return nil, fmt.Errorf("%w: %s %s profile %q", ErrUnsupportedProfile, profile.ColorSpace, profile.Class, profile.Description)
+}
+
+// ConvertFromSRGB returns img, in sRGB, converted to the RGB color
+// space of an output profile, such as a printer's for one paper
+func ConvertFromSRGB(img image.Image, profile *ICCProfile) (image.Image, error) {
+	if profile.ColorSpace != ColorSpaceRGB {
+		return nil, fmt.Errorf("%w: output profile must be RGB, not %s", ErrUnsupportedProfile, profile.ColorSpace)
+	}
+	if profile.IsSRGB() {
+		return img, nil
+	}
+
+	toLinear := srgbDecodeTable()
+	if profile.fromPCS != nil {
+		// Printer profiles map colors through their perceptual table
+		return mapRGB(img, true, func(r, g, b uint8) (uint8, uint8, uint8) {
+			xyz := mulMatrix(linearSRGBToXYZ, [3]float64{toLinear[r], toLinear[g], toLinear[b]})
+			in := encodePCS(xyz, profile.PCS, profile.fromPCS.lut8)
+			var out [4]float64
+			profile.fromPCS.Eval(in[:], out[:])
+			return unit8(out[0]), unit8(out[1]), unit8(out[2])
+		}), nil
+	}
+	if profile.matrix == nil {
+		return nil, fmt.Errorf("%w: output profile %q has no transform from the PCS", ErrUnsupportedProfile, profile.Description)
+	}
+
+	inverse, ok := invert(*profile.matrix)
+	if !ok {
+		return nil, fmt.Errorf("%w: output profile %q has a singular matrix", ErrUnsupportedProfile, profile.Description)
+	}
+	var encode [3][]uint8
+	for c := range encode {
+		encode[c] = inverseCurveTable(profile.curves[c])
+	}
+	toDevice := mulMatrices(inverse, linearSRGBToXYZ)
+	return mapRGB(img, false, func(r, g, b uint8) (uint8, uint8, uint8) {
+		device := mulMatrix(toDevice, [3]float64{toLinear[r], toLinear[g], toLinear[b]})
+		return encode[0][linearIndex(device[0])], encode[1][linearIndex(device[1])], encode[2][linearIndex(device[2])]
+	}), nil
+}
+
+// matrixToSRGB converts img through the primaries and tone curves
+// of a matrix/TRC profile
+func matrixToSRGB(img image.Image, profile *ICCProfile) image.Image {
+	var toLinear [3][256]float64
+	for c := range toLinear {
+		for v := range toLinear[c] {
+			toLinear[c][v] = profile.curves[c].Eval(float64(v) / 255)
+		}
+	}
+	toSRGB := mulMatrices(xyzToLinearSRGB, *profile.matrix)
+	encode := srgbEncodeTable()
+
+	return mapRGB(img, false, func(r, g, b uint8) (uint8, uint8, uint8) {
+		linear := mulMatrix(toSRGB, [3]float64{toLinear[0][r], toLinear[1][g], toLinear[2][b]})
+		return encode[linearIndex(linear[0])], encode[linearIndex(linear[1])], encode[linearIndex(linear[2])]
+	})
+}
+
+// lutToSRGB converts img through the perceptual table of an RGB profile
+func lutToSRGB(img image.Image, profile *ICCProfile) image.Image {
+	encode := srgbEncodeTable()
+	return mapRGB(img, true, func(r, g, b uint8) (uint8, uint8, uint8) {
+		var pcs [4]float64
+		profile.toPCS.Eval([]float64{float64(r) / 255, float64(g) / 255, float64(b) / 255}, pcs[:])
+		linear := mulMatrix(xyzToLinearSRGB, decodePCS(pcs, profile.PCS, profile.toPCS.lut8))
+		return encode[linearIndex(linear[0])], encode[linearIndex(linear[1])], encode[linearIndex(linear[2])]
+	})
+}
+
+// cmykToSRGB converts a CMYK image through the perceptual table of
+// its profile. Go's decoders undo the inversion of Adobe CMYK and
+// YCCK JPEGs, so 0 is always no ink.
+func cmykToSRGB(img *image.CMYK, profile *ICCProfile) (image.Image, error) {
+	if profile.toPCS.inputs != 4 || profile.toPCS.outputs != 3 {
+		return nil, fmt.Errorf("%w: CMYK table is %d-in %d-out", ErrUnsupportedProfile, profile.toPCS.inputs, profile.toPCS.outputs)
+	}
+
+	encode := srgbEncodeTable()
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	converted := make(map[uint32][3]uint8)
+	for y := 0; y < bounds.Dy(); y++ {
+		src := img.Pix[y*img.Stride : y*img.Stride+bounds.Dx()*4]
+		dst := out.Pix[y*out.Stride : y*out.Stride+bounds.Dx()*4]
+		for i := 0; i < len(src); i += 4 {
+			key := uint32(src[i])<<24 | uint32(src[i+1])<<16 | uint32(src[i+2])<<8 | uint32(src[i+3])
+			rgb, ok := converted[key]
+			if !ok {
+				var pcs [4]float64
+				profile.toPCS.Eval([]float64{float64(src[i]) / 255, float64(src[i+1]) / 255, float64(src[i+2]) / 255, float64(src[i+3]) / 255}, pcs[:])
+				linear := mulMatrix(xyzToLinearSRGB, decodePCS(pcs, profile.PCS, profile.toPCS.lut8))
+				rgb = [3]uint8{encode[linearIndex(linear[0])], encode[linearIndex(linear[1])], encode[linearIndex(linear[2])]}
+				converted[key] = rgb
+			}
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = rgb[0], rgb[1], rgb[2], 0xff
+		}
+	}
+	return out, nil
+}
+
+// grayToSRGB converts a grayscale image through its tone curve
+func grayToSRGB(img image.Image, curve iccCurve) image.Image {
+	encode := srgbEncodeTable()
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = encode[linearIndex(curve.Eval(float64(v)/255))]
+	}
+
+	bounds := img.Bounds()
+	out := image.NewGray(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	for i, v := range out.Pix {
+		out.Pix[i] = lut[v]
+	}
+	return out
+}
+
+// mapRGB returns a copy of img with every color mapped by convert.
+// Slow conversions are memoised per color.
+func mapRGB(img image.Image, memoise bool, convert func(r, g, b uint8) (uint8, uint8, uint8)) *image.NRGBA {
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+
+	var converted map[uint32][3]uint8
+	if memoise {
+		converted = make(map[uint32][3]uint8)
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+bounds.Dx()*4]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := row[i], row[i+1], row[i+2]
+			if converted == nil {
+				row[i], row[i+1], row[i+2] = convert(r, g, b)
+				continue
+			}
+			key := uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+			rgb, ok := converted[key]
+			if !ok {
+				rgb[0], rgb[1], rgb[2] = convert(r, g, b)
+				converted[key] = rgb
+			}
+			row[i], row[i+1], row[i+2] = rgb[0], rgb[1], rgb[2]
+		}
+	}
+	return out
+}
+
+// decodePCS returns the D50 XYZ of a table's normalised PCS output
+func decodePCS(pcs [4]float64, space string, lut8 bool) [3]float64 {
+	if space == pcsXYZ {
+		// -> lut16 XYZ spans 0 to 1+32767/32768
+		return [3]float64{pcs[0] * 65535 / 32768, pcs[1] * 65535 / 32768, pcs[2] * 65535 / 32768}
+	}
+
+	scale := 1.0
+	if !lut8 {
+		// -> legacy 16-bit Lab, where 0xFF00 is L* 100
+		scale = 65535.0 / 65280
+	}
+	l := pcs[0] * scale * 100
+	a := pcs[1]*scale*255 - 128
+	b := pcs[2]*scale*255 - 128
+	return labToXYZ(l, a, b)
+}
+
+// encodePCS returns the normalised table input for a D50 XYZ
+func encodePCS(xyz [3]float64, space string, lut8 bool) [3]float64 {
+	if space == pcsXYZ {
+		return [3]float64{xyz[0] * 32768 / 65535, xyz[1] * 32768 / 65535, xyz[2] * 32768 / 65535}
+	}
+
+	scale := 1.0
+	if !lut8 {
+		scale = 65280.0 / 65535
+	}
+	l, a, b := xyzToLab(xyz)
+	return [3]float64{l / 100 * scale, (a + 128) / 255 * scale, (b + 128) / 255 * scale}
+}
+
+// labToXYZ converts CIELAB to XYZ, relative to the D50 white
+func labToXYZ(l, a, b float64) [3]float64 {
+	fy := (l + 16) / 116
+	f := [3]float64{fy + a/500, fy, fy - b/200}
+
+	var xyz [3]float64
+	for i, v := range f {
+		if v > 6.0/29 {
+			xyz[i] = v * v * v
+		} else {
+			xyz[i] = 3 * (6.0 / 29) * (6.0 / 29) * (v - 4.0/29)
+		}
+		xyz[i] *= d50White[i]
+	}
+	return xyz
+}
+
+// xyzToLab converts D50 XYZ to CIELAB
+func xyzToLab(xyz [3]float64) (float64, float64, float64) {
+	var f [3]float64
+	for i := range f {
+		t := xyz[i] / d50White[i]
+		if t > math.Pow(6.0/29, 3) {
+			f[i] = math.Cbrt(t)
+		} else {
+			f[i] = t/(3*(6.0/29)*(6.0/29)) + 4.0/29
+		}
+	}
+	return 116*f[1] - 16, 500 * (f[0] - f[1]), 200 * (f[1] - f[2])
+}
+
+// srgbDecodeTable returns the linear value of each 8-bit sRGB value
+func srgbDecodeTable() [256]float64 {
+	var table [256]float64
+	for v := range table {
+		c := float64(v) / 255
+		if c <= 0.04045 {
+			table[v] = c / 12.92
+		} else {
+			table[v] = math.Pow((c+0.055)/1.055, 2.4)
+		}
+	}
+	return table
+}
+
+// srgbEncodeTable returns the 8-bit sRGB value of linear values
+// sampled linearTableSize times from 0 to 1
+func srgbEncodeTable() []uint8 {
+	table := make([]uint8, linearTableSize)
+	for i := range table {
+		c := float64(i) / (linearTableSize - 1)
+		if c <= 0.0031308 {
+			c *= 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		table[i] = unit8(c)
+	}
+	return table
+}
+
+// inverseCurveTable returns the 8-bit device value of linear values
+// sampled linearTableSize times, inverting a profile's tone curve
+func inverseCurveTable(curve iccCurve) []uint8 {
+	var forward [256]float64
+	for v := range forward {
+		forward[v] = curve.Eval(float64(v) / 255)
+	}
+
+	table := make([]uint8, linearTableSize)
+	v := 0
+	for i := range table {
+		target := float64(i) / (linearTableSize - 1)
+		for v < 255 && forward[v+1] <= target {
+			v++
+		}
+		// -> round to the nearer of the two neighbouring values
+		if v < 255 && forward[v+1]-target < target-forward[v] {
+			table[i] = uint8(v + 1)
+		} else {
+			table[i] = uint8(v)
+		}
+	}
+	return table
+}
+
+// linearIndex returns the index of a linear value in the tables
+// sampled linearTableSize times
+func linearIndex(v float64) int {
+	return int(math.Round(math.Min(math.Max(v, 0), 1) * (linearTableSize - 1)))
+}
+
+// unit8 converts a value from 0 to 1 to 8 bits
+func unit8(v float64) uint8 {
+	return clampUint8(float32(v * 255))
+}
+
+// mulMatrix returns m × v
+func mulMatrix(m [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+// mulMatrices returns a × b
+func mulMatrices(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := range m {
+		for j := range m[i] {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// invert returns the inverse of m, and false when it is singular
+func invert(m [3][3]float64) ([3][3]float64, bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return [3][3]float64{}, false
+	}
+
+	var inverse [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// -> the cofactor of m[j][i], by cyclic indices
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inverse[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return inverse, true
+}
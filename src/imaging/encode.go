@@ -0,0 +1,207 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"math"
+)
+
+// DefaultSizeTolerance is how far under the target a JPEG may land,
+// as a fraction of the target, for the search to stop early
+const DefaultSizeTolerance = 0.05
+
+// maxScaleSearches bounds the resizes tried when no quality fits
+const maxScaleSearches = 8
+
+// SizeTarget describes the JPEG encoding wanted from EncodeToSize
+type SizeTarget struct {
+	Bytes      int64   // -> the encoded size must not exceed this
+	Tolerance  float64 // -> stop once within this fraction under Bytes
+	MaxQuality int     // -> quality tried first
+	MinQuality int     // -> lowest quality tried before resizing
+
+	// Resample scales the image to width x height. When nil, or when
+	// even a scaled image cannot fit, the smallest encode is returned.
+	Resample func(img image.Image, width, height int) (image.Image, error)
+	MinScale float64 // -> smallest scale tried, 0.1 by default
+
+	Metadata *Metadata // -> written into every encode, so it is counted
+}
+
+// SizedJPEG is a JPEG encoded to a size target
+type SizedJPEG struct {
+	Data    []byte
+	Image   image.Image // -> the pixels that were encoded
+	Quality int
+	Scale   float64 // -> 1 unless the image had to be resized
+	Encodes int     // -> JPEG encodes the search took
+	Fits    bool    // -> false when the target could not be met
+}
+
+// EncodeToSize encodes img as a JPEG of at most target.Bytes. It
+// searches for the highest quality that fits, narrowing its bounds
+// like a binary search, and, when not even MinQuality fits, for the
+// largest scale that fits at MinQuality. The search stops as soon as
+// an encode lands within the tolerance.
+func EncodeToSize(img image.Image, target SizeTarget) (*SizedJPEG, error) {
+	if target.Bytes <= 0 {
+		return nil, errors.New("size target must be positive")
+	}
+	if target.MaxQuality <= 0 || target.MaxQuality > 100 {
+		target.MaxQuality = jpeg.DefaultQuality
+	}
+	target.MinQuality = min(max(target.MinQuality, 1), target.MaxQuality)
+	if target.Tolerance <= 0 {
+		target.Tolerance = DefaultSizeTolerance
+	}
+	if target.MinScale <= 0 || target.MinScale >= 1 {
+		target.MinScale = 0.1
+	}
+
+	s := &sizeSearch{target: target}
+	floor := int64(float64(target.Bytes) * (1 - target.Tolerance))
+	closeEnough := func(size int) bool { return int64(size) >= floor && int64(size) <= target.Bytes }
+
+	// Most photos fit at the best quality, in a single encode
+	best, err := s.encode(img, target.MaxQuality, 1)
+	if err != nil || best.Fits {
+		return best, err
+	}
+	smallest := best
+
+	// Highest quality that fits: lo fits or is the floor, hi does
+	// not fit. Guesses interpolate the size between the bounds, aiming
+	// inside the tolerance, as the size grows smoothly with quality.
+	// When the same bound moves twice in a row, the next guess bisects
+	// so a lopsided curve cannot stall the search.
+	aim := float64(target.Bytes) * (1 - target.Tolerance/2)
+	lo, hi := target.MinQuality, target.MaxQuality
+	loSize, hiSize := 0, len(best.Data)
+	var fitting *SizedJPEG
+	if lo < hi {
+		result, err := s.encode(img, lo, 1)
+		if err != nil {
+			return nil, err
+		}
+		smallest, loSize = result, len(result.Data)
+		if result.Fits {
+			fitting = result
+		}
+	}
+	lastFit, streak := false, 0
+	for fitting != nil && hi-lo > 1 && !closeEnough(len(fitting.Data)) {
+		guess := lo + int(float64(hi-lo)*(aim-float64(loSize))/float64(hiSize-loSize))
+		if streak >= 2 {
+			guess = (lo + hi) / 2
+		}
+		guess = min(max(guess, lo+1), hi-1)
+
+		result, err := s.encode(img, guess, 1)
+		if err != nil {
+			return nil, err
+		}
+		if result.Fits == lastFit {
+			streak++
+		} else {
+			lastFit, streak = result.Fits, 1
+		}
+		if result.Fits {
+			lo, loSize, fitting = guess, len(result.Data), result
+		} else {
+			hi, hiSize = guess, len(result.Data)
+		}
+	}
+	if fitting != nil {
+		return s.done(fitting), nil
+	}
+	if target.Resample == nil {
+		return s.done(smallest), nil
+	}
+
+	// Not even the lowest quality fits, so search the scale. Each
+	// guess assumes the size follows the pixel count, falling back
+	// to bisection when that lands outside the bounds.
+	loScale, hiScale := target.MinScale, 1.0
+	scale := math.Sqrt(aim / float64(len(smallest.Data)))
+	for i := 0; i < maxScaleSearches; i++ {
+		if scale <= loScale || scale >= hiScale {
+			scale = (loScale + hiScale) / 2
+		}
+		result, err := s.resampled(img, target.MinQuality, scale)
+		if err != nil {
+			return nil, err
+		}
+		if result.Fits {
+			loScale, fitting = scale, result
+			if closeEnough(len(result.Data)) {
+				break
+			}
+		} else {
+			hiScale = scale
+			smallest = result
+		}
+		if hiScale-loScale < 0.01 {
+			break
+		}
+		scale *= math.Sqrt(aim / float64(len(result.Data)))
+	}
+
+	if fitting == nil && loScale == target.MinScale {
+		// Even the smallest scale may fit when the guesses never tried it
+		if fitting, err = s.resampled(img, target.MinQuality, loScale); err != nil {
+			return nil, err
+		}
+		if !fitting.Fits {
+			smallest, fitting = fitting, nil
+		}
+	}
+	if fitting != nil {
+		return s.done(fitting), nil
+	}
+	return s.done(smallest), nil
+}
+
+// sizeSearch counts the encodes of one EncodeToSize call
+type sizeSearch struct {
+	target  SizeTarget
+	encodes int
+}
+
+// encode encodes img at quality and records whether it fits
+func (s *sizeSearch) encode(img image.Image, quality int, scale float64) (*SizedJPEG, error) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, img, &jpeg.Options{Quality: quality}, s.target.Metadata); err != nil {
+		return nil, err
+	}
+	s.encodes++
+
+	return &SizedJPEG{
+		Data:    buf.Bytes(),
+		Image:   img,
+		Quality: quality,
+		Scale:   scale,
+		Encodes: s.encodes,
+		Fits:    int64(buf.Len()) <= s.target.Bytes,
+	}, nil
+}
+
+// resampled encodes img scaled by scale at quality
+func (s *sizeSearch) resampled(img image.Image, quality int, scale float64) (*SizedJPEG, error) {
+	bounds := img.Bounds()
+	width := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	height := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+
+	scaled, err := s.target.Resample(img, width, height)
+	if err != nil {
+		return nil, err
+	}
+	return s.encode(scaled, quality, scale)
+}
+
+// done stamps the final encode count on the chosen result
+func (s *sizeSearch) done(result *SizedJPEG) *SizedJPEG {
+	result.Encodes = s.encodes
+	return result
+}
@@ -0,0 +1,198 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// EXIF tags read by this package
+const (
+	TagOrientation       uint16 = 0x0112
+	TagDateTime          uint16 = 0x0132
+	TagArtist            uint16 = 0x013B
+	TagCopyright         uint16 = 0x8298
+	TagExifIFD           uint16 = 0x8769
+	TagGPSIFD            uint16 = 0x8825
+	TagDateTimeOriginal  uint16 = 0x9003
+	TagDateTimeDigitized uint16 = 0x9004
+	TagOffsetTime        uint16 = 0x9010
+	TagOffsetTimeOrig    uint16 = 0x9011
+	TagOffsetTimeDigit   uint16 = 0x9012
+	TagSubSecTime        uint16 = 0x9290
+	TagSubSecTimeOrig    uint16 = 0x9291
+	TagSubSecTimeDigit   uint16 = 0x9292
+	TagMakerNote         uint16 = 0x927C
+	TagImageUniqueID     uint16 = 0xA420
+	TagCameraOwnerName   uint16 = 0xA430
+	TagBodySerialNumber  uint16 = 0xA431
+	TagLensSerialNumber  uint16 = 0xA435
+)
+
+// EXIF value types
+const (
+	typeASCII     uint16 = 2
+	typeShort     uint16 = 3
+	typeLong      uint16 = 4
+	typeRational  uint16 = 5
+	typeSLong     uint16 = 9
+	typeSRational uint16 = 10
+)
+
+// byteOrder reads and appends values in the payload's byte order
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// Exif is the EXIF metadata of a photo: the entries of IFD0 and of
+// the Exif and GPS sub-directories it points at.
+type Exif struct {
+	order   byteOrder
+	IFD0    []ExifEntry
+	ExifIFD []ExifEntry
+	GPSIFD  []ExifEntry
+}
+
+// ExifEntry is a single entry of an EXIF image file directory
+type ExifEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value []byte // -> raw value bytes, in the payload's byte order
+}
+
+// exifTypeSizes is the size in bytes of one value of each TIFF type
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// ReadExif returns the EXIF metadata of a JPEG or PNG read from r.
+// It returns nil and no error when the file carries no EXIF.
+func ReadExif(r io.Reader) (*Exif, error) {
+	metadata, err := ReadMetadata(r)
+	if err != nil || metadata == nil {
+		return nil, err
+	}
+	return metadata.Exif, nil
+}
+
+// ParseExif decodes a TIFF-structured EXIF payload
+func ParseExif(tiff []byte) (*Exif, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("exif: payload too short")
+	}
+
+	var order byteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: invalid byte order marker")
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return nil, errors.New("exif: invalid TIFF header")
+	}
+
+	x := &Exif{order: order}
+	var err error
+	if x.IFD0, err = readIFD(tiff, order, order.Uint32(tiff[4:8])); err != nil {
+		return nil, err
+	}
+
+	// The sub-directories are optional; a broken
+	// pointer only loses the entries behind it
+	if offset, ok := x.pointer(TagExifIFD); ok {
+		x.ExifIFD, _ = readIFD(tiff, order, offset)
+	}
+	if offset, ok := x.pointer(TagGPSIFD); ok {
+		x.GPSIFD, _ = readIFD(tiff, order, offset)
+	}
+
+	return x, nil
+}
+
+// readIFD decodes the directory at offset within the payload
+func readIFD(tiff []byte, order byteOrder, offset uint32) ([]ExifEntry, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errors.New("exif: directory offset out of range")
+	}
+
+	count := uint32(order.Uint16(tiff[offset:]))
+	start := offset + 2
+	if uint64(start)+uint64(count)*12 > uint64(len(tiff)) {
+		return nil, errors.New("exif: directory runs past the payload")
+	}
+
+	entries := make([]ExifEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		raw := tiff[start+i*12 : start+i*12+12]
+		entry := ExifEntry{
+			Tag:   order.Uint16(raw[0:2]),
+			Type:  order.Uint16(raw[2:4]),
+			Count: order.Uint32(raw[4:8]),
+		}
+
+		size, known := exifTypeSizes[entry.Type]
+		if !known {
+			continue // -> unknown types are skipped, as the spec requires
+		}
+		length := uint64(size) * uint64(entry.Count)
+		if length <= 4 {
+			entry.Value = raw[8 : 8+length]
+		} else {
+			valueOffset := uint64(order.Uint32(raw[8:12]))
+			if valueOffset+length > uint64(len(tiff)) {
+				continue // -> a broken entry should not hide the others
+			}
+			entry.Value = tiff[valueOffset : valueOffset+length]
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// pointer returns the offset stored in an IFD0 LONG entry
+func (x *Exif) pointer(tag uint16) (uint32, bool) {
+	entry, ok := lookup(x.IFD0, tag)
+	if !ok || entry.Type != typeLong || len(entry.Value) < 4 {
+		return 0, false
+	}
+	return x.order.Uint32(entry.Value), true
+}
+
+// lookup returns the entry with the given tag
+func lookup(entries []ExifEntry, tag uint16) (ExifEntry, bool) {
+	for _, entry := range entries {
+		if entry.Tag == tag {
+			return entry, true
+		}
+	}
+	return ExifEntry{}, false
+}
+
+// Lookup returns the IFD0 entry with the given tag
+func (x *Exif) Lookup(tag uint16) (ExifEntry, bool) {
+	if x == nil {
+		return ExifEntry{}, false
+	}
+	return lookup(x.IFD0, tag)
+}
+
+// Orientation returns the photo's EXIF orientation, or
+// OrientationNormal when it is missing or out of range
+func (x *Exif) Orientation() ExifOrientation {
+	entry, ok := x.Lookup(TagOrientation)
+	if !ok || entry.Type != typeShort || len(entry.Value) < 2 {
+		return OrientationNormal
+	}
+
+	orientation := ExifOrientation(x.order.Uint16(entry.Value))
+	if orientation < OrientationNormal || orientation > OrientationRotate270 {
+		return OrientationNormal
+	}
+	return orientation
+}
@@ -0,0 +1,128 @@
+package imaging
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxJSONBinary is the longest binary value rendered as hex in
+// the JSON; longer ones, like maker notes, only report their size
+const maxJSONBinary = 64
+
+// exifTagNames names the common tags in each directory
+var exifTagNames = map[string]map[uint16]string{
+	"IFD0": {
+		0x010E: "ImageDescription", 0x010F: "Make", 0x0110: "Model",
+		0x0112: "Orientation", 0x011A: "XResolution", 0x011B: "YResolution",
+		0x0128: "ResolutionUnit", 0x0131: "Software", 0x0132: "DateTime",
+		0x013B: "Artist", 0x0213: "YCbCrPositioning", 0x8298: "Copyright",
+		0x8769: "ExifIFDPointer", 0x8825: "GPSInfoIFDPointer",
+	},
+	"Exif": {
+		0x829A: "ExposureTime", 0x829D: "FNumber", 0x8822: "ExposureProgram",
+		0x8827: "ISOSpeedRatings", 0x9000: "ExifVersion", 0x9003: "DateTimeOriginal",
+		0x9004: "DateTimeDigitized", 0x9010: "OffsetTime", 0x9011: "OffsetTimeOriginal",
+		0x9012: "OffsetTimeDigitized", 0x9201: "ShutterSpeedValue", 0x9202: "ApertureValue",
+		0x9204: "ExposureBiasValue", 0x9207: "MeteringMode", 0x9209: "Flash",
+		0x920A: "FocalLength", 0x927C: "MakerNote", 0x9286: "UserComment",
+		0x9290: "SubSecTime", 0x9291: "SubSecTimeOriginal", 0x9292: "SubSecTimeDigitized",
+		0xA001: "ColorSpace", 0xA002: "PixelXDimension", 0xA003: "PixelYDimension",
+		0xA402: "ExposureMode", 0xA403: "WhiteBalance", 0xA405: "FocalLengthIn35mmFilm",
+		0xA406: "SceneCaptureType", 0xA420: "ImageUniqueID", 0xA430: "CameraOwnerName",
+		0xA431: "BodySerialNumber", 0xA432: "LensSpecification", 0xA433: "LensMake",
+		0xA434: "LensModel", 0xA435: "LensSerialNumber",
+	},
+	"GPS": {
+		0x0000: "GPSVersionID", 0x0001: "GPSLatitudeRef", 0x0002: "GPSLatitude",
+		0x0003: "GPSLongitudeRef", 0x0004: "GPSLongitude", 0x0005: "GPSAltitudeRef",
+		0x0006: "GPSAltitude", 0x0007: "GPSTimeStamp", 0x0010: "GPSImgDirectionRef",
+		0x0011: "GPSImgDirection", 0x001D: "GPSDateStamp",
+	},
+}
+
+// Fields returns the EXIF entries grouped by directory and keyed by
+// tag name, with values decoded to strings and numbers. Tags without
+// a known name are keyed by their hex ID.
+func (x *Exif) Fields() map[string]map[string]any {
+	if x == nil {
+		return nil
+	}
+
+	fields := make(map[string]map[string]any)
+	for _, group := range []struct {
+		name    string
+		entries []ExifEntry
+	}{{"IFD0", x.IFD0}, {"Exif", x.ExifIFD}, {"GPS", x.GPSIFD}} {
+		if len(group.entries) == 0 {
+			continue
+		}
+
+		values := make(map[string]any, len(group.entries))
+		for _, entry := range group.entries {
+			name, ok := exifTagNames[group.name][entry.Tag]
+			if !ok {
+				name = fmt.Sprintf("0x%04X", entry.Tag)
+			}
+			values[name] = x.value(entry)
+		}
+		fields[group.name] = values
+	}
+
+	return fields
+}
+
+// MarshalJSON renders the EXIF as its Fields
+func (x *Exif) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.Fields())
+}
+
+// value decodes an entry's value. Single values are returned
+// as they are, multiple values as a slice.
+func (x *Exif) value(entry ExifEntry) any {
+	var values []any
+	switch entry.Type {
+	case typeASCII:
+		return strings.TrimRight(string(entry.Value), "\x00 ")
+	case typeShort:
+		for i := 0; i+2 <= len(entry.Value); i += 2 {
+			values = append(values, x.order.Uint16(entry.Value[i:]))
+		}
+	case typeLong:
+		for i := 0; i+4 <= len(entry.Value); i += 4 {
+			values = append(values, x.order.Uint32(entry.Value[i:]))
+		}
+	case typeSLong:
+		for i := 0; i+4 <= len(entry.Value); i += 4 {
+			values = append(values, int32(x.order.Uint32(entry.Value[i:])))
+		}
+	case typeRational, typeSRational:
+		for i := 0; i+8 <= len(entry.Value); i += 8 {
+			numerator, denominator := x.order.Uint32(entry.Value[i:]), x.order.Uint32(entry.Value[i+4:])
+			if entry.Type == typeSRational {
+				values = append(values, rational(float64(int32(numerator)), float64(int32(denominator))))
+			} else {
+				values = append(values, rational(float64(numerator), float64(denominator)))
+			}
+		}
+	default: // -> BYTE, UNDEFINED and types without a JSON form
+		if len(entry.Value) > maxJSONBinary {
+			return fmt.Sprintf("<%d bytes>", len(entry.Value))
+		}
+		return hex.EncodeToString(entry.Value)
+	}
+
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+// rational returns numerator/denominator, or nil for a zero denominator
+func rational(numerator, denominator float64) any {
+	if denominator == 0 {
+		return nil
+	}
+	return numerator / denominator
+}
@@ -0,0 +1,169 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// PaperWhite is the background transparent areas are printed on
+// when none is configured
+var PaperWhite = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+// Flattening records how a decoded image was prepared for the
+// 8-bit, opaque JPEG sent to print
+type Flattening struct {
+	Source     string `json:"source"`               // -> decoded pixel model, e.g. "nrgba64" or "paletted"
+	BitDepth   int    `json:"bit_depth"`            // -> bits per channel of the source
+	Alpha      bool   `json:"alpha"`                // -> transparent pixels were composited
+	Background string `json:"background,omitempty"` // -> "#rrggbb" they were composited onto
+}
+
+// ParseColor parses a color written "#rrggbb" or "rrggbb"
+func ParseColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, want #rrggbb", value)
+	}
+	return color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, nil
+}
+
+// hexColor writes an opaque color as "#rrggbb"
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Flatten returns img as opaque 8-bit pixels. Transparent pixels
+// are composited onto background, 16-bit channels are rounded to
+// 8 bits rather than truncated, and palettes are expanded. Opaque
+// 8-bit images are returned as they are.
+func Flatten(img image.Image, background color.NRGBA) (image.Image, Flattening) {
+	background.A = 0xff
+	record := Flattening{Source: pixelModel(img), BitDepth: 8}
+
+	o, ok := img.(interface{ Opaque() bool })
+	opaque := ok && o.Opaque()
+
+	switch src := img.(type) {
+	case *image.Paletted:
+		// Flatten each palette entry once, then expand
+		record.Alpha = !opaque
+		palette := make([]color.RGBA, len(src.Palette))
+		for i, c := range src.Palette {
+			palette[i] = composite(color.NRGBA64Model.Convert(c).(color.NRGBA64), background)
+		}
+
+		bounds := src.Bounds()
+		out := image.NewRGBA(bounds)
+		for y := 0; y < bounds.Dy(); y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+bounds.Dx()]
+			dst := out.Pix[y*out.Stride : y*out.Stride+bounds.Dx()*4]
+			for x, index := range row {
+				c := color.RGBA{A: 0xff}
+				if int(index) < len(palette) {
+					c = palette[index]
+				}
+				dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = c.R, c.G, c.B, 0xff
+			}
+		}
+		if record.Alpha {
+			record.Background = hexColor(background)
+		}
+		return out, record
+
+	case *image.Gray16:
+		// Opaque grayscale stays grayscale
+		record.BitDepth = 16
+		bounds := src.Bounds()
+		out := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				out.SetGray(x, y, color.Gray{Y: round16(src.Gray16At(x, y).Y)})
+			}
+		}
+		return out, record
+
+	case *image.CMYK:
+		// Opaque and 8-bit, and kept as CMYK for color management
+		return img, record
+
+	case *image.NRGBA64, *image.RGBA64:
+		record.BitDepth = 16
+	}
+
+	if opaque && record.BitDepth == 8 {
+		return img, record
+	}
+
+	record.Alpha = !opaque
+	if record.Alpha {
+		record.Background = hexColor(background)
+	}
+
+	bounds := img.Bounds()
+	out := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var c color.NRGBA64
+			switch src := img.(type) {
+			case *image.NRGBA:
+				// -> the usual transparent PNG, read without boxing
+				n := src.NRGBAAt(x, y)
+				c = color.NRGBA64{R: uint16(n.R) * 257, G: uint16(n.G) * 257, B: uint16(n.B) * 257, A: uint16(n.A) * 257}
+			case *image.NRGBA64:
+				c = src.NRGBA64At(x, y)
+			default:
+				c = color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			}
+			out.SetRGBA(x, y, composite(c, background))
+		}
+	}
+	return out, record
+}
+
+// composite blends a 16-bit color over an opaque background and
+// rounds the result to 8 bits
+func composite(c color.NRGBA64, background color.NRGBA) color.RGBA {
+	a := uint32(c.A)
+	blend := func(v uint16, bg uint8) uint8 {
+		// -> 16-bit blend, bg widened by 257 so 0xff is 0xffff
+		mixed := (uint32(v)*a + uint32(bg)*257*(0xffff-a) + 0x7fff) / 0xffff
+		return round16(uint16(mixed))
+	}
+	return color.RGBA{R: blend(c.R, background.R), G: blend(c.G, background.G), B: blend(c.B, background.B), A: 0xff}
+}
+
+// round16 rounds a 16-bit channel to 8 bits
+func round16(v uint16) uint8 {
+	return uint8((uint32(v)*255 + 0x7fff) / 0xffff)
+}
+
+// pixelModel names the pixel type of a decoded image
+func pixelModel(img image.Image) string {
+	switch img.(type) {
+	case *image.RGBA:
+		return "rgba"
+	case *image.NRGBA:
+		return "nrgba"
+	case *image.RGBA64:
+		return "rgba64"
+	case *image.NRGBA64:
+		return "nrgba64"
+	case *image.Gray:
+		return "gray"
+	case *image.Gray16:
+		return "gray16"
+	case *image.Paletted:
+		return "paletted"
+	case *image.YCbCr:
+		return "ycbcr"
+	case *image.NYCbCrA:
+		return "nycbcra"
+	case *image.CMYK:
+		return "cmyk"
+	}
+	return fmt.Sprintf("%T", img)
+}
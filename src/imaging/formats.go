@@ -0,0 +1,132 @@
+package imaging
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Format is an image format uploads may be in. Every format is
+// re-encoded to the JPEG the printers take, so only decoding matters.
+type Format struct {
+	Name       string   // -> as returned by image.Decode
+	Extensions []string // -> lower case, with the dot
+	MIMEType   string
+
+	// match reports whether a file's first bytes are in the format
+	match func(header []byte) bool
+}
+
+// knownFormats are the formats this package can recognise. HEIC is
+// only decoded once a converter is registered, see RegisterHEICConverter.
+var knownFormats = []Format{
+	{Name: "jpeg", Extensions: []string{".jpg", ".jpeg"}, MIMEType: "image/jpeg", match: func(h []byte) bool {
+		return bytes.HasPrefix(h, []byte{0xFF, 0xD8, 0xFF})
+	}},
+	{Name: "png", Extensions: []string{".png"}, MIMEType: "image/png", match: func(h []byte) bool {
+		return bytes.HasPrefix(h, pngSignature)
+	}},
+	{Name: "webp", Extensions: []string{".webp"}, MIMEType: "image/webp", match: func(h []byte) bool {
+		return len(h) >= 12 && string(h[:4]) == "RIFF" && string(h[8:12]) == "WEBP"
+	}},
+	{Name: "tiff", Extensions: []string{".tif", ".tiff"}, MIMEType: "image/tiff", match: func(h []byte) bool {
+		return bytes.HasPrefix(h, []byte("II*\x00")) || bytes.HasPrefix(h, []byte("MM\x00*"))
+	}},
+	{Name: "bmp", Extensions: []string{".bmp"}, MIMEType: "image/bmp", match: func(h []byte) bool {
+		return bytes.HasPrefix(h, []byte("BM"))
+	}},
+	{Name: "heic", Extensions: []string{".heic", ".heif"}, MIMEType: "image/heic", match: isHEIF},
+}
+
+var (
+	registeredMu sync.RWMutex
+
+	// registered names the formats with a decoder. The standard and
+	// golang.org/x/image decoders are registered by the imports above.
+	registered = map[string]bool{"jpeg": true, "png": true, "webp": true, "tiff": true, "bmp": true}
+)
+
+// registerFormat marks a format as decodable
+func registerFormat(name string) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registered[name] = true
+}
+
+// SupportedFormats returns the formats that can be decoded, by name
+func SupportedFormats() []Format {
+	registeredMu.RLock()
+	defer registeredMu.RUnlock()
+
+	var formats []Format
+	for _, format := range knownFormats {
+		if registered[format.Name] {
+			formats = append(formats, format)
+		}
+	}
+	sort.Slice(formats, func(i, j int) bool { return formats[i].Name < formats[j].Name })
+	return formats
+}
+
+// LookupFormat returns the supported format with the given name
+func LookupFormat(name string) (Format, bool) {
+	for _, format := range SupportedFormats() {
+		if format.Name == name {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
+// FormatForFilename returns the supported format a filename's
+// extension stands for
+func FormatForFilename(filename string) (Format, bool) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, format := range SupportedFormats() {
+		for _, candidate := range format.Extensions {
+			if candidate == ext {
+				return format, true
+			}
+		}
+	}
+	return Format{}, false
+}
+
+// SniffFormat returns the supported format of a file from its
+// first bytes; 32 are enough for every format
+func SniffFormat(header []byte) (Format, bool) {
+	for _, format := range SupportedFormats() {
+		if format.match(header) {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
+// SupportedExtensions returns the extensions of the supported formats
+func SupportedExtensions() []string {
+	var extensions []string
+	for _, format := range SupportedFormats() {
+		extensions = append(extensions, format.Extensions...)
+	}
+	return extensions
+}
+
+// FormatNames returns the upper-case names of the supported
+// formats, for error messages
+func FormatNames() string {
+	var names []string
+	for _, format := range SupportedFormats() {
+		names = append(names, strings.ToUpper(format.Name))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,198 @@
+package imaging
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded marks an image that was not decoded because the
+// memory budget stayed in use for longer than the wait allowed
+var ErrOverloaded = errors.New("image processing is at capacity")
+
+// MemoryGovernor admits image processing across the whole process
+// against a budget of bytes. Each image reserves the memory its
+// header says decoding and processing it will take before any is
+// allocated, and keeps what it retains reserved until it is stored;
+// images that do not fit wait in turn for their share. A nil
+// MemoryGovernor admits everything.
+type MemoryGovernor struct {
+	budget  int64
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	used    int64
+	waiters list.List // -> *memoryWaiter, first come first served
+}
+
+// memoryWaiter is an image waiting for its memory
+type memoryWaiter struct {
+	bytes   int64
+	granted chan struct{}
+}
+
+// NewMemoryGovernor returns a governor for budget bytes, which lets
+// an image wait up to maxWait for its share. A budget of 0 or less
+// returns nil, which admits everything.
+func NewMemoryGovernor(budget int64, maxWait time.Duration) *MemoryGovernor {
+	if budget <= 0 {
+		return nil
+	}
+	return &MemoryGovernor{budget: budget, maxWait: maxWait}
+}
+
+// Acquire reserves bytes for an image, waiting while the budget is
+// in use. An image larger than the whole budget waits until it can
+// be processed alone. It fails with ErrOverloaded once the wait passes
+// the governor's deadline, or with the context's error when ctx ends
+// first. Release the reservation once the image's memory is freed.
+func (g *MemoryGovernor) Acquire(ctx context.Context, bytes int64) (*Reservation, error) {
+	if g == nil {
+		return nil, nil
+	}
+	if bytes > g.budget {
+		bytes = g.budget
+	}
+	if bytes < 0 {
+		bytes = 0
+	}
+
+	g.mu.Lock()
+	if g.waiters.Len() == 0 && g.used+bytes <= g.budget {
+		g.used += bytes
+		g.mu.Unlock()
+		return &Reservation{governor: g, bytes: bytes}, nil
+	}
+	waiter := &memoryWaiter{bytes: bytes, granted: make(chan struct{})}
+	element := g.waiters.PushBack(waiter)
+	g.mu.Unlock()
+
+	var deadline <-chan time.Time
+	if g.maxWait > 0 {
+		timer := time.NewTimer(g.maxWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var err error
+	select {
+	case <-waiter.granted:
+		return &Reservation{governor: g, bytes: bytes}, nil
+	case <-deadline:
+		err = fmt.Errorf("%w: waited %s for %d bytes", ErrOverloaded, g.maxWait, bytes)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-waiter.granted:
+		// Granted while giving up, so hand the bytes back
+		g.used -= bytes
+	default:
+		g.waiters.Remove(element)
+	}
+	// The waiters behind this one may fit now
+	g.grant()
+	return nil, err
+}
+
+// grant admits the waiters at the front of the queue that fit
+// in the budget. It is called with mu held.
+func (g *MemoryGovernor) grant() {
+	for element := g.waiters.Front(); element != nil; element = g.waiters.Front() {
+		waiter := element.Value.(*memoryWaiter)
+		if g.used+waiter.bytes > g.budget {
+			return
+		}
+		g.used += waiter.bytes
+		g.waiters.Remove(element)
+		close(waiter.granted)
+	}
+}
+
+// InUse returns the bytes reserved and the images waiting
+func (g *MemoryGovernor) InUse() (bytes int64, waiting int) {
+	if g == nil {
+		return 0, 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.used, g.waiters.Len()
+}
+
+// Reservation is memory held from a MemoryGovernor. A nil
+// Reservation, from a nil governor, holds nothing.
+type Reservation struct {
+	governor *MemoryGovernor
+	bytes    int64 // -> guarded by governor.mu
+}
+
+// Shrink hands back all but bytes of the reservation, once the
+// intermediate copies of an image are freed and only what is
+// retained remains. It never grows the reservation.
+func (r *Reservation) Shrink(bytes int64) {
+	if r == nil {
+		return
+	}
+	g := r.governor
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if bytes < 0 || bytes >= r.bytes {
+		return
+	}
+	g.used -= r.bytes - bytes
+	r.bytes = bytes
+	g.grant()
+}
+
+// Release hands the whole reservation back. Calling it
+// again, or after the reservation is released, does nothing.
+func (r *Reservation) Release() {
+	r.Shrink(0)
+}
+
+// Copies of the pixels held while an image is processed: the flattened
+// and sRGB copies at the source size, and the fitted, sharpened and
+// output-profile copies at the output size
+const (
+	sourceCopies = 2
+	outputCopies = 3
+)
+
+// DecodedBytes estimates the memory the decoded pixels of an image
+// with config take, from its color model
+func DecodedBytes(config image.Config) int64 {
+	pixels := int64(config.Width) * int64(config.Height)
+	switch model := config.ColorModel; {
+	case model == color.GrayModel || model == color.AlphaModel:
+		return pixels
+	case model == color.Gray16Model || model == color.Alpha16Model:
+		return pixels * 2
+	case model == color.YCbCrModel:
+		return pixels * 3 // -> without chroma subsampling
+	case model == color.RGBA64Model || model == color.NRGBA64Model:
+		return pixels * 8
+	}
+	if _, ok := config.ColorModel.(color.Palette); ok {
+		return pixels
+	}
+	return pixels * 4
+}
+
+// ProcessingBytes estimates the peak memory of decoding and processing
+// an image with config into one of outputPixels, which is the source's
+// own size when 0 or smaller. Each intermediate copy is 8-bit RGBA.
+func ProcessingBytes(config image.Config, outputPixels int64) int64 {
+	pixels := int64(config.Width) * int64(config.Height)
+	if outputPixels <= 0 {
+		outputPixels = pixels
+	}
+	return DecodedBytes(config) + 4*(sourceCopies*pixels+outputCopies*outputPixels)
+}
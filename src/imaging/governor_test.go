@@ -0,0 +1,97 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestMemoryGovernorReservations(t *testing.T) {
+	governor := NewMemoryGovernor(100, 20*time.Millisecond)
+	ctx := context.Background()
+
+	first, err := governor.Acquire(ctx, 60)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := governor.Acquire(ctx, 50); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("Acquire over budget = %v, want ErrOverloaded", err)
+	}
+
+	// Shrinking to what is retained lets the next image in
+	first.Shrink(10)
+	second, err := governor.Acquire(ctx, 50)
+	if err != nil {
+		t.Fatalf("Acquire after Shrink: %v", err)
+	}
+	if used, _ := governor.InUse(); used != 60 {
+		t.Errorf("in use = %d, want 60", used)
+	}
+
+	// Shrink never grows, and Release is idempotent
+	first.Shrink(40)
+	first.Release()
+	first.Release()
+	second.Release()
+	if used, waiting := governor.InUse(); used != 0 || waiting != 0 {
+		t.Errorf("in use = %d with %d waiting, want nothing", used, waiting)
+	}
+}
+
+func TestMemoryGovernorGrantsWaiterOnRelease(t *testing.T) {
+	governor := NewMemoryGovernor(100, time.Second)
+	held, err := governor.Acquire(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	granted := make(chan error, 1)
+	go func() {
+		reservation, err := governor.Acquire(context.Background(), 30)
+		reservation.Release()
+		granted <- err
+	}()
+
+	for _, waiting := governor.InUse(); waiting == 0; _, waiting = governor.InUse() {
+		time.Sleep(time.Millisecond)
+	}
+	held.Shrink(70)
+	if err := <-granted; err != nil {
+		t.Fatalf("waiter: %v", err)
+	}
+	held.Release()
+}
+
+func TestNilMemoryGovernor(t *testing.T) {
+	var governor *MemoryGovernor
+	reservation, err := governor.Acquire(context.Background(), 1<<40)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	reservation.Shrink(1)
+	reservation.Release()
+}
+
+func TestProcessingBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config image.Config
+		output int64
+		want   int64
+	}{
+		// Decoded YCbCr, two source copies and three output copies
+		{"jpeg", image.Config{ColorModel: color.YCbCrModel, Width: 100, Height: 50}, 0, 5000*3 + 4*(2*5000+3*5000)},
+		{"jpeg to a smaller print", image.Config{ColorModel: color.YCbCrModel, Width: 100, Height: 50}, 1000, 5000*3 + 4*(2*5000+3*1000)},
+		{"16-bit png", image.Config{ColorModel: color.NRGBA64Model, Width: 10, Height: 10}, 0, 100*8 + 4*(2*100+3*100)},
+		{"paletted gif", image.Config{ColorModel: color.Palette{color.Black}, Width: 10, Height: 10}, 0, 100 + 4*(2*100+3*100)},
+	}
+
+	for _, test := range tests {
+		if got := ProcessingBytes(test.config, test.output); got != test.want {
+			t.Errorf("%s: ProcessingBytes = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package imaging
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// heifBrands are the ftyp brands of HEIC and HEIF still images
+var heifBrands = []string{"heic", "heix", "heim", "heis", "mif1"}
+
+// heicConvertTimeout bounds a single conversion
+const heicConvertTimeout = time.Minute
+
+// maxHEIFMetaSize bounds the meta box read to find the dimensions
+const maxHEIFMetaSize = 1 << 20
+
+// isHEIF reports whether a file header is an HEIF ftyp box with a
+// still-image brand
+func isHEIF(header []byte) bool {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return false
+	}
+	for _, brand := range heifBrands {
+		if string(header[8:12]) == brand {
+			return true
+		}
+	}
+	return false
+}
+
+var heicOnce sync.Once
+
+// RegisterHEICConverter registers a decoder for HEIC photos. HEIC
+// holds HEVC-coded pixels, which have no pure Go decoder, so they are
+// converted by command, run as "command input.heic output.png" like
+// heif-convert or ImageMagick's magick. The dimensions are read from
+// the file itself, so probing a photo does not run the command.
+func RegisterHEICConverter(command string) error {
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return fmt.Errorf("HEIC converter %q not found: %w", command, err)
+	}
+
+	heicOnce.Do(func() {
+		decode := func(r io.Reader) (image.Image, error) { return convertHEIC(path, r) }
+		for _, brand := range heifBrands {
+			image.RegisterFormat("heic", "????ftyp"+brand, decode, decodeHEICConfig)
+		}
+		registerFormat("heic")
+	})
+	return nil
+}
+
+// convertHEIC decodes a HEIC photo by converting it to a PNG
+func convertHEIC(command string, r io.Reader) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "snapflow-heic-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "input.heic"), filepath.Join(dir, "output.png")
+	file, err := os.Create(input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), heicConvertTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, command, input, output).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("heic: conversion failed: %v: %s", err, out)
+	}
+
+	converted, err := os.Open(output)
+	if err != nil {
+		return nil, fmt.Errorf("heic: converter wrote no image: %w", err)
+	}
+	defer converted.Close()
+	return png.Decode(bufio.NewReader(converted))
+}
+
+// decodeHEICConfig returns the dimensions of the primary image of a
+// HEIC photo from its ispe property, turned by its irot property
+func decodeHEICConfig(r io.Reader) (image.Config, error) {
+	meta, err := findBox(r, "meta", maxHEIFMetaSize)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if len(meta) < 4 {
+		return image.Config{}, errors.New("heic: meta box too short")
+	}
+	children := meta[4:] // -> skip the full box version and flags
+
+	primary, hasPrimary := uint32(0), false
+	if pitm, ok := childBox(children, "pitm"); ok && len(pitm) >= 6 {
+		if pitm[0] == 0 {
+			primary = uint32(binary.BigEndian.Uint16(pitm[4:]))
+		} else if len(pitm) >= 8 {
+			primary = binary.BigEndian.Uint32(pitm[4:])
+		}
+		hasPrimary = true
+	}
+
+	iprp, ok := childBox(children, "iprp")
+	if !ok {
+		return image.Config{}, errors.New("heic: no item properties")
+	}
+	ipco, ok := childBox(iprp, "ipco")
+	if !ok {
+		return image.Config{}, errors.New("heic: no item property container")
+	}
+	properties := boxes(ipco)
+
+	// The primary item's properties, by their 1-based index in ipco;
+	// without an association, the largest image size is used
+	var associated []int
+	if ipma, ok := childBox(iprp, "ipma"); ok && hasPrimary {
+		associated = heifAssociations(ipma, primary)
+	}
+
+	var width, height uint32
+	rotated := false
+	consider := func(property box) {
+		switch property.kind {
+		case "ispe":
+			if len(property.data) >= 12 {
+				w, h := binary.BigEndian.Uint32(property.data[4:]), binary.BigEndian.Uint32(property.data[8:])
+				if uint64(w)*uint64(h) > uint64(width)*uint64(height) {
+					width, height = w, h
+				}
+			}
+		case "irot":
+			if len(property.data) >= 1 {
+				rotated = property.data[0]&0x03 == 1 || property.data[0]&0x03 == 3
+			}
+		}
+	}
+	if len(associated) > 0 {
+		for _, index := range associated {
+			if index >= 1 && index <= len(properties) {
+				consider(properties[index-1])
+			}
+		}
+	} else {
+		for _, property := range properties {
+			if property.kind == "ispe" {
+				consider(property)
+			}
+		}
+	}
+
+	if width == 0 || height == 0 {
+		return image.Config{}, errors.New("heic: no image size")
+	}
+	if rotated {
+		width, height = height, width
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+// heifAssociations returns the property indexes of an item in ipma
+func heifAssociations(ipma []byte, item uint32) []int {
+	if len(ipma) < 8 {
+		return nil
+	}
+	version, flags := ipma[0], ipma[3]
+	count := binary.BigEndian.Uint32(ipma[4:])
+	data := ipma[8:]
+
+	for i := uint32(0); i < count; i++ {
+		var id uint32
+		if version < 1 {
+			if len(data) < 3 {
+				return nil
+			}
+			id, data = uint32(binary.BigEndian.Uint16(data)), data[2:]
+		} else {
+			if len(data) < 5 {
+				return nil
+			}
+			id, data = binary.BigEndian.Uint32(data), data[4:]
+		}
+
+		associations := int(data[0])
+		data = data[1:]
+		entrySize := 1
+		if flags&1 == 1 {
+			entrySize = 2
+		}
+		if len(data) < associations*entrySize {
+			return nil
+		}
+
+		var indexes []int
+		for a := 0; a < associations; a++ {
+			if entrySize == 2 {
+				indexes = append(indexes, int(binary.BigEndian.Uint16(data[a*2:])&0x7FFF))
+			} else {
+				indexes = append(indexes, int(data[a]&0x7F))
+			}
+		}
+		data = data[associations*entrySize:]
+
+		if id == item {
+			return indexes
+		}
+	}
+	return nil
+}
+
+// box is an ISO base media file format box
+type box struct {
+	kind string
+	data []byte
+}
+
+// boxes splits data into the boxes it holds, stopping at a broken one
+func boxes(data []byte) []box {
+	var result []box
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return result
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return result
+		}
+		result = append(result, box{kind: kind, data: data[header:size]})
+		data = data[size:]
+	}
+	return result
+}
+
+// childBox returns the payload of the first box of the given kind
+func childBox(data []byte, kind string) ([]byte, bool) {
+	for _, child := range boxes(data) {
+		if child.kind == kind {
+			return child.data, true
+		}
+	}
+	return nil, false
+}
+
+// findBox reads top-level boxes from r up to the one of the given
+// kind and returns its payload, which may not exceed limit bytes
+func findBox(r io.Reader, kind string, limit int64) ([]byte, error) {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("heic: no %s box: %w", kind, err)
+		}
+		size := uint64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := uint64(8)
+		if size == 1 {
+			var large [8]byte
+			if _, err := io.ReadFull(r, large[:]); err != nil {
+				return nil, err
+			}
+			size, headerSize = binary.BigEndian.Uint64(large[:]), 16
+		}
+		if size == 0 || size < headerSize {
+			return nil, fmt.Errorf("heic: no %s box", kind)
+		}
+
+		payload := int64(size - headerSize)
+		if string(header[4:]) != kind {
+			if _, err := io.CopyN(io.Discard, r, payload); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if payload > limit {
+			return nil, fmt.Errorf("heic: %s box of %d bytes is too large", kind, payload)
+		}
+
+		data := make([]byte, payload)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
@@ -0,0 +1,404 @@
+package imaging
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// ErrUnsupportedProfile is returned for ICC profiles whose transforms
+// cannot be evaluated, such as v4 lutAtoB tables
+var ErrUnsupportedProfile = errors.New("unsupported ICC profile")
+
+// ICC color spaces and profile connection spaces
+const (
+	ColorSpaceRGB  = "RGB"
+	ColorSpaceCMYK = "CMYK"
+	ColorSpaceGray = "GRAY"
+
+	pcsXYZ = "XYZ"
+	pcsLab = "Lab"
+)
+
+// iccHeaderSize is the size of an ICC profile's header, followed
+// by its tag table
+const iccHeaderSize = 128
+
+// ICCProfile is a parsed ICC profile. Matrix/TRC profiles, such as
+// sRGB, Adobe RGB and Display P3, are evaluated from their primaries
+// and tone curves; others through their lut8 or lut16 tables.
+type ICCProfile struct {
+	Data        []byte // -> the profile as embedded
+	Class       string // -> "mntr", "prtr", "scnr" or "spac"
+	ColorSpace  string // -> ColorSpaceRGB, ColorSpaceCMYK or ColorSpaceGray
+	PCS         string
+	Description string
+
+	// Matrix/TRC transform to the D50 PCS, nil matrix without one
+	matrix *[3][3]float64
+	curves []iccCurve
+
+	// Lookup tables to and from the PCS, nil when absent
+	toPCS   *iccLut
+	fromPCS *iccLut
+}
+
+// ParseICCProfile parses an ICC profile, as embedded in an image
+func ParseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < iccHeaderSize+4 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+
+	profile := &ICCProfile{
+		Data:       data,
+		Class:      string(data[12:16]),
+		ColorSpace: strings.TrimSpace(string(data[16:20])),
+		PCS:        strings.TrimSpace(string(data[20:24])),
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[iccHeaderSize:]))
+	for i := 0; i < count; i++ {
+		entry := iccHeaderSize + 4 + i*12
+		if entry+12 > len(data) {
+			return nil, errors.New("truncated ICC tag table")
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 8 || offset+size > len(data) || offset+size < offset {
+			return nil, fmt.Errorf("ICC tag %q is out of bounds", data[entry:entry+4])
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	if desc, ok := tags["desc"]; ok {
+		profile.Description = parseICCText(desc)
+	}
+
+	var err error
+	switch profile.ColorSpace {
+	case ColorSpaceRGB:
+		if tags["rXYZ"] != nil && tags["rTRC"] != nil {
+			err = profile.parseMatrixTRC(tags)
+		}
+	case ColorSpaceGray:
+		if trc, ok := tags["kTRC"]; ok {
+			var curve iccCurve
+			if curve, err = parseToneCurve(trc); err == nil {
+				profile.curves = []iccCurve{curve}
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Perceptual tables, which minilab and press profiles carry
+	if a2b, ok := tags["A2B0"]; ok {
+		profile.toPCS, _ = parseICCLut(a2b)
+	}
+	if b2a, ok := tags["B2A0"]; ok {
+		profile.fromPCS, _ = parseICCLut(b2a)
+	}
+	return profile, nil
+}
+
+// String identifies the profile by description and content, so
+// options holding one have a stable fingerprint
+func (p *ICCProfile) String() string {
+	sum := sha256.Sum256(p.Data)
+	return p.Description + " " + hex.EncodeToString(sum[:6])
+}
+
+// IsSRGB reports whether the profile describes sRGB, so pixels
+// in it need no conversion
+func (p *ICCProfile) IsSRGB() bool {
+	return p.ColorSpace == ColorSpaceRGB && strings.Contains(strings.ToLower(p.Description), "srgb")
+}
+
+// parseMatrixTRC reads the primaries and tone curves of an RGB profile
+func (p *ICCProfile) parseMatrixTRC(tags map[string][]byte) error {
+	var matrix [3][3]float64
+	for column, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := parseXYZ(tags[name])
+		if err != nil {
+			return err
+		}
+		for row := range xyz {
+			matrix[row][column] = xyz[row]
+		}
+	}
+
+	for _, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseToneCurve(tags[name])
+		if err != nil {
+			return err
+		}
+		p.curves = append(p.curves, curve)
+	}
+	p.matrix = &matrix
+	return nil
+}
+
+// parseICCText reads a v2 textDescriptionType or a v4
+// multiLocalizedUnicodeType, taking its first record
+func parseICCText(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		if len(tag) < 12 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > len(tag)-12 {
+			n = len(tag) - 12
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) || length < 0 {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// parseXYZ reads an XYZType holding one value
+func parseXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("invalid ICC XYZ tag")
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+// s15Fixed16 reads a signed 15.16 fixed-point number
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// iccCurve maps a device value from 0 to 1 to its linear value
+type iccCurve struct {
+	gamma  float64   // -> used when table and params are nil
+	table  []float64 // -> sampled curve
+	kind   int       // -> parametricCurveType function type
+	params []float64
+}
+
+// parseToneCurve reads a curveType or parametricCurveType
+func parseToneCurve(tag []byte) (iccCurve, error) {
+	if len(tag) < 12 {
+		return iccCurve{}, errors.New("invalid ICC tone curve")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return iccCurve{gamma: 1}, nil
+		case 12+2*n > len(tag):
+			return iccCurve{}, errors.New("truncated ICC tone curve")
+		case n == 1:
+			return iccCurve{gamma: float64(binary.BigEndian.Uint16(tag[12:])) / 256}, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return iccCurve{table: table}, nil
+
+	case "para":
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if kind >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return iccCurve{}, errors.New("invalid ICC parametric curve")
+		}
+		params := make([]float64, counts[kind])
+		for i := range params {
+			params[i] = s15Fixed16(tag[12+4*i:])
+		}
+		return iccCurve{kind: kind, params: params}, nil
+	}
+	return iccCurve{}, fmt.Errorf("%w: tone curve type %q", ErrUnsupportedProfile, tag[:4])
+}
+
+// Eval returns the linear value of a device value from 0 to 1
+func (c iccCurve) Eval(x float64) float64 {
+	x = math.Min(math.Max(x, 0), 1)
+	switch {
+	case c.table != nil:
+		return interpolate(c.table, x)
+	case c.params != nil:
+		return c.parametric(x)
+	}
+	return math.Pow(x, c.gamma)
+}
+
+// parametric evaluates the ICC parametric curve functions
+func (c iccCurve) parametric(x float64) float64 {
+	p := c.params
+	g := p[0]
+	switch c.kind {
+	case 0:
+		return math.Pow(x, g)
+	case 1:
+		if x >= -p[2]/p[1] {
+			return math.Pow(p[1]*x+p[2], g)
+		}
+		return 0
+	case 2:
+		if x >= -p[2]/p[1] {
+			return math.Pow(p[1]*x+p[2], g) + p[3]
+		}
+		return p[3]
+	case 3:
+		if x >= p[4] {
+			return math.Pow(p[1]*x+p[2], g)
+		}
+		return p[3] * x
+	default:
+		if x >= p[4] {
+			return math.Pow(p[1]*x+p[2], g) + p[5]
+		}
+		return p[3]*x + p[6]
+	}
+}
+
+// interpolate samples table, spanning 0 to 1, at x
+func interpolate(table []float64, x float64) float64 {
+	if len(table) == 1 {
+		return table[0]
+	}
+	pos := x * float64(len(table)-1)
+	i := min(int(pos), len(table)-2)
+	frac := pos - float64(i)
+	return table[i]*(1-frac) + table[i+1]*frac
+}
+
+// iccLut is a lut8Type or lut16Type transform: input curves, a
+// color lookup table and output curves, with values from 0 to 1
+type iccLut struct {
+	inputs, outputs int
+	grid            int       // -> points along each input of the table
+	matrix          []float64 // -> 3x3, applied to XYZ input only
+	inCurves        [][]float64
+	clut            []float64
+	outCurves       [][]float64
+	lut8            bool
+}
+
+// parseICCLut reads a lut8Type ("mft1") or lut16Type ("mft2") tag
+func parseICCLut(tag []byte) (*iccLut, error) {
+	if len(tag) < 48 {
+		return nil, errors.New("truncated ICC lookup table")
+	}
+	kind := string(tag[:4])
+	if kind != "mft1" && kind != "mft2" {
+		return nil, fmt.Errorf("%w: lookup table type %q", ErrUnsupportedProfile, kind)
+	}
+
+	lut := &iccLut{inputs: int(tag[8]), outputs: int(tag[9]), grid: int(tag[10]), lut8: kind == "mft1"}
+	if lut.inputs < 1 || lut.inputs > 4 || lut.outputs < 1 || lut.outputs > 4 || lut.grid < 2 {
+		return nil, fmt.Errorf("%w: %d-in %d-out lookup table", ErrUnsupportedProfile, lut.inputs, lut.outputs)
+	}
+	for i := 0; i < 9; i++ {
+		lut.matrix = append(lut.matrix, s15Fixed16(tag[12+4*i:]))
+	}
+
+	// The value width and curve lengths differ between the types
+	width, scale, inEntries, outEntries, pos := 1, 255.0, 256, 256, 48
+	if !lut.lut8 {
+		if len(tag) < 52 {
+			return nil, errors.New("truncated ICC lookup table")
+		}
+		width, scale = 2, 65535
+		inEntries = int(binary.BigEndian.Uint16(tag[48:]))
+		outEntries = int(binary.BigEndian.Uint16(tag[50:]))
+		pos = 52
+	}
+
+	cells := 1
+	for i := 0; i < lut.inputs; i++ {
+		cells *= lut.grid
+	}
+	need := (lut.inputs*inEntries + cells*lut.outputs + lut.outputs*outEntries) * width
+	if inEntries < 2 || outEntries < 2 || pos+need > len(tag) {
+		return nil, errors.New("truncated ICC lookup table")
+	}
+
+	read := func(n int) []float64 {
+		values := make([]float64, n)
+		for i := range values {
+			if width == 1 {
+				values[i] = float64(tag[pos]) / scale
+			} else {
+				values[i] = float64(binary.BigEndian.Uint16(tag[pos:])) / scale
+			}
+			pos += width
+		}
+		return values
+	}
+	for i := 0; i < lut.inputs; i++ {
+		lut.inCurves = append(lut.inCurves, read(inEntries))
+	}
+	lut.clut = read(cells * lut.outputs)
+	for i := 0; i < lut.outputs; i++ {
+		lut.outCurves = append(lut.outCurves, read(outEntries))
+	}
+	return lut, nil
+}
+
+// Eval maps the inputs, from 0 to 1, through the table into out
+func (l *iccLut) Eval(in []float64, out []float64) {
+	var x [4]float64
+	for i := 0; i < l.inputs; i++ {
+		x[i] = interpolate(l.inCurves[i], math.Min(math.Max(in[i], 0), 1))
+	}
+
+	// Multilinear interpolation between the corners of the cell
+	var base [4]int
+	var frac [4]float64
+	for i := 0; i < l.inputs; i++ {
+		pos := x[i] * float64(l.grid-1)
+		base[i] = min(int(pos), l.grid-2)
+		frac[i] = pos - float64(base[i])
+	}
+
+	var acc [4]float64
+	for corner := 0; corner < 1<<l.inputs; corner++ {
+		weight, index := 1.0, 0
+		for i := 0; i < l.inputs; i++ {
+			index *= l.grid
+			if corner&(1<<(l.inputs-1-i)) != 0 {
+				weight *= frac[i]
+				index += base[i] + 1
+			} else {
+				weight *= 1 - frac[i]
+				index += base[i]
+			}
+		}
+		if weight == 0 {
+			continue
+		}
+		for o := 0; o < l.outputs; o++ {
+			acc[o] += weight * l.clut[index*l.outputs+o]
+		}
+	}
+
+	for o := 0; o < l.outputs; o++ {
+		out[o] = interpolate(l.outCurves[o], math.Min(math.Max(acc[o], 0), 1))
+	}
+}
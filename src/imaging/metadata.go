@@ -0,0 +1,277 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// exifHeader prefixes the TIFF payload of a JPEG APP1 segment
+var exifHeader = []byte("Exif\x00\x00")
+
+// iccHeader prefixes each ICC profile chunk of a JPEG APP2 segment
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// pngSignature starts every PNG file
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Size limits for metadata read from a file. A JPEG APP1 segment cannot
+// exceed 64KiB and PNG eXIf chunks are capped to the same size; ICC
+// profiles are bounded so a crafted file cannot exhaust memory.
+const (
+	maxExifSize = 64 * 1024
+	maxICCSize  = 4 * 1024 * 1024
+)
+
+// maxSegmentData is the payload a JPEG marker segment can carry
+const maxSegmentData = 0xFFFF - 2
+
+// Metadata is the EXIF and embedded ICC profile of a photo
+type Metadata struct {
+	Exif       *Exif
+	ICCProfile []byte
+}
+
+// ReadMetadata returns the metadata of a JPEG, PNG or WebP read from r.
+// It returns nil and no error when the file carries none.
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(12)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var exifPayload, icc []byte
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xFF, 0xD8}):
+		exifPayload, icc, err = jpegMetadata(br)
+	case bytes.HasPrefix(magic, pngSignature):
+		exifPayload, icc, err = pngMetadata(br)
+	case len(magic) == 12 && string(magic[:4]) == "RIFF" && string(magic[8:]) == "WEBP":
+		exifPayload, icc, err = webpMetadata(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exifPayload == nil && icc == nil {
+		return nil, nil
+	}
+
+	metadata := &Metadata{ICCProfile: icc}
+	if exifPayload != nil {
+		if metadata.Exif, err = ParseExif(exifPayload); err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// jpegMetadata returns the TIFF payload of the first EXIF APP1 segment
+// and the ICC profile reassembled from the APP2 chunks, scanning the
+// markers up to the start of scan
+func jpegMetadata(r *bufio.Reader) ([]byte, []byte, error) {
+	if _, err := r.Discard(2); err != nil { // -> SOI
+		return nil, nil, err
+	}
+
+	var exifPayload []byte
+	iccChunks := make(map[byte][]byte)
+	iccSize := 0
+
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		if marker != 0xFF {
+			return nil, nil, fmt.Errorf("metadata: invalid JPEG marker 0x%02x", marker)
+		}
+
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case kind == 0xFF:
+			r.UnreadByte() // -> fill byte before a marker
+			continue
+		case kind == 0xD8 || kind == 0x01 || (kind >= 0xD0 && kind <= 0xD7):
+			continue // -> markers without a length
+		case kind == 0xDA || kind == 0xD9:
+			return exifPayload, joinICCChunks(iccChunks), nil // -> image data starts
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, nil, err
+		}
+		if length < 2 {
+			return nil, nil, errors.New("metadata: invalid JPEG segment length")
+		}
+
+		if kind != 0xE1 && kind != 0xE2 {
+			if _, err := r.Discard(int(length) - 2); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		segment := make([]byte, int(length)-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case kind == 0xE1 && exifPayload == nil && bytes.HasPrefix(segment, exifHeader):
+			exifPayload = segment[len(exifHeader):]
+		case kind == 0xE2 && bytes.HasPrefix(segment, iccHeader) && len(segment) > len(iccHeader)+2:
+			sequence := segment[len(iccHeader)]
+			chunk := segment[len(iccHeader)+2:]
+			if iccSize += len(chunk); iccSize > maxICCSize {
+				return nil, nil, errors.New("metadata: ICC profile is too large")
+			}
+			iccChunks[sequence] = chunk
+		}
+	}
+}
+
+// joinICCChunks concatenates the ICC chunks in sequence order
+func joinICCChunks(chunks map[byte][]byte) []byte {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	sequences := make([]int, 0, len(chunks))
+	for sequence := range chunks {
+		sequences = append(sequences, int(sequence))
+	}
+	sort.Ints(sequences)
+
+	var profile []byte
+	for _, sequence := range sequences {
+		profile = append(profile, chunks[byte(sequence)]...)
+	}
+	return profile
+}
+
+// pngMetadata returns the payloads of the eXIf and iCCP
+// chunks, which must precede the image data
+func pngMetadata(r *bufio.Reader) ([]byte, []byte, error) {
+	if _, err := r.Discard(len(pngSignature)); err != nil {
+		return nil, nil, err
+	}
+
+	var exifPayload, icc []byte
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, nil, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+
+		switch kind := string(header[4:]); kind {
+		case "IDAT", "IEND":
+			return exifPayload, icc, nil
+
+		case "eXIf", "iCCP":
+			if (kind == "eXIf" && length > maxExifSize) || length > maxICCSize {
+				return nil, nil, fmt.Errorf("metadata: %s chunk of %d bytes is too large", kind, length)
+			}
+			payload := make([]byte, length+4) // -> data and CRC
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, nil, err
+			}
+			payload = payload[:length]
+
+			if kind == "eXIf" {
+				exifPayload = payload
+			} else if profile, err := inflateICCP(payload); err == nil {
+				icc = profile
+			}
+
+		default:
+			if _, err := r.Discard(int(length) + 4); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// inflateICCP returns the profile of an iCCP chunk: a profile
+// name, a compression method byte and the zlib stream
+func inflateICCP(chunk []byte) ([]byte, error) {
+	separator := bytes.IndexByte(chunk, 0)
+	if separator < 0 || separator+2 > len(chunk) || chunk[separator+1] != 0 {
+		return nil, errors.New("metadata: invalid iCCP chunk")
+	}
+
+	inflater, err := zlib.NewReader(bytes.NewReader(chunk[separator+2:]))
+	if err != nil {
+		return nil, err
+	}
+	defer inflater.Close()
+
+	profile, err := io.ReadAll(io.LimitReader(inflater, maxICCSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(profile) > maxICCSize {
+		return nil, errors.New("metadata: ICC profile is too large")
+	}
+	return profile, nil
+}
+
+// webpMetadata returns the payloads of the EXIF and ICCP chunks of
+// an extended WebP, which may come in any order
+func webpMetadata(r *bufio.Reader) ([]byte, []byte, error) {
+	if _, err := r.Discard(12); err != nil { // -> RIFF header
+		return nil, nil, err
+	}
+
+	var exifPayload, icc []byte
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return exifPayload, icc, nil
+			}
+			return nil, nil, err
+		}
+		length := binary.LittleEndian.Uint32(header[4:])
+		padded := int64(length) + int64(length&1) // -> chunks are padded to an even size
+
+		switch kind := string(header[:4]); kind {
+		case "EXIF", "ICCP":
+			if (kind == "EXIF" && length > maxExifSize) || length > maxICCSize {
+				return nil, nil, fmt.Errorf("metadata: %s chunk of %d bytes is too large", kind, length)
+			}
+			payload := make([]byte, padded)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, nil, err
+			}
+			payload = payload[:length]
+
+			if kind == "EXIF" {
+				// Some writers keep the JPEG "Exif" prefix
+				exifPayload = bytes.TrimPrefix(payload, exifHeader)
+			} else {
+				icc = payload
+			}
+
+		default:
+			if _, err := r.Discard(int(padded)); err != nil {
+				if errors.Is(err, io.EOF) {
+					return exifPayload, icc, nil
+				}
+				return nil, nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+)
+
+// ExifOrientation is the value of the EXIF Orientation tag. It
+// describes how the stored pixels must be transformed to be upright.
+type ExifOrientation int
+
+const (
+	OrientationNormal     ExifOrientation = 1
+	OrientationFlipH      ExifOrientation = 2 // -> mirrored horizontally
+	OrientationRotate180  ExifOrientation = 3
+	OrientationFlipV      ExifOrientation = 4 // -> mirrored vertically
+	OrientationTranspose  ExifOrientation = 5 // -> mirrored along the main diagonal
+	OrientationRotate90   ExifOrientation = 6 // -> needs 90° clockwise
+	OrientationTransverse ExifOrientation = 7 // -> mirrored along the anti-diagonal
+	OrientationRotate270  ExifOrientation = 8 // -> needs 90° counter-clockwise
+)
+
+// Rotation returns the clockwise rotation in degrees the orientation
+// applies, and whether the image is also mirrored horizontally after
+// rotating.
+func (o ExifOrientation) Rotation() (int, bool) {
+	switch o {
+	case OrientationFlipH:
+		return 0, true
+	case OrientationRotate180:
+		return 180, false
+	case OrientationFlipV:
+		return 180, true
+	case OrientationTranspose:
+		return 90, true
+	case OrientationRotate90:
+		return 90, false
+	case OrientationTransverse:
+		return 270, true
+	case OrientationRotate270:
+		return 270, false
+	}
+	return 0, false
+}
+
+// ApplyOrientation returns img transformed so it is upright, undoing
+// the EXIF orientation o. OrientationNormal returns img unchanged.
+func ApplyOrientation(img image.Image, o ExifOrientation) image.Image {
+	if o <= OrientationNormal || o > OrientationRotate270 {
+		return img
+	}
+
+	src := toRGBA(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+
+	// Orientations 5-8 swap the axes
+	dstWidth, dstHeight := width, height
+	if o >= OrientationTranspose {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		row := src.Pix[y*src.Stride : y*src.Stride+width*4]
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch o {
+			case OrientationFlipH:
+				dx, dy = width-1-x, y
+			case OrientationRotate180:
+				dx, dy = width-1-x, height-1-y
+			case OrientationFlipV:
+				dx, dy = x, height-1-y
+			case OrientationTranspose:
+				dx, dy = y, x
+			case OrientationRotate90:
+				dx, dy = height-1-y, x
+			case OrientationTransverse:
+				dx, dy = height-1-y, width-1-x
+			case OrientationRotate270:
+				dx, dy = y, width-1-x
+			}
+
+			offset := dy*dst.Stride + dx*4
+			copy(dst.Pix[offset:offset+4], row[x*4:x*4+4])
+		}
+	}
+
+	return dst
+}
+
+// toRGBA returns img as an *image.RGBA with its origin at
+// (0, 0), converting it when it is in another format
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
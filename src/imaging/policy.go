@@ -0,0 +1,297 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MetadataPolicy selects the metadata copied into a processed JPEG.
+// GPS position, device serial numbers, maker notes and every other tag
+// are never copied, whatever the policy.
+type MetadataPolicy struct {
+	CaptureDate bool // -> DateTime, DateTimeOriginal and their offsets
+	Copyright   bool
+	ICCProfile  bool
+}
+
+// Metadata policy names, as listed in PRESERVE_METADATA
+const (
+	PolicyCaptureDate = "capture_date"
+	PolicyCopyright   = "copyright"
+	PolicyICCProfile  = "icc"
+)
+
+// ParseMetadataPolicy parses a comma-separated list of the metadata to
+// keep. "all" keeps everything the policy allows, "" and "none" nothing.
+func ParseMetadataPolicy(value string) (MetadataPolicy, error) {
+	var policy MetadataPolicy
+	for _, name := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "none":
+		case "all":
+			policy = MetadataPolicy{CaptureDate: true, Copyright: true, ICCProfile: true}
+		case PolicyCaptureDate:
+			policy.CaptureDate = true
+		case PolicyCopyright:
+			policy.Copyright = true
+		case PolicyICCProfile:
+			policy.ICCProfile = true
+		default:
+			return MetadataPolicy{}, fmt.Errorf("unknown metadata %q, expected %s, %s or %s", name, PolicyCaptureDate, PolicyCopyright, PolicyICCProfile)
+		}
+	}
+	return policy, nil
+}
+
+// Enabled reports whether the policy keeps any metadata
+func (p MetadataPolicy) Enabled() bool {
+	return p.CaptureDate || p.Copyright || p.ICCProfile
+}
+
+// captureDateTags are the Exif sub-directory tags kept with CaptureDate
+var captureDateTags = map[uint16]bool{
+	TagDateTimeOriginal:  true,
+	TagDateTimeDigitized: true,
+	TagOffsetTime:        true,
+	TagOffsetTimeOrig:    true,
+	TagOffsetTimeDigit:   true,
+	TagSubSecTime:        true,
+	TagSubSecTimeOrig:    true,
+	TagSubSecTimeDigit:   true,
+}
+
+// Filter returns the metadata allowed by policy, or nil when nothing
+// is kept. The orientation is dropped too, as the pixels are upright.
+func (m *Metadata) Filter(policy MetadataPolicy) *Metadata {
+	if m == nil || !policy.Enabled() {
+		return nil
+	}
+
+	filtered := &Metadata{}
+	if policy.ICCProfile && len(m.ICCProfile) > 0 {
+		filtered.ICCProfile = m.ICCProfile
+	}
+
+	if x := m.Exif; x != nil {
+		kept := &Exif{order: x.order}
+		for _, entry := range x.IFD0 {
+			if (policy.CaptureDate && entry.Tag == TagDateTime) || (policy.Copyright && entry.Tag == TagCopyright) {
+				kept.IFD0 = append(kept.IFD0, entry)
+			}
+		}
+		if policy.CaptureDate {
+			for _, entry := range x.ExifIFD {
+				if captureDateTags[entry.Tag] {
+					kept.ExifIFD = append(kept.ExifIFD, entry)
+				}
+			}
+		}
+		if len(kept.IFD0) > 0 || len(kept.ExifIFD) > 0 {
+			filtered.Exif = kept
+		}
+	}
+
+	if filtered.Exif == nil && filtered.ICCProfile == nil {
+		return nil
+	}
+	return filtered
+}
+
+// identifyingTags are the tags of IFD0 and the Exif sub-directory
+// that name the owner or identify the camera, which Redacted drops
+var identifyingTags = map[uint16]bool{
+	TagArtist:           true, // -> usually the owner's name
+	TagMakerNote:        true, // -> often holds the serial number
+	TagImageUniqueID:    true,
+	TagCameraOwnerName:  true,
+	TagBodySerialNumber: true,
+	TagLensSerialNumber: true,
+}
+
+// Redacted returns a copy of the EXIF without the GPS directory and
+// the tags that identify the owner or the camera, so it can be shown
+// to editors. Everything else, including exposure and capture date,
+// is kept.
+func (x *Exif) Redacted() *Exif {
+	if x == nil {
+		return nil
+	}
+
+	redacted := &Exif{order: x.order}
+	for _, entry := range x.IFD0 {
+		if entry.Tag != TagGPSIFD && !identifyingTags[entry.Tag] {
+			redacted.IFD0 = append(redacted.IFD0, entry)
+		}
+	}
+	for _, entry := range x.ExifIFD {
+		if !identifyingTags[entry.Tag] {
+			redacted.ExifIFD = append(redacted.ExifIFD, entry)
+		}
+	}
+	return redacted
+}
+
+// EncodeJPEG encodes img as a JPEG to w, with the EXIF and ICC
+// profile of metadata written ahead of the image data. A nil
+// metadata writes a plain JPEG, like jpeg.Encode.
+func EncodeJPEG(w io.Writer, img image.Image, o *jpeg.Options, metadata *Metadata) error {
+	if metadata == nil {
+		return jpeg.Encode(w, img, o)
+	}
+
+	segments, err := metadata.jpegSegments()
+	if err != nil {
+		return err
+	}
+
+	// Write our own SOI and segments, then the encoder's
+	// output without its SOI
+	if _, err := w.Write(append([]byte{0xFF, 0xD8}, segments...)); err != nil {
+		return err
+	}
+	return jpeg.Encode(&skipWriter{w: w, skip: 2}, img, o)
+}
+
+// jpegSegments returns the APP1 EXIF segment and the APP2 ICC
+// profile segments of the metadata
+func (m *Metadata) jpegSegments() ([]byte, error) {
+	var segments bytes.Buffer
+
+	if m.Exif != nil {
+		tiff, err := m.Exif.encode()
+		if err != nil {
+			return nil, err
+		}
+		payload := append(append([]byte{}, exifHeader...), tiff...)
+		if len(payload) > maxSegmentData {
+			return nil, errors.New("metadata: EXIF does not fit in a JPEG segment")
+		}
+		writeSegment(&segments, 0xE1, payload)
+	}
+
+	if len(m.ICCProfile) > 0 {
+		chunkSize := maxSegmentData - len(iccHeader) - 2
+		count := (len(m.ICCProfile) + chunkSize - 1) / chunkSize
+		if count > 255 {
+			return nil, errors.New("metadata: ICC profile does not fit in 255 JPEG segments")
+		}
+
+		for i := 0; i < count; i++ {
+			chunk := m.ICCProfile[i*chunkSize : min((i+1)*chunkSize, len(m.ICCProfile))]
+			payload := append(append([]byte{}, iccHeader...), byte(i+1), byte(count))
+			writeSegment(&segments, 0xE2, append(payload, chunk...))
+		}
+	}
+
+	return segments.Bytes(), nil
+}
+
+// writeSegment writes a JPEG marker segment
+func writeSegment(buf *bytes.Buffer, marker byte, payload []byte) {
+	buf.Write([]byte{0xFF, marker})
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)+2))
+	buf.Write(payload)
+}
+
+// encode writes IFD0 and the Exif sub-directory as a TIFF payload
+// in the original byte order. Entries are sorted by tag, as the
+// spec requires, and values longer than four bytes follow the
+// directories.
+func (x *Exif) encode() ([]byte, error) {
+	ifd0 := append([]ExifEntry{}, x.IFD0...)
+	exifIFD := append([]ExifEntry{}, x.ExifIFD...)
+	sortEntries(ifd0)
+	sortEntries(exifIFD)
+
+	ifdSize := func(entries []ExifEntry) int { return 2 + len(entries)*12 + 4 }
+
+	// IFD0 gains an entry pointing at the Exif sub-directory
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, ExifEntry{Tag: TagExifIFD, Type: typeLong, Count: 1, Value: make([]byte, 4)})
+		sortEntries(ifd0)
+	}
+
+	ifd0Offset := 8
+	exifOffset := ifd0Offset + ifdSize(ifd0)
+	dataOffset := exifOffset
+	if len(exifIFD) > 0 {
+		dataOffset += ifdSize(exifIFD)
+	}
+
+	var data []byte
+	writeIFD := func(entries []ExifEntry) []byte {
+		dir := x.order.AppendUint16(nil, uint16(len(entries)))
+		for _, entry := range entries {
+			value := entry.Value
+			if entry.Tag == TagExifIFD && len(exifIFD) > 0 {
+				value = x.order.AppendUint32(nil, uint32(exifOffset))
+			}
+
+			dir = x.order.AppendUint16(dir, entry.Tag)
+			dir = x.order.AppendUint16(dir, entry.Type)
+			dir = x.order.AppendUint32(dir, entry.Count)
+			if len(value) <= 4 {
+				dir = append(dir, value...)
+				dir = append(dir, make([]byte, 4-len(value))...)
+				continue
+			}
+
+			// Values start on a word boundary
+			if len(data)%2 == 1 {
+				data = append(data, 0)
+			}
+			dir = x.order.AppendUint32(dir, uint32(dataOffset+len(data)))
+			data = append(data, value...)
+		}
+		return x.order.AppendUint32(dir, 0) // -> no next IFD
+	}
+
+	tiff := []byte("II*\x00")
+	if x.order == binary.BigEndian {
+		tiff = []byte("MM\x00*")
+	}
+	tiff = x.order.AppendUint32(tiff, uint32(ifd0Offset))
+	tiff = append(tiff, writeIFD(ifd0)...)
+	if len(exifIFD) > 0 {
+		tiff = append(tiff, writeIFD(exifIFD)...)
+	}
+	tiff = append(tiff, data...)
+
+	if len(tiff) > maxExifSize {
+		return nil, errors.New("metadata: EXIF payload is too large")
+	}
+	return tiff, nil
+}
+
+// sortEntries orders directory entries by tag
+func sortEntries(entries []ExifEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Tag < entries[j].Tag })
+}
+
+// skipWriter drops the first skip bytes written to it
+type skipWriter struct {
+	w    io.Writer
+	skip int
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip > 0 {
+		drop := min(s.skip, len(p))
+		s.skip -= drop
+		p = p[drop:]
+	}
+	if len(p) > 0 {
+		if _, err := s.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,57 @@
+package imaging
+
+import (
+	"image"
+	"math"
+)
+
+// PrintQuality grades how sharp a photo prints at its size
+type PrintQuality string
+
+const (
+	PrintQualityGood       PrintQuality = "good"
+	PrintQualityAcceptable PrintQuality = "acceptable"
+	PrintQualityPoor       PrintQuality = "poor" // -> visibly soft or blocky
+)
+
+// Effective resolutions, in dots per inch of paper, at which a
+// photo starts to look soft, then blurry, at arm's length
+const (
+	GoodDPI       = 240
+	AcceptableDPI = 150
+)
+
+// Preflight is the print quality expected of a photo
+type Preflight struct {
+	EffectiveDPI int          `json:"effective_dpi"`
+	Quality      PrintQuality `json:"quality"`
+	PrintSize    string       `json:"print_size"`
+}
+
+// AnalysePrint works out the effective DPI of a photo with the given
+// upright bounds printed as spec describes: the photo pixels that land
+// on each inch of paper once it is scaled to the print. Stretched
+// photos are graded on the axis that is enlarged the most.
+func AnalysePrint(bounds image.Rectangle, spec PrintSpec) Preflight {
+	width, height := spec.Pixels(bounds)
+	scaleX := float64(width) / float64(max(1, bounds.Dx()))
+	scaleY := float64(height) / float64(max(1, bounds.Dy()))
+
+	// How much the photo is enlarged to reach the print's pixels
+	scale := math.Max(scaleX, scaleY) // -> fill covers, stretch is worst on this axis
+	if spec.Mode == FitFit {
+		scale = math.Min(scaleX, scaleY)
+	}
+
+	dpi := int(math.Round(float64(spec.DPI) / scale))
+	preflight := Preflight{EffectiveDPI: dpi, PrintSize: spec.Size.Name}
+	switch {
+	case dpi >= GoodDPI:
+		preflight.Quality = PrintQualityGood
+	case dpi >= AcceptableDPI:
+		preflight.Quality = PrintQualityAcceptable
+	default:
+		preflight.Quality = PrintQualityPoor
+	}
+	return preflight
+}
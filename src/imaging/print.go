@@ -0,0 +1,238 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// DefaultDPI is the print resolution used when none is configured
+const DefaultDPI = 300
+
+// PrintSize is a physical print size in inches, short side first
+type PrintSize struct {
+	Name  string
+	Short float64
+	Long  float64
+
+	// Sharpening applied after resizing, tuned at DefaultDPI
+	Sharpen UnsharpMask
+}
+
+// PrintSizes are the print sizes offered on the order form. Small
+// prints are held closer to the eye, so they get a finer, lighter
+// mask; larger ones need a wider radius to look crisp.
+var PrintSizes = map[string]PrintSize{
+	"4x6": {Name: "4x6", Short: 4, Long: 6, Sharpen: UnsharpMask{Radius: 1.0, Amount: 0.8, Threshold: 3}},
+	"5x7": {Name: "5x7", Short: 5, Long: 7, Sharpen: UnsharpMask{Radius: 1.2, Amount: 0.9, Threshold: 3}},
+	"2x3": {Name: "2x3", Short: 2, Long: 3, Sharpen: UnsharpMask{Radius: 0.6, Amount: 0.6, Threshold: 2}},
+}
+
+// LookupPrintSize returns the print size named on the order form
+func LookupPrintSize(name string) (PrintSize, error) {
+	size, ok := PrintSizes[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return PrintSize{}, fmt.Errorf("unknown print size %q", name)
+	}
+	return size, nil
+}
+
+// Orientation selects which way round a photo is printed
+type Orientation string
+
+const (
+	OrientationAuto      Orientation = "auto" // -> follows the photo
+	OrientationPortrait  Orientation = "portrait"
+	OrientationLandscape Orientation = "landscape"
+)
+
+// FitMode selects how a photo is mapped onto the print
+type FitMode string
+
+const (
+	FitFill    FitMode = "fill"    // -> cover the print, cropping the overflow
+	FitFit     FitMode = "fit"     // -> fit inside the print, letterboxed
+	FitStretch FitMode = "stretch" // -> scale each axis to the print
+)
+
+// PrintSpec describes the pixels a printer expects for a photo
+type PrintSpec struct {
+	Size        PrintSize
+	DPI         int
+	Orientation Orientation
+	Mode        FitMode
+	Background  color.Color // -> letterbox color for FitFit, white by default
+	Kernel      Kernel      // -> resampling kernel, DefaultKernel when empty
+}
+
+// ParsePrintSpec builds a PrintSpec from the order form values.
+// Empty orientation and mode default to auto and fill.
+func ParsePrintSpec(size string, dpi int, orientation, mode string) (PrintSpec, error) {
+	printSize, err := LookupPrintSize(size)
+	if err != nil {
+		return PrintSpec{}, err
+	}
+	if dpi <= 0 {
+		return PrintSpec{}, fmt.Errorf("print DPI must be positive, got %d", dpi)
+	}
+
+	spec := PrintSpec{
+		Size:        printSize,
+		DPI:         dpi,
+		Orientation: Orientation(strings.ToLower(orientation)),
+		Mode:        FitMode(strings.ToLower(mode)),
+	}
+	if spec.Orientation == "" {
+		spec.Orientation = OrientationAuto
+	}
+	if spec.Mode == "" {
+		spec.Mode = FitFill
+	}
+
+	switch spec.Orientation {
+	case OrientationAuto, OrientationPortrait, OrientationLandscape:
+	default:
+		return PrintSpec{}, fmt.Errorf("unknown orientation %q", orientation)
+	}
+	switch spec.Mode {
+	case FitFill, FitFit, FitStretch:
+	default:
+		return PrintSpec{}, fmt.Errorf("unknown fit mode %q", mode)
+	}
+
+	return spec, nil
+}
+
+// Pixels returns the width and height of the print in pixels for a
+// photo with the given bounds. With OrientationAuto, a landscape photo
+// is printed landscape and any other photo portrait.
+func (s PrintSpec) Pixels(bounds image.Rectangle) (int, int) {
+	short := int(math.Round(s.Size.Short * float64(s.DPI)))
+	long := int(math.Round(s.Size.Long * float64(s.DPI)))
+
+	landscape := s.Orientation == OrientationLandscape
+	if s.Orientation == OrientationAuto {
+		landscape = bounds.Dx() > bounds.Dy()
+	}
+
+	if landscape {
+		return long, short
+	}
+	return short, long
+}
+
+// FitToPrint maps img onto the print described by spec. The result
+// is always exactly the width and height returned by spec.Pixels.
+func FitToPrint(img image.Image, spec PrintSpec) (image.Image, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, fmt.Errorf("cannot print an empty image")
+	}
+
+	width, height := spec.Pixels(bounds)
+	srcWidth, srcHeight := float64(bounds.Dx()), float64(bounds.Dy())
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	switch spec.Mode {
+	case FitStretch:
+		scaled := Resize(img, width, height, spec.Kernel)
+		draw.Draw(canvas, canvas.Bounds(), scaled, scaled.Bounds().Min, draw.Src)
+
+	case FitFill:
+		// Scale to cover the print, then crop the overflow evenly
+		scale := math.Max(float64(width)/srcWidth, float64(height)/srcHeight)
+		scaledWidth := max(width, int(math.Ceil(srcWidth*scale)))
+		scaledHeight := max(height, int(math.Ceil(srcHeight*scale)))
+
+		scaled := Resize(img, scaledWidth, scaledHeight, spec.Kernel)
+		offset := scaled.Bounds().Min.Add(image.Pt((scaledWidth-width)/2, (scaledHeight-height)/2))
+		draw.Draw(canvas, canvas.Bounds(), scaled, offset, draw.Src)
+
+	case FitFit:
+		// Scale to fit inside the print and center it on the background
+		background := spec.Background
+		if background == nil {
+			background = color.White
+		}
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+		scale := math.Min(float64(width)/srcWidth, float64(height)/srcHeight)
+		scaledWidth := min(width, max(1, int(math.Round(srcWidth*scale))))
+		scaledHeight := min(height, max(1, int(math.Round(srcHeight*scale))))
+
+		scaled := Resize(img, scaledWidth, scaledHeight, spec.Kernel)
+		target := image.Rect(0, 0, scaledWidth, scaledHeight).Add(image.Pt((width-scaledWidth)/2, (height-scaledHeight)/2))
+		draw.Draw(canvas, target, scaled, scaled.Bounds().Min, draw.Src)
+
+	default:
+		return nil, fmt.Errorf("unknown fit mode %q", spec.Mode)
+	}
+
+	return canvas, nil
+}
+
+// Sharpening returns the unsharp mask for the print, scaled to its DPI
+func (s PrintSpec) Sharpening() UnsharpMask {
+	return s.Size.Sharpen.ForDPI(s.DPI)
+}
+
+// FitWithin scales img down with kernel so its longer side is at most
+// maxSide pixels, keeping its aspect ratio. Smaller images are returned
+// as they are, as enlarging them adds no detail.
+func FitWithin(img image.Image, maxSide int, kernel Kernel) image.Image {
+	bounds := img.Bounds()
+	if maxSide <= 0 || (bounds.Dx() <= maxSide && bounds.Dy() <= maxSide) {
+		return img
+	}
+
+	scale := float64(maxSide) / float64(max(bounds.Dx(), bounds.Dy()))
+	width := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	height := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+	return Resize(img, width, height, kernel)
+}
+
+// CropToAspect crops img evenly from both ends of its longer
+// dimension to the aspect ratio long:short, turned to match the
+// photo, so a 2:3 crop suits portrait and landscape photos alike
+func CropToAspect(img image.Image, long, short float64) (image.Image, error) {
+	if long <= 0 || short <= 0 {
+		return nil, fmt.Errorf("invalid aspect ratio %g:%g", long, short)
+	}
+	if short > long {
+		long, short = short, long
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	ratio := long / short
+	if height > width {
+		ratio = short / long
+	}
+
+	// -> ratio is width over height for the crop
+	cropWidth, cropHeight := width, height
+	if float64(width)/float64(height) > ratio {
+		cropWidth = max(1, int(math.Round(float64(height)*ratio)))
+	} else {
+		cropHeight = max(1, int(math.Round(float64(width)/ratio)))
+	}
+	if cropWidth == width && cropHeight == height {
+		return img, nil
+	}
+
+	crop := image.Rect(0, 0, cropWidth, cropHeight).Add(bounds.Min).
+		Add(image.Pt((width-cropWidth)/2, (height-cropHeight)/2))
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(crop), nil
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, cropWidth, cropHeight))
+	draw.Draw(out, out.Bounds(), img, crop.Min, draw.Src)
+	return out, nil
+}
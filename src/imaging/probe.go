@@ -0,0 +1,54 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// ErrPixelBudget marks an image whose header claims more pixels than
+// the budget allows, so it is rejected before it is decoded
+var ErrPixelBudget = errors.New("image exceeds the pixel budget")
+
+// PixelBudget bounds the size of an image that may be decoded. Zero
+// fields are not checked.
+type PixelBudget struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+// Probe reads only the header of the image in src and checks its
+// dimensions against budget, before a decoder allocates any pixels.
+// The dimensions may fit either way round, as the photo may still be
+// turned by its EXIF orientation. src is rewound on return.
+func Probe(src io.ReadSeeker, budget PixelBudget) (image.Config, string, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return image.Config{}, "", fmt.Errorf("failed to rewind image: %w", err)
+	}
+	config, format, err := image.DecodeConfig(src)
+	if _, seekErr := src.Seek(0, io.SeekStart); seekErr != nil && err == nil {
+		err = fmt.Errorf("failed to rewind image: %w", seekErr)
+	}
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("failed to read image header: %w", err)
+	}
+
+	width, height := config.Width, config.Height
+	if width <= 0 || height <= 0 {
+		return image.Config{}, "", fmt.Errorf("invalid image dimensions %dx%d", width, height)
+	}
+	if budget.MaxPixels > 0 && int64(width)*int64(height) > budget.MaxPixels {
+		return image.Config{}, "", fmt.Errorf("%w: %dx%d is more than %d pixels", ErrPixelBudget, width, height, budget.MaxPixels)
+	}
+	if budget.MaxWidth > 0 && budget.MaxHeight > 0 {
+		fits := width <= budget.MaxWidth && height <= budget.MaxHeight
+		turned := height <= budget.MaxWidth && width <= budget.MaxHeight
+		if !fits && !turned {
+			return image.Config{}, "", fmt.Errorf("%w: %dx%d exceeds %dx%d", ErrPixelBudget, width, height, budget.MaxWidth, budget.MaxHeight)
+		}
+	}
+
+	return config, format, nil
+}
@@ -0,0 +1,542 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Recipe steps, in the order they usually run
+const (
+	StepOrient       = "orient"         // -> undo the EXIF orientation
+	StepCropToAspect = "crop-to-aspect" // -> aspect: "2:3", the print's by default
+	StepResize       = "resize"         // -> max_side, width and height, or print, dpi, fit and orientation; and kernel
+	StepSharpen      = "sharpen"        // -> radius, amount and threshold, the print's mask by default
+	StepColorAdjust  = "color-adjust"   // -> brightness, contrast, saturation and gamma
+	StepAutoColor    = "auto-color"     // -> levels, white_balance, contrast and saturation strengths
+	StepEncode       = "encode"         // -> quality, target_kb and downscale; must come last
+)
+
+// Recipe is a named, ordered list of processing steps, so the
+// processing of a product can be changed without a code change
+type Recipe struct {
+	Name  string       `json:"name" yaml:"name"`
+	Size  string       `json:"size,omitempty" yaml:"size,omitempty"`   // -> print size it is used for, any when empty
+	Paper string       `json:"paper,omitempty" yaml:"paper,omitempty"` // -> paper type it is used for, any when empty
+	Steps []RecipeStep `json:"steps" yaml:"steps"`
+}
+
+// RecipeStep is one step of a recipe and its parameters
+type RecipeStep struct {
+	Op     string         `json:"op" yaml:"op"`
+	Params map[string]any `json:"params,omitempty" yaml:"params,omitempty"`
+}
+
+// RecipeInput is what the steps know of the photo and its order
+type RecipeInput struct {
+	Orientation ExifOrientation // -> undone by the orient step
+	Print       *PrintSpec      // -> the ordered print, nil when there is none
+	Kernel      Kernel          // -> resampling kernel of resize steps without one
+}
+
+// RecipeEncoding is the JPEG encoding asked for by an encode step.
+// Zero fields keep the processor's defaults.
+type RecipeEncoding struct {
+	Quality     int
+	TargetBytes int64
+	Downscale   bool // -> the image may be scaled down to meet TargetBytes
+}
+
+// Pipeline is a compiled recipe, with its parameters checked
+type Pipeline struct {
+	Name     string
+	Encoding *RecipeEncoding // -> nil without an encode step
+
+	steps []pipelineStep
+}
+
+// pipelineStep is a compiled image step
+type pipelineStep struct {
+	op    string
+	apply func(img image.Image, in RecipeInput) (image.Image, error)
+
+	// Automatic color correction, run in place of apply so
+	// the correction can be returned
+	autoColor *AutoColor
+}
+
+// Matches reports whether the recipe is for prints of the given
+// size on the given paper
+func (r Recipe) Matches(size, paper string) bool {
+	return (r.Size == "" || strings.EqualFold(r.Size, size)) &&
+		(r.Paper == "" || strings.EqualFold(r.Paper, paper))
+}
+
+// Compile checks the recipe's steps and their parameters and
+// returns the pipeline that runs them
+func (r Recipe) Compile() (*Pipeline, error) {
+	if strings.TrimSpace(r.Name) == "" {
+		return nil, fmt.Errorf("recipe has no name")
+	}
+	if len(r.Steps) == 0 {
+		return nil, fmt.Errorf("recipe %s has no steps", r.Name)
+	}
+
+	pipeline := &Pipeline{Name: r.Name}
+	for i, step := range r.Steps {
+		if pipeline.Encoding != nil {
+			return nil, fmt.Errorf("recipe %s: %s must be the last step", r.Name, StepEncode)
+		}
+
+		params := &stepParams{values: step.Params, used: make(map[string]bool)}
+		var apply func(image.Image, RecipeInput) (image.Image, error)
+		var autoColor *AutoColor
+		var err error
+		switch step.Op {
+		case StepOrient:
+			apply = func(img image.Image, in RecipeInput) (image.Image, error) {
+				return ApplyOrientation(img, in.Orientation), nil
+			}
+		case StepCropToAspect:
+			apply, err = compileCrop(params)
+		case StepResize:
+			apply, err = compileResize(params)
+		case StepSharpen:
+			apply, err = compileSharpen(params)
+		case StepColorAdjust:
+			apply, err = compileColorAdjust(params)
+		case StepAutoColor:
+			autoColor, err = compileAutoColor(params)
+		case StepEncode:
+			pipeline.Encoding, err = compileEncode(params)
+		default:
+			err = fmt.Errorf("unknown step")
+		}
+		if err == nil {
+			err = params.unused()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("recipe %s, step %d (%s): %w", r.Name, i+1, step.Op, err)
+		}
+
+		if apply != nil || autoColor != nil {
+			pipeline.steps = append(pipeline.steps, pipelineStep{op: step.Op, apply: apply, autoColor: autoColor})
+		}
+	}
+	return pipeline, nil
+}
+
+// Run applies the pipeline's image steps to img in order. It also
+// returns the color correction of an auto-color step, nil without one.
+func (p *Pipeline) Run(img image.Image, in RecipeInput) (image.Image, *ColorCorrection, error) {
+	var correction *ColorCorrection
+	for _, step := range p.steps {
+		var err error
+		if step.autoColor != nil {
+			img, correction, err = AutoCorrectColor(img, *step.autoColor)
+		} else {
+			img, err = step.apply(img, in)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("recipe %s, %s: %w", p.Name, step.op, err)
+		}
+	}
+	return img, correction, nil
+}
+
+// Has reports whether the pipeline runs the given step
+func (p *Pipeline) Has(op string) bool {
+	for _, step := range p.steps {
+		if step.op == op {
+			return true
+		}
+	}
+	return op == StepEncode && p.Encoding != nil
+}
+
+// compileCrop compiles a crop-to-aspect step
+func compileCrop(params *stepParams) (func(image.Image, RecipeInput) (image.Image, error), error) {
+	aspect, err := params.text("aspect", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var long, short float64
+	if aspect != "" {
+		if long, short, err = parseAspect(aspect); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(img image.Image, in RecipeInput) (image.Image, error) {
+		if aspect == "" {
+			if in.Print == nil {
+				return nil, fmt.Errorf("no aspect and no print size to take it from")
+			}
+			return CropToAspect(img, in.Print.Size.Long, in.Print.Size.Short)
+		}
+		return CropToAspect(img, long, short)
+	}, nil
+}
+
+// parseAspect parses an aspect ratio written "2:3" or "4x6"
+func parseAspect(value string) (float64, float64, error) {
+	a, b, ok := strings.Cut(strings.ToLower(value), ":")
+	if !ok {
+		a, b, ok = strings.Cut(strings.ToLower(value), "x")
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid aspect %q, want e.g. 2:3", value)
+	}
+
+	long, errLong := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	short, errShort := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if errLong != nil || errShort != nil || long <= 0 || short <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect %q, want e.g. 2:3", value)
+	}
+	return long, short, nil
+}
+
+// compileResize compiles a resize step. It scales to fit max_side,
+// to width and height, or onto a print: the one named, or the one
+// ordered, with dpi, fit and orientation overriding the order's. The
+// kernel named overrides the one the image is processed with.
+func compileResize(params *stepParams) (func(image.Image, RecipeInput) (image.Image, error), error) {
+	maxSide, err := params.integer("max_side", 0)
+	if err != nil {
+		return nil, err
+	}
+	width, err := params.integer("width", 0)
+	if err != nil {
+		return nil, err
+	}
+	height, err := params.integer("height", 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := params.text("print", "")
+	if err != nil {
+		return nil, err
+	}
+	dpi, err := params.integer("dpi", 0)
+	if err != nil {
+		return nil, err
+	}
+	fit, err := params.text("fit", "")
+	if err != nil {
+		return nil, err
+	}
+	orientation, err := params.text("orientation", "")
+	if err != nil {
+		return nil, err
+	}
+
+	kernelName, err := params.text("kernel", "")
+	if err != nil {
+		return nil, err
+	}
+	var kernel Kernel
+	if kernelName != "" {
+		if kernel, err = ParseKernel(kernelName); err != nil {
+			return nil, err
+		}
+	}
+	kernelFor := func(in RecipeInput) Kernel {
+		if kernel != "" {
+			return kernel
+		}
+		return in.Kernel
+	}
+
+	switch {
+	case maxSide < 0 || width < 0 || height < 0 || dpi < 0:
+		return nil, fmt.Errorf("sizes must be positive")
+	case maxSide > 0:
+		return func(img image.Image, in RecipeInput) (image.Image, error) {
+			return FitWithin(img, maxSide, kernelFor(in)), nil
+		}, nil
+	case width > 0 || height > 0:
+		// -> a zero width or height keeps the aspect ratio
+		return func(img image.Image, in RecipeInput) (image.Image, error) {
+			return Resize(img, width, height, kernelFor(in)), nil
+		}, nil
+	}
+
+	// Check the print parameters now, with any size standing in
+	// for the ordered one
+	check := size
+	if check == "" {
+		check = "4x6"
+	}
+	if _, err := ParsePrintSpec(check, max(dpi, 1), orientation, fit); err != nil {
+		return nil, err
+	}
+
+	return func(img image.Image, in RecipeInput) (image.Image, error) {
+		spec := PrintSpec{DPI: DefaultDPI, Orientation: OrientationAuto, Mode: FitFill}
+		if in.Print != nil {
+			spec = *in.Print
+		} else if size == "" {
+			return nil, fmt.Errorf("no print size to resize to")
+		}
+
+		name := spec.Size.Name
+		if size != "" {
+			name = size
+		}
+		if dpi > 0 {
+			spec.DPI = dpi
+		}
+		if orientation != "" {
+			spec.Orientation = Orientation(orientation)
+		}
+		if fit != "" {
+			spec.Mode = FitMode(fit)
+		}
+
+		resolved, err := ParsePrintSpec(name, spec.DPI, string(spec.Orientation), string(spec.Mode))
+		if err != nil {
+			return nil, err
+		}
+		resolved.Background = spec.Background
+		resolved.Kernel = kernelFor(in)
+		return FitToPrint(img, resolved)
+	}, nil
+}
+
+// compileSharpen compiles a sharpen step. Without a radius, the mask
+// tuned for the print is used, else DefaultUnsharpMask.
+func compileSharpen(params *stepParams) (func(image.Image, RecipeInput) (image.Image, error), error) {
+	radius, err := params.number("radius", 0)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := params.number("amount", 0)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := params.integer("threshold", 0)
+	if err != nil {
+		return nil, err
+	}
+	if threshold < 0 || threshold > 255 {
+		return nil, fmt.Errorf("threshold %d is outside 0 to 255", threshold)
+	}
+
+	mask := UnsharpMask{Radius: radius, Amount: amount, Threshold: uint8(threshold)}
+	if radius != 0 {
+		if err := mask.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(img image.Image, in RecipeInput) (image.Image, error) {
+		switch {
+		case radius != 0:
+			return Sharpen(img, mask)
+		case in.Print != nil:
+			return Sharpen(img, in.Print.Sharpening())
+		}
+		return Sharpen(img, DefaultUnsharpMask)
+	}, nil
+}
+
+// compileColorAdjust compiles a color-adjust step
+func compileColorAdjust(params *stepParams) (func(image.Image, RecipeInput) (image.Image, error), error) {
+	var adjustment ColorAdjustment
+	for name, field := range map[string]*float64{
+		"brightness": &adjustment.Brightness,
+		"contrast":   &adjustment.Contrast,
+		"saturation": &adjustment.Saturation,
+		"gamma":      &adjustment.Gamma,
+	} {
+		value, err := params.number(name, 0)
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+	if err := adjustment.validate(); err != nil {
+		return nil, err
+	}
+
+	return func(img image.Image, _ RecipeInput) (image.Image, error) {
+		return AdjustColor(img, adjustment)
+	}, nil
+}
+
+// compileAutoColor compiles an auto-color step. Strengths left out
+// are those of DefaultAutoColor.
+func compileAutoColor(params *stepParams) (*AutoColor, error) {
+	autoColor := DefaultAutoColor
+	for name, field := range map[string]*float64{
+		"levels":        &autoColor.Levels,
+		"white_balance": &autoColor.WhiteBalance,
+		"contrast":      &autoColor.Contrast,
+		"saturation":    &autoColor.Saturation,
+	} {
+		value, err := params.number(name, *field)
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+	if err := autoColor.validate(); err != nil {
+		return nil, err
+	}
+	return &autoColor, nil
+}
+
+// compileEncode compiles an encode step
+func compileEncode(params *stepParams) (*RecipeEncoding, error) {
+	quality, err := params.integer("quality", 0)
+	if err != nil {
+		return nil, err
+	}
+	targetKB, err := params.integer("target_kb", 0)
+	if err != nil {
+		return nil, err
+	}
+	downscale, err := params.flag("downscale", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if quality < 0 || quality > 100 {
+		return nil, fmt.Errorf("quality %d is outside 1 to 100", quality)
+	}
+	if targetKB < 0 {
+		return nil, fmt.Errorf("target_kb must be positive")
+	}
+	return &RecipeEncoding{Quality: quality, TargetBytes: int64(targetKB) << 10, Downscale: downscale}, nil
+}
+
+// stepParams reads the parameters of a step, remembering which were
+// read so misspelt ones are reported rather than ignored
+type stepParams struct {
+	values map[string]any
+	used   map[string]bool
+}
+
+// lookup returns the named parameter
+func (s *stepParams) lookup(name string) (any, bool) {
+	value, ok := s.values[name]
+	if ok {
+		s.used[name] = true
+	}
+	return value, ok
+}
+
+// number returns the named parameter as a number
+func (s *stepParams) number(name string, fallback float64) (float64, error) {
+	value, ok := s.lookup(name)
+	if !ok {
+		return fallback, nil
+	}
+
+	// -> JSON decodes numbers as float64, YAML as int or float64
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("%s must be a number, got %v", name, value)
+}
+
+// integer returns the named parameter as a whole number
+func (s *stepParams) integer(name string, fallback int) (int, error) {
+	value, err := s.number(name, float64(fallback))
+	if err != nil {
+		return 0, err
+	}
+	if value != math.Trunc(value) || math.Abs(value) > math.MaxInt32 {
+		return 0, fmt.Errorf("%s must be a whole number, got %v", name, value)
+	}
+	return int(value), nil
+}
+
+// text returns the named parameter as a string
+func (s *stepParams) text(name, fallback string) (string, error) {
+	value, ok := s.lookup(name)
+	if !ok {
+		return fallback, nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %v", name, value)
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// flag returns the named parameter as a boolean
+func (s *stepParams) flag(name string, fallback bool) (bool, error) {
+	value, ok := s.lookup(name)
+	if !ok {
+		return fallback, nil
+	}
+	flag, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s must be true or false, got %v", name, value)
+	}
+	return flag, nil
+}
+
+// unused reports the parameters no step read
+func (s *stepParams) unused() error {
+	var unknown []string
+	for name := range s.values {
+		if !s.used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// ValidateRecipes checks that every recipe compiles and that
+// no two share a name
+func ValidateRecipes(recipes []Recipe) error {
+	names := make(map[string]bool, len(recipes))
+	for _, recipe := range recipes {
+		if _, err := recipe.Compile(); err != nil {
+			return err
+		}
+		if names[recipe.Name] {
+			return fmt.Errorf("recipe %s is defined twice", recipe.Name)
+		}
+		names[recipe.Name] = true
+	}
+	return nil
+}
+
+// LookupRecipe returns the recipe with the given name
+func LookupRecipe(recipes []Recipe, name string) (Recipe, bool) {
+	for _, recipe := range recipes {
+		if recipe.Name == name {
+			return recipe, true
+		}
+	}
+	return Recipe{}, false
+}
+
+// RecipeFor returns the first recipe for prints of the given size on
+// the given paper, so specific recipes should be listed first
+func RecipeFor(recipes []Recipe, size, paper string) (Recipe, bool) {
+	for _, recipe := range recipes {
+		if recipe.Matches(size, paper) {
+			return recipe, true
+		}
+	}
+	return Recipe{}, false
+}
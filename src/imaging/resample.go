@@ -0,0 +1,424 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kernel names the filter an image is resampled with
+type Kernel string
+
+const (
+	KernelNearest    Kernel = "nearest"     // -> fastest, copies the closest pixel
+	KernelBilinear   Kernel = "bilinear"    // -> fast and soft
+	KernelCatmullRom Kernel = "catmull-rom" // -> sharp cubic, cheaper than Lanczos
+	KernelLanczos    Kernel = "lanczos"     // -> Lanczos3, the sharpest
+)
+
+// DefaultKernel is the kernel used when none is chosen
+const DefaultKernel = KernelLanczos
+
+// filter is a resampling kernel: its weight at a distance from the
+// sample, and the distance beyond which the weight is 0
+type filter struct {
+	support float64
+	weight  func(x float64) float64
+}
+
+// filters are the kernels that weigh neighbouring pixels;
+// KernelNearest copies a pixel instead
+var filters = map[Kernel]filter{
+	KernelBilinear: {support: 1, weight: func(x float64) float64 {
+		return math.Max(0, 1-math.Abs(x))
+	}},
+	KernelCatmullRom: {support: 2, weight: func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return (1.5*x-2.5)*x*x + 1
+		case x < 2:
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	}},
+	KernelLanczos: {support: 3, weight: func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x == 0:
+			return 1
+		case x < 3:
+			return 3 * math.Sin(math.Pi*x) * math.Sin(math.Pi*x/3) / (math.Pi * math.Pi * x * x)
+		}
+		return 0
+	}},
+}
+
+// ParseKernel parses a kernel name. An empty name is DefaultKernel.
+func ParseKernel(name string) (Kernel, error) {
+	kernel := Kernel(strings.ToLower(strings.TrimSpace(name)))
+	if kernel == "" {
+		return DefaultKernel, nil
+	}
+	if _, ok := filters[kernel]; !ok && kernel != KernelNearest {
+		return "", fmt.Errorf("unknown resampling kernel %q, want one of %s", name, KernelNames())
+	}
+	return kernel, nil
+}
+
+// KernelNames lists the kernels that can be chosen
+func KernelNames() string {
+	names := []string{string(KernelNearest)}
+	for kernel := range filters {
+		names = append(names, string(kernel))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Resampler scales images to a new size with a kernel
+type Resampler interface {
+	Resample(img image.Image, width, height int, kernel Kernel) image.Image
+}
+
+// DefaultResampler is the Resampler used by Resize
+var DefaultResampler Resampler = StripeResampler{}
+
+// Resize scales img to width x height pixels with kernel, using
+// DefaultResampler. A width or height of 0 keeps the aspect ratio,
+// and an empty or unknown kernel is DefaultKernel. The result never
+// shares pixels with img.
+func Resize(img image.Image, width, height int, kernel Kernel) image.Image {
+	bounds := img.Bounds()
+	switch {
+	case width <= 0 && height <= 0:
+		width, height = bounds.Dx(), bounds.Dy()
+	case width <= 0:
+		width = max(1, int(math.Round(float64(bounds.Dx())*float64(height)/float64(bounds.Dy()))))
+	case height <= 0:
+		height = max(1, int(math.Round(float64(bounds.Dy())*float64(width)/float64(bounds.Dx()))))
+	}
+	return DefaultResampler.Resample(img, width, height, kernel)
+}
+
+// StripeResampler is the default Resampler. It filters each axis
+// in turn with fixed-point weights, and splits both passes into
+// stripes of rows that are worked on in parallel. Grayscale images
+// stay grayscale; any other image is resampled as premultiplied
+// RGBA, so transparent edges do not bleed.
+type StripeResampler struct {
+	Workers int // -> stripes worked on at once, GOMAXPROCS when 0
+}
+
+// Resample scales img to width x height pixels with kernel
+func (r StripeResampler) Resample(img image.Image, width, height int, kernel Kernel) image.Image {
+	src := loadPixels(img)
+	if width <= 0 || height <= 0 || src.width == 0 || src.height == 0 {
+		return src.withSize(max(width, 0), max(height, 0)).image()
+	}
+
+	workers := r.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	if kernel == KernelNearest {
+		return resampleNearest(src, width, height, workers).image()
+	}
+	f, ok := filters[kernel]
+	if !ok {
+		f = filters[DefaultKernel]
+	}
+
+	out := src
+	if width != src.width {
+		out = resampleRows(out, width, contributions(src.width, width, f), workers)
+	}
+	if height != src.height {
+		out = resampleColumns(out, height, contributions(src.height, height, f), workers)
+	}
+	if out.shared {
+		out = out.clone()
+	}
+	return out.image()
+}
+
+// pixels are 8-bit interleaved samples, 1 channel for gray and 4
+// for premultiplied RGBA, with the origin at 0, 0
+type pixels struct {
+	pix      []uint8
+	stride   int
+	channels int
+	width    int
+	height   int
+	shared   bool // -> pix belongs to the source image
+	opaque   bool // -> every alpha is 0xff, so alpha is not filtered
+}
+
+// loadPixels returns the samples of img, sharing them when img
+// already holds them in the layout resampling works on
+func loadPixels(img image.Image) pixels {
+	bounds := img.Bounds()
+	switch src := img.(type) {
+	case *image.Gray:
+		return pixels{pix: src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], stride: src.Stride, channels: 1, width: bounds.Dx(), height: bounds.Dy(), shared: true, opaque: true}
+	case *image.RGBA:
+		return pixels{pix: src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], stride: src.Stride, channels: 4, width: bounds.Dx(), height: bounds.Dy(), shared: true, opaque: src.Opaque()}
+	}
+
+	// Everything else is converted once, with draw's fast paths
+	// for YCbCr, NRGBA and the other common models
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	o, ok := img.(interface{ Opaque() bool })
+	return pixels{pix: rgba.Pix, stride: rgba.Stride, channels: 4, width: bounds.Dx(), height: bounds.Dy(), opaque: ok && o.Opaque()}
+}
+
+// withSize returns empty pixels of the same kind
+func (p pixels) withSize(width, height int) pixels {
+	return pixels{
+		pix:      make([]uint8, width*height*p.channels),
+		stride:   width * p.channels,
+		channels: p.channels,
+		width:    width,
+		height:   height,
+		opaque:   p.opaque,
+	}
+}
+
+// clone copies pixels shared with the source image
+func (p pixels) clone() pixels {
+	out := p.withSize(p.width, p.height)
+	for y := 0; y < p.height; y++ {
+		copy(out.pix[y*out.stride:(y+1)*out.stride], p.pix[y*p.stride:])
+	}
+	return out
+}
+
+// image wraps the samples as an image
+func (p pixels) image() image.Image {
+	rect := image.Rect(0, 0, p.width, p.height)
+	if p.channels == 1 {
+		return &image.Gray{Pix: p.pix, Stride: p.stride, Rect: rect}
+	}
+	return &image.RGBA{Pix: p.pix, Stride: p.stride, Rect: rect}
+}
+
+// weightBits is the fixed-point precision of the filter weights
+const weightBits = 14
+
+// contribution is the run of source samples that make up one
+// destination sample, and their weights summing to 1<<weightBits
+type contribution struct {
+	start   int
+	weights []int32
+}
+
+// contributions returns the weights mapping srcLen samples onto
+// dstLen. When shrinking, the filter is widened so every source
+// sample contributes. Samples past the edges are left out and the
+// remaining weights renormalised.
+func contributions(srcLen, dstLen int, f filter) []contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	filterScale := math.Max(scale, 1)
+	support := f.support * filterScale
+
+	out := make([]contribution, dstLen)
+	raw := make([]float64, 0, int(math.Ceil(support))*2+2)
+	for i := range out {
+		center := (float64(i) + 0.5) * scale
+		start := max(0, int(math.Floor(center-support)))
+		end := min(srcLen, int(math.Ceil(center+support)))
+
+		raw = raw[:0]
+		sum := 0.0
+		for j := start; j < end; j++ {
+			w := f.weight((float64(j) + 0.5 - center) / filterScale)
+			raw = append(raw, w)
+			sum += w
+		}
+		if sum == 0 {
+			// -> a filter narrower than the gap, take the nearest sample
+			out[i] = contribution{start: min(srcLen-1, int(center)), weights: []int32{1 << weightBits}}
+			continue
+		}
+
+		// Trim zero weights, so the inner loops skip them
+		used := raw
+		for len(used) > 1 && used[0] == 0 {
+			used, start = used[1:], start+1
+		}
+		for len(used) > 1 && used[len(used)-1] == 0 {
+			used = used[:len(used)-1]
+		}
+
+		weights := make([]int32, len(used))
+		var total, peak int32
+		for k, w := range used {
+			weights[k] = int32(math.Round(w / sum * (1 << weightBits)))
+			total += weights[k]
+			if weights[k] > weights[peak] {
+				peak = int32(k)
+			}
+		}
+		// -> rounding error goes to the largest weight, so flat areas stay flat
+		weights[peak] += 1<<weightBits - total
+		out[i] = contribution{start: start, weights: weights}
+	}
+	return out
+}
+
+// resampleRows scales each row of src to width samples
+func resampleRows(src pixels, width int, contribs []contribution, workers int) pixels {
+	dst := src.withSize(width, src.height)
+
+	parallelStripes(src.height, workers, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			in := src.pix[y*src.stride : y*src.stride+src.width*src.channels]
+			out := dst.pix[y*dst.stride : y*dst.stride+dst.width*dst.channels]
+			for x, c := range contribs {
+				run := in[c.start*src.channels : (c.start+len(c.weights))*src.channels]
+
+				switch {
+				case src.channels == 1:
+					var v int32
+					for k, w := range c.weights {
+						v += int32(run[k]) * w
+					}
+					out[x] = clampSample(v)
+
+				case src.opaque:
+					var r, g, b int32
+					for k, w := range c.weights {
+						s := run[k*4 : k*4+3 : k*4+3]
+						r += int32(s[0]) * w
+						g += int32(s[1]) * w
+						b += int32(s[2]) * w
+					}
+					d := out[x*4 : x*4+4 : x*4+4]
+					d[0], d[1], d[2], d[3] = clampSample(r), clampSample(g), clampSample(b), 0xff
+
+				default:
+					var r, g, b, a int32
+					for k, w := range c.weights {
+						s := run[k*4 : k*4+4 : k*4+4]
+						r += int32(s[0]) * w
+						g += int32(s[1]) * w
+						b += int32(s[2]) * w
+						a += int32(s[3]) * w
+					}
+					storeRGBA(out[x*4:x*4+4:x*4+4], r, g, b, a)
+				}
+			}
+		}
+	})
+	return dst
+}
+
+// resampleColumns scales each column of src to height samples
+func resampleColumns(src pixels, height int, contribs []contribution, workers int) pixels {
+	dst := src.withSize(src.width, height)
+	rowLen := src.width * src.channels
+
+	parallelStripes(height, workers, func(y0, y1 int) {
+		// Whole rows are weighed at once, so reads stay sequential
+		sums := make([]int32, rowLen)
+		for y := y0; y < y1; y++ {
+			c := contribs[y]
+			clear(sums)
+			for k, w := range c.weights {
+				in := src.pix[(c.start+k)*src.stride : (c.start+k)*src.stride+rowLen]
+				for i, s := range in {
+					sums[i] += int32(s) * w
+				}
+			}
+
+			out := dst.pix[y*dst.stride : y*dst.stride+rowLen]
+			if src.channels == 1 || src.opaque {
+				// -> an opaque alpha sums to exactly 0xff
+				for i, v := range sums {
+					out[i] = clampSample(v)
+				}
+				continue
+			}
+			for i := 0; i < rowLen; i += 4 {
+				storeRGBA(out[i:i+4:i+4], sums[i], sums[i+1], sums[i+2], sums[i+3])
+			}
+		}
+	})
+	return dst
+}
+
+// resampleNearest scales src by copying the closest sample
+func resampleNearest(src pixels, width, height int, workers int) pixels {
+	dst := src.withSize(width, height)
+	channels := src.channels
+
+	columns := make([]int, width)
+	for x := range columns {
+		columns[x] = min(src.width-1, int((float64(x)+0.5)*float64(src.width)/float64(width))) * channels
+	}
+
+	parallelStripes(height, workers, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			sy := min(src.height-1, int((float64(y)+0.5)*float64(src.height)/float64(height)))
+			in := src.pix[sy*src.stride:]
+			out := dst.pix[y*dst.stride:]
+			for x, sx := range columns {
+				copy(out[x*channels:(x+1)*channels], in[sx:sx+channels])
+			}
+		}
+	})
+	return dst
+}
+
+// clampSample rounds a weighted sum back to an 8-bit sample
+func clampSample(v int32) uint8 {
+	v = (v + 1<<(weightBits-1)) >> weightBits
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return uint8(v)
+}
+
+// storeRGBA writes weighted premultiplied sums, keeping each color
+// within the alpha that the kernel's negative lobes can overshoot
+func storeRGBA(out []uint8, r, g, b, a int32) {
+	alpha := clampSample(a)
+	out[0] = min(clampSample(r), alpha)
+	out[1] = min(clampSample(g), alpha)
+	out[2] = min(clampSample(b), alpha)
+	out[3] = alpha
+}
+
+// minStripeRows keeps stripes large enough to be worth a goroutine
+const minStripeRows = 16
+
+// parallelStripes calls fn for stripes of the rows [0, rows),
+// at most workers of them at once
+func parallelStripes(rows, workers int, fn func(y0, y1 int)) {
+	stripes := min(workers, max(1, rows/minStripeRows))
+	if stripes <= 1 {
+		fn(0, rows)
+		return
+	}
+
+	size := (rows + stripes - 1) / stripes
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < rows; y0 += size {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(rows, y0+size))
+	}
+	wg.Wait()
+}
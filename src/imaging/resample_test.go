@@ -0,0 +1,155 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"slices"
+	"testing"
+)
+
+// grayRow returns a one-row grayscale image with the given samples
+func grayRow(samples ...uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, len(samples), 1))
+	copy(img.Pix, samples)
+	return img
+}
+
+// transparentEdge returns an 8x1 image, opaque red on the left half
+// and fully transparent green on the right. Resampled premultiplied,
+// the green must never show.
+func transparentEdge() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 1))
+	for x := 0; x < 8; x++ {
+		if x < 4 {
+			img.SetNRGBA(x, 0, color.NRGBA{255, 0, 0, 255})
+		} else {
+			img.SetNRGBA(x, 0, color.NRGBA{0, 255, 0, 0})
+		}
+	}
+	return img
+}
+
+func TestResampleGolden(t *testing.T) {
+	tests := []struct {
+		kernel Kernel
+		down   []uint8 // -> 8 to 4 pixels across a hard edge
+		up     []uint8 // -> 4 to 8 pixels across a hard edge
+		edge   []uint8 // -> transparentEdge to 4 pixels, premultiplied RGBA
+	}{
+		{
+			kernel: KernelNearest,
+			down:   []uint8{0, 0, 255, 255},
+			up:     []uint8{0, 0, 0, 0, 255, 255, 255, 255},
+			edge:   []uint8{255, 0, 0, 255, 255, 0, 0, 255, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			kernel: KernelBilinear,
+			down:   []uint8{0, 32, 223, 255},
+			up:     []uint8{0, 0, 0, 64, 191, 255, 255, 255},
+			edge:   []uint8{255, 0, 0, 255, 223, 0, 0, 223, 32, 0, 0, 32, 0, 0, 0, 0},
+		},
+		{
+			kernel: KernelCatmullRom,
+			down:   []uint8{0, 17, 238, 255},
+			up:     []uint8{0, 0, 0, 52, 203, 255, 255, 255},
+			edge:   []uint8{255, 0, 0, 255, 238, 0, 0, 238, 17, 0, 0, 17, 0, 0, 0, 0},
+		},
+		{
+			// -> Lanczos rings at the image's own borders too
+			kernel: KernelLanczos,
+			down:   []uint8{0, 13, 242, 255},
+			up:     []uint8{10, 0, 0, 54, 201, 255, 255, 245},
+			edge:   []uint8{255, 0, 0, 255, 242, 0, 0, 242, 13, 0, 0, 13, 0, 0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.kernel), func(t *testing.T) {
+			down, ok := Resize(grayRow(0, 0, 0, 0, 255, 255, 255, 255), 4, 1, test.kernel).(*image.Gray)
+			if !ok {
+				t.Fatalf("gray image did not stay gray")
+			}
+			if !slices.Equal(down.Pix, test.down) {
+				t.Errorf("down = %v, want %v", down.Pix, test.down)
+			}
+
+			up := Resize(grayRow(0, 0, 255, 255), 8, 1, test.kernel).(*image.Gray)
+			if !slices.Equal(up.Pix, test.up) {
+				t.Errorf("up = %v, want %v", up.Pix, test.up)
+			}
+
+			edge := Resize(transparentEdge(), 4, 1, test.kernel).(*image.RGBA)
+			if !slices.Equal(edge.Pix, test.edge) {
+				t.Errorf("edge = %v, want %v", edge.Pix, test.edge)
+			}
+		})
+	}
+}
+
+func TestResampleTransparentEdgeDoesNotBleed(t *testing.T) {
+	for _, kernel := range []Kernel{KernelNearest, KernelBilinear, KernelCatmullRom, KernelLanczos} {
+		for _, width := range []int{3, 5, 13} {
+			out := Resize(transparentEdge(), width, 2, kernel).(*image.RGBA)
+			for i := 0; i < len(out.Pix); i += 4 {
+				r, g, b, a := out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3]
+				if g != 0 || b != 0 || r > a {
+					t.Errorf("%s to %d: pixel %d = %v, want premultiplied red only", kernel, width, i/4, out.Pix[i:i+4])
+				}
+			}
+		}
+	}
+}
+
+func TestResizeKeepsAspectAndCopies(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	if bounds := Resize(src, 10, 0, KernelLanczos).Bounds(); bounds.Dx() != 10 || bounds.Dy() != 5 {
+		t.Errorf("width 10 gives %v, want 10x5", bounds)
+	}
+	if bounds := Resize(src, 0, 4, KernelLanczos).Bounds(); bounds.Dx() != 8 || bounds.Dy() != 4 {
+		t.Errorf("height 4 gives %v, want 8x4", bounds)
+	}
+
+	same := Resize(src, 40, 20, KernelLanczos).(*image.RGBA)
+	same.Pix[0] = 1
+	if src.Pix[0] != 0 {
+		t.Errorf("resizing to the same size shares pixels with the source")
+	}
+}
+
+// benchmarkPhoto returns an opaque RGBA image with some detail
+func benchmarkPhoto(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(x), uint8(y), uint8(x^y), 0xff
+		}
+	}
+	return img
+}
+
+// benchmarkResample fits a 6MP photo to a 4x6 print at 300 DPI, and
+// enlarges a small one to it, with kernel
+func benchmarkResample(b *testing.B, kernel Kernel) {
+	for _, size := range []struct {
+		name          string
+		width, height int
+	}{
+		{"down", 3000, 2000},
+		{"up", 900, 600},
+	} {
+		src := benchmarkPhoto(size.width, size.height)
+		b.Run(size.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(src.Pix)))
+			for i := 0; i < b.N; i++ {
+				Resize(src, 1800, 1200, kernel)
+			}
+		})
+	}
+}
+
+func BenchmarkResampleNearest(b *testing.B)    { benchmarkResample(b, KernelNearest) }
+func BenchmarkResampleBilinear(b *testing.B)   { benchmarkResample(b, KernelBilinear) }
+func BenchmarkResampleCatmullRom(b *testing.B) { benchmarkResample(b, KernelCatmullRom) }
+func BenchmarkResampleLanczos(b *testing.B)    { benchmarkResample(b, KernelLanczos) }
@@ -0,0 +1,168 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// UnsharpMask describes an unsharp-mask sharpening pass. Each pixel
+// is pushed away from a Gaussian blur of its neighbourhood.
+type UnsharpMask struct {
+	Radius    float64 // -> Gaussian sigma in pixels
+	Amount    float64 // -> strength, 1 adds the full difference to the blur
+	Threshold uint8   // -> differences below this many levels are left alone
+}
+
+// DefaultUnsharpMask is applied after a resize that is not for a
+// known print size
+var DefaultUnsharpMask = UnsharpMask{Radius: 0.8, Amount: 0.7, Threshold: 2}
+
+// maxSharpenRadius bounds the blur so the kernel stays small
+const maxSharpenRadius = 10
+
+// ParseUnsharpMask parses "radius,amount,threshold", e.g. "1,0.8,3"
+func ParseUnsharpMask(value string) (UnsharpMask, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return UnsharpMask{}, fmt.Errorf("unsharp mask %q must be radius,amount,threshold", value)
+	}
+
+	radius, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return UnsharpMask{}, fmt.Errorf("invalid sharpening radius %q", parts[0])
+	}
+	amount, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return UnsharpMask{}, fmt.Errorf("invalid sharpening amount %q", parts[1])
+	}
+	threshold, err := strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 8)
+	if err != nil {
+		return UnsharpMask{}, fmt.Errorf("invalid sharpening threshold %q", parts[2])
+	}
+
+	mask := UnsharpMask{Radius: radius, Amount: amount, Threshold: uint8(threshold)}
+	return mask, mask.validate()
+}
+
+// validate checks the mask's values are in range
+func (u UnsharpMask) validate() error {
+	if u.Radius <= 0 || u.Radius > maxSharpenRadius {
+		return fmt.Errorf("sharpening radius must be in (0, %d], got %g", maxSharpenRadius, u.Radius)
+	}
+	if u.Amount < 0 || u.Amount > 5 {
+		return fmt.Errorf("sharpening amount must be in [0, 5], got %g", u.Amount)
+	}
+	return nil
+}
+
+// ForDPI scales the radius, tuned at DefaultDPI, to a print
+// rendered at dpi so the visible sharpening stays the same
+func (u UnsharpMask) ForDPI(dpi int) UnsharpMask {
+	if dpi > 0 {
+		u.Radius = math.Min(u.Radius*float64(dpi)/DefaultDPI, maxSharpenRadius)
+	}
+	return u
+}
+
+// Sharpen returns img sharpened with the unsharp mask u. The alpha
+// channel is kept as it is. A zero amount returns img unchanged.
+func Sharpen(img image.Image, u UnsharpMask) (image.Image, error) {
+	if err := u.validate(); err != nil {
+		return nil, err
+	}
+	if u.Amount == 0 {
+		return img, nil
+	}
+
+	src := toRGBA(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	if width == 0 || height == 0 {
+		return img, nil
+	}
+
+	kernel := gaussianKernel(u.Radius)
+	half := len(kernel) / 2
+
+	// Horizontal pass into a float buffer of the RGB channels
+	blurred := make([]float32, width*height*3)
+	for y := 0; y < height; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, b float32
+			for k, weight := range kernel {
+				sx := min(max(x+k-half, 0), width-1) // -> clamp at the edges
+				r += weight * float32(row[sx*4])
+				g += weight * float32(row[sx*4+1])
+				b += weight * float32(row[sx*4+2])
+			}
+			i := (y*width + x) * 3
+			blurred[i], blurred[i+1], blurred[i+2] = r, g, b
+		}
+	}
+
+	// Vertical pass, applying the mask to each pixel as it is blurred
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	amount, threshold := float32(u.Amount), float32(u.Threshold)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var blur [3]float32
+			for k, weight := range kernel {
+				sy := min(max(y+k-half, 0), height-1)
+				i := (sy*width + x) * 3
+				blur[0] += weight * blurred[i]
+				blur[1] += weight * blurred[i+1]
+				blur[2] += weight * blurred[i+2]
+			}
+
+			offset := y*src.Stride + x*4
+			out := y*dst.Stride + x*4
+			alpha := src.Pix[offset+3]
+			for c := 0; c < 3; c++ {
+				original := float32(src.Pix[offset+c])
+				diff := original - blur[c]
+				if diff < threshold && -diff < threshold {
+					dst.Pix[out+c] = src.Pix[offset+c]
+					continue
+				}
+				// Colors are premultiplied, so none may exceed the alpha
+				dst.Pix[out+c] = min(clampUint8(original+amount*diff), alpha)
+			}
+			dst.Pix[out+3] = alpha
+		}
+	}
+
+	return dst, nil
+}
+
+// gaussianKernel returns a normalised 1D Gaussian kernel for sigma,
+// spanning three sigmas either side of the centre
+func gaussianKernel(sigma float64) []float32 {
+	half := max(1, int(math.Ceil(sigma*3)))
+	kernel := make([]float32, 2*half+1)
+
+	var sum float64
+	weights := make([]float64, len(kernel))
+	for i := range weights {
+		d := float64(i - half)
+		weights[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += weights[i]
+	}
+	for i, weight := range weights {
+		kernel[i] = float32(weight / sum)
+	}
+	return kernel
+}
+
+// clampUint8 rounds v to the nearest value in [0, 255]
+func clampUint8(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
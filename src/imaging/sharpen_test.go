@@ -0,0 +1,157 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"slices"
+	"testing"
+)
+
+// stepEdge returns a gray row of width pixels, dark on the left
+// half and light on the right
+func stepEdge(width int, dark, light uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, 1))
+	for x := 0; x < width; x++ {
+		v := dark
+		if x >= width/2 {
+			v = light
+		}
+		img.SetRGBA(x, 0, color.RGBA{v, v, v, 255})
+	}
+	return img
+}
+
+// redRow returns the red channel of the first row of img
+func redRow(t *testing.T, img image.Image) []uint8 {
+	t.Helper()
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		t.Fatalf("sharpened image is %T, want *image.RGBA", img)
+	}
+	row := make([]uint8, rgba.Rect.Dx())
+	for x := range row {
+		row[x] = rgba.Pix[x*4]
+		if g, b := rgba.Pix[x*4+1], rgba.Pix[x*4+2]; g != row[x] || b != row[x] {
+			t.Fatalf("pixel %d is not gray: %v", x, rgba.Pix[x*4:x*4+3])
+		}
+	}
+	return row
+}
+
+func TestUnsharpMaskGolden(t *testing.T) {
+	edge := stepEdge(8, 50, 200)
+
+	tests := []struct {
+		name string
+		mask UnsharpMask
+		want []uint8
+	}{
+		// Only the pixels either side of the edge overshoot
+		{"narrow", UnsharpMask{Radius: 0.5, Amount: 1}, []uint8{50, 50, 50, 34, 216, 200, 200, 200}},
+		// A wider radius spreads the halo and deepens it
+		{"wide", UnsharpMask{Radius: 1, Amount: 1}, []uint8{50, 49, 41, 5, 245, 209, 201, 200}},
+		{"half amount", UnsharpMask{Radius: 1, Amount: 0.5}, []uint8{50, 50, 46, 27, 223, 204, 200, 200}},
+		// The threshold keeps the small differences away from the edge
+		{"threshold", UnsharpMask{Radius: 1, Amount: 1, Threshold: 20}, []uint8{50, 50, 50, 5, 245, 200, 200, 200}},
+		// and above the edge's own difference leaves it alone
+		{"threshold above edge", UnsharpMask{Radius: 1, Amount: 1, Threshold: 80}, []uint8{50, 50, 50, 50, 200, 200, 200, 200}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := Sharpen(edge, test.mask)
+			if err != nil {
+				t.Fatalf("Sharpen: %v", err)
+			}
+			if got := redRow(t, out); !slices.Equal(got, test.want) {
+				t.Errorf("row = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnsharpMaskRadiusWidensHalo(t *testing.T) {
+	edge := stepEdge(32, 80, 160)
+
+	changed := func(radius float64) int {
+		out, err := Sharpen(edge, UnsharpMask{Radius: radius, Amount: 1})
+		if err != nil {
+			t.Fatalf("Sharpen: %v", err)
+		}
+		count := 0
+		for x, v := range redRow(t, out) {
+			if v != edge.Pix[x*4] {
+				count++
+			}
+		}
+		return count
+	}
+
+	previous := 0
+	for _, radius := range []float64{0.5, 1, 2, 4} {
+		count := changed(radius)
+		if count <= previous {
+			t.Errorf("radius %g changed %d pixels, no more than the %d of a smaller radius", radius, count, previous)
+		}
+		previous = count
+	}
+}
+
+func TestUnsharpMaskLeavesFlatAndZeroAmount(t *testing.T) {
+	flat := stepEdge(8, 90, 90)
+	out, err := Sharpen(flat, UnsharpMask{Radius: 2, Amount: 3})
+	if err != nil {
+		t.Fatalf("Sharpen: %v", err)
+	}
+	if got := redRow(t, out); !slices.Equal(got, []uint8{90, 90, 90, 90, 90, 90, 90, 90}) {
+		t.Errorf("flat row = %v, want it unchanged", got)
+	}
+
+	edge := stepEdge(8, 50, 200)
+	if out, _ := Sharpen(edge, UnsharpMask{Radius: 1}); out != image.Image(edge) {
+		t.Errorf("zero amount returned a new image")
+	}
+}
+
+func TestUnsharpMaskKeepsPremultipliedAlpha(t *testing.T) {
+	// Opaque black on the left, half-transparent gray on the right
+	img := image.NewRGBA(image.Rect(0, 0, 8, 1))
+	for x := 0; x < 8; x++ {
+		if x < 4 {
+			img.Pix[x*4+3] = 255
+			continue
+		}
+		copy(img.Pix[x*4:], []uint8{120, 120, 120, 128})
+	}
+
+	out, err := Sharpen(img, UnsharpMask{Radius: 1, Amount: 2})
+	if err != nil {
+		t.Fatalf("Sharpen: %v", err)
+	}
+
+	want := []uint8{
+		0, 0, 0, 255, 0, 0, 0, 255, 0, 0, 0, 255, 0, 0, 0, 255,
+		// -> the overshoot is clamped to the alpha
+		128, 128, 128, 128, 128, 128, 128, 128, 121, 121, 121, 128, 120, 120, 120, 128,
+	}
+	if got := out.(*image.RGBA).Pix; !slices.Equal(got, want) {
+		t.Errorf("pixels = %v, want %v", got, want)
+	}
+}
+
+func TestParseUnsharpMask(t *testing.T) {
+	mask, err := ParseUnsharpMask(" 1.5, 0.8 ,3")
+	if err != nil {
+		t.Fatalf("ParseUnsharpMask: %v", err)
+	}
+	if want := (UnsharpMask{Radius: 1.5, Amount: 0.8, Threshold: 3}); mask != want {
+		t.Errorf("mask = %+v, want %+v", mask, want)
+	}
+
+	for _, value := range []string{"", "1,1", "0,1,0", "11,1,0", "1,6,0", "1,1,256", "a,1,0"} {
+		if _, err := ParseUnsharpMask(value); err == nil {
+			t.Errorf("ParseUnsharpMask(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+
+	"github.com/30Piraten/snapflow/config"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// main runs the upload-completion handler as a Lambda subscribed to
+// the bucket's s3:ObjectCreated:* notifications for presigned uploads.
+// It reads BUCKET_NAME, AWS_REGION, DYNAMODB_TABLE_NAME and SQS_QUEUE_URL.
+func main() {
+	if err := config.InitStorage(); err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// Register the decoders for the optional upload formats
+	if err := config.InitDecoders(); err != nil {
+		log.Fatalf("Failed to register image decoders: %v", err)
+	}
+
+	lambda.Start(config.UploadCompletion().HandleEvent)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
@@ -42,6 +43,61 @@ func main() {
 	}
 	defer utils.Logger.Sync()
 
+	// Initialize the storage backend (S3 or local disk)
+	if err := config.InitStorage(); err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// Register the decoders for the optional upload formats
+	if err := config.InitDecoders(); err != nil {
+		log.Fatalf("Failed to register image decoders: %v", err)
+	}
+
+	// Validate the processing configuration before taking orders
+	if _, err := config.PrintDPI(); err != nil {
+		log.Fatalf("Invalid print configuration: %v", err)
+	}
+	if _, err := config.PrintBackground(); err != nil {
+		log.Fatalf("Invalid print configuration: %v", err)
+	}
+	if _, err := config.ResamplingKernel(); err != nil {
+		log.Fatalf("Invalid resampling configuration: %v", err)
+	}
+	if _, err := config.MetadataPolicy(); err != nil {
+		log.Fatalf("Invalid metadata configuration: %v", err)
+	}
+	if _, _, err := config.Sharpening(); err != nil {
+		log.Fatalf("Invalid sharpening configuration: %v", err)
+	}
+	if _, err := config.PrintQualityPolicy(); err != nil {
+		log.Fatalf("Invalid print quality configuration: %v", err)
+	}
+	if _, err := config.OutputProfiles(); err != nil {
+		log.Fatalf("Invalid print profile configuration: %v", err)
+	}
+	if _, err := config.AutoColor(); err != nil {
+		log.Fatalf("Invalid color correction configuration: %v", err)
+	}
+	if _, err := config.Recipes(); err != nil {
+		log.Fatalf("Invalid processing recipes: %v", err)
+	}
+	if _, err := config.ImageCacheBytes(); err != nil {
+		log.Fatalf("Invalid image cache configuration: %v", err)
+	}
+	if _, _, err := config.DecodeBudget(); err != nil {
+		log.Fatalf("Invalid decode budget configuration: %v", err)
+	}
+
+	// Consume S3 upload notifications in-process when a queue is
+	// configured, instead of running the upload-completion Lambda
+	if queueURL := os.Getenv("UPLOAD_EVENTS_QUEUE_URL"); queueURL != "" {
+		sqsClient, err := config.SQSClient()
+		if err != nil {
+			log.Fatalf("Failed to initialize SQS client: %v", err)
+		}
+		go config.UploadCompletion().Consume(context.Background(), sqsClient, queueURL)
+	}
+
 	// Enable CORS
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: os.Getenv("TRUSTED_ORIGIN"),
@@ -1,10 +1,12 @@
 package models
 
 import (
+	"image/color"
 	"mime/multipart"
 	"sync"
 	"time"
 
+	"github.com/30Piraten/snapflow/imaging"
 	"go.uber.org/zap"
 )
 
@@ -15,8 +17,9 @@ type PrintJob struct {
 	ProcessedS3Location string `json:"processed_s3_location"`
 }
 
-// SignedURLInfo struct
+// SignedURLInfo describes a CloudFront signed download URL
 type SignedURLInfo struct {
+	URL              string `json:"url"`
 	CloudFrontDomain string `json:"cloudfront_domain"`
 	ObjectKey        string `json:"object_key"`
 	Expires          int64  `json:"expires"`
@@ -24,6 +27,7 @@ type SignedURLInfo struct {
 	Policy           string `json:"policy"`
 	CustomerName     string `json:"customer_name"`
 	OrderID          string `json:"order_id"`
+	Rendition        string `json:"rendition,omitempty"`
 }
 
 type PhotoOrder struct {
@@ -50,9 +54,15 @@ const (
 	MaxFileCount            int   = 10              // Maximum 10 files per request
 	TargetFileSize          int64 = 2 * 1024 * 1024 // 2MB total for all sizes
 	MaxFileSize             int64 = 50 * 100 * 1024 // 50MB per file upload
+	MaxImageDimension       int   = 6000            // Max width and height of a decoded image
+	MaxImagePixels          int64 = 25_000_000      // Max pixels decoded per image, e.g. 6000x4000
 	// MaxTotalUploadSize      int   = 5 * 1024 * 1024 // 5MB total for all files
 )
 
+// MaxProcessingTime is how long one file of a multi-file upload may
+// take to validate or process before it is reported as failed
+const MaxProcessingTime = 2 * time.Minute
+
 // ProcessingOptions defines configuration for image processing
 type ProcessingOptions struct {
 	MaxWidth         int
@@ -64,6 +74,50 @@ type ProcessingOptions struct {
 	OptimiseSizeOnly bool
 	TargetSizeBytes  int64 // -> New field for target file size
 	MaxDimensions    Dimensions
+	MaxPixels        int64 // -> pixel budget checked from the header, before decoding
+
+	// Print geometry, see imaging.PrintSpec. No print
+	// size leaves the photo's dimensions unchanged.
+	PrintSize        string // -> "4x6", "5x7" or "2x3"
+	PrintDPI         int
+	PrintOrientation string // -> "auto", "portrait" or "landscape"
+	FitMode          string // -> "fill", "fit" or "stretch"
+
+	// Kernel the photo is resampled with whenever it is resized,
+	// imaging.DefaultKernel when empty
+	Kernel imaging.Kernel
+
+	// Paper color transparent areas are flattened onto, and
+	// letterboxing is filled with. Unset means paper white.
+	Background color.NRGBA
+
+	// Refuse photos whose effective DPI grades them poor for the
+	// print size, instead of flagging them in the response
+	RejectPoorPrints bool
+
+	// Metadata copied into the output when PreserveMetadata is
+	// set. GPS position and device serials are always stripped.
+	KeepCaptureDate bool
+	KeepCopyright   bool
+	KeepICCProfile  bool
+
+	// Unsharp mask applied after resizing when Sharpen is set. A
+	// zero radius uses the mask tuned for the print size.
+	SharpenRadius    float64
+	SharpenAmount    float64
+	SharpenThreshold uint8
+
+	// ICC profile of the printer and paper the print master is
+	// converted to from sRGB, nil to leave it in sRGB
+	OutputProfile *imaging.ICCProfile
+
+	// Strengths of the automatic color correction applied once
+	// the photo is fitted to its print, none when all are zero
+	AutoColor imaging.AutoColor
+
+	// Recipe whose steps replace the processing above, for the
+	// ordered product. A recipe without a name is not used.
+	Recipe imaging.Recipe
 }
 
 type Dimensions struct {
@@ -82,6 +136,17 @@ type ResponseData struct {
 	Order        *PhotoOrder `json:"order"`
 	PresignedURL []string    `json:"presigned_url"`
 	OrderID      string      `json:"order_id"`
+
+	// Print quality of each photo, with a warning for poor ones
+	PrintQuality []PhotoPrintQuality `json:"print_quality,omitempty"`
+}
+
+// PhotoPrintQuality is the expected print quality of a photo
+type PhotoPrintQuality struct {
+	Filename     string `json:"filename"`
+	EffectiveDPI int    `json:"effective_dpi"`
+	Quality      string `json:"quality"`
+	Warning      string `json:"warning,omitempty"`
 }
 
 // FileProcessingResult holds the result of processing a single file
@@ -94,6 +159,68 @@ type FileProcessingResult struct {
 	Error         *ProcessingError `json:"error,omitempty"`
 	Duration      time.Duration    `json:"duration"`
 	Quality       int              `json:"quality"`
+	Encodes       int              `json:"encodes,omitempty"` // -> JPEG encodes taken to meet the target size
+	PhotoIndex    int              `json:"photo_index"`
+
+	// EXIF orientation of the upload and the clockwise rotation
+	// and mirroring applied to turn it upright
+	ExifOrientation int  `json:"exif_orientation,omitempty"`
+	Rotation        int  `json:"rotation"`
+	Mirrored        bool `json:"mirrored"`
+
+	// Effective DPI of the photo on its print and its grade:
+	// "good", "acceptable" or "poor"
+	EffectiveDPI int    `json:"effective_dpi,omitempty"`
+	PrintQuality string `json:"print_quality,omitempty"`
+
+	// How transparency, 16-bit channels and palettes were
+	// flattened for the 8-bit JPEG
+	Flattening *imaging.Flattening `json:"flattening,omitempty"`
+
+	// Automatic color correction applied, so it can be undone
+	ColorCorrection *imaging.ColorCorrection `json:"color_correction,omitempty"`
+
+	// Key of the original EXIF, saved as JSON for editors
+	ExifKey string `json:"exif_key,omitempty"`
+
+	// Content hashes used to deduplicate resubmitted photos
+	OriginalSHA256  string `json:"original_sha256,omitempty"`
+	ProcessedSHA256 string `json:"processed_sha256,omitempty"`
+	Deduplicated    bool   `json:"deduplicated"`
+
+	// The print master at Path and its smaller renditions
+	Renditions []Rendition `json:"renditions,omitempty"`
+}
+
+// Rendition is one stored version of a processed photo
+type Rendition struct {
+	Name   string `json:"name"` // -> "print", "preview" or "thumbnail"
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// OrderManifest lists the processed photos linked to an order
+type OrderManifest struct {
+	OrderID       string       `json:"order_id"`
+	CustomerName  string       `json:"customer_name,omitempty"`
+	CustomerEmail string       `json:"customer_email,omitempty"`
+	Photos        []OrderPhoto `json:"photos"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+// OrderPhoto is a processed photo linked to an order
+type OrderPhoto struct {
+	Filename        string `json:"filename"`
+	Key             string `json:"key"`
+	Size            int64  `json:"size"`
+	OriginalSHA256  string `json:"original_sha256"`
+	ProcessedSHA256 string `json:"processed_sha256"`
+	Deduplicated    bool   `json:"deduplicated"`
+	ExifKey         string `json:"exif_key,omitempty"`
+
+	Renditions []Rendition `json:"renditions,omitempty"`
 }
 
 // ProcessingError represents a structured processing error
@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"github.com/30Piraten/snapflow/config"
 	h "github.com/30Piraten/snapflow/handlers"
+	"github.com/30Piraten/snapflow/storage"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -18,4 +20,12 @@ func Handler(app *fiber.App) {
 
 	// Register the presigned URL route
 	h.Upload(app)
+
+	// Register the signed download URL route
+	h.Download(app)
+
+	// Serve presigned URLs when running without S3
+	if local, ok := config.ObjectStore().(*storage.LocalStorage); ok {
+		h.LocalStorage(app, local, config.UploadCompletion())
+	}
 }
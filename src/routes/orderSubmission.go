@@ -1,9 +1,13 @@
 package routes
 
 import (
+	"errors"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/imaging"
 	"github.com/30Piraten/snapflow/models"
 	"github.com/30Piraten/snapflow/services"
 	svc "github.com/30Piraten/snapflow/services"
@@ -12,6 +16,10 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// retryAfterSeconds is how long a client is asked to wait before
+// resubmitting an order refused while the server is at capacity
+const retryAfterSeconds = 30
+
 // HandleOrderSubmission is the main entry point for the order
 // submission process. It will parse order details, generate
 // a presigned URL, process uploaded files and return a successful
@@ -44,13 +52,29 @@ func HandleOrderSubmission(c *fiber.Ctx) error {
 	}
 
 	// Generate presigned URL
-	presignedResponse, err := url.GeneratePresignedURL(order)
+	presignedResponse, err := url.GeneratePresignedURL(order, config.ObjectStore())
 	if err != nil {
 		return utils.HandleError(c, fiber.StatusInternalServerError, "File validation or processing failed", err)
 	}
 
 	// Process uploaded photos
-	if err := svc.ProcessUploadedFiles(c); err != nil {
+	results, err := svc.ProcessUploadedFiles(c, order, presignedResponse.OrderID)
+	switch {
+	case errors.Is(err, imaging.ErrOverloaded):
+		// -> the photos are fine, the server is busy
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfterSeconds))
+		return utils.HandleError(c, fiber.StatusServiceUnavailable, "Too many photos are being processed, please try again shortly", err)
+	case errors.Is(err, imaging.ErrPixelBudget):
+		return utils.HandleError(c, fiber.StatusRequestEntityTooLarge, "Photo is too large to process", err)
+	case errors.Is(err, svc.ErrInvalidOrder):
+		return utils.HandleError(c, fiber.StatusBadRequest, "Invalid order", err)
+	case errors.Is(err, svc.ErrMisconfigured):
+		return utils.HandleError(c, fiber.StatusInternalServerError, "Invalid server configuration", err)
+	case errors.Is(err, svc.ErrStorage):
+		return utils.HandleError(c, fiber.StatusInternalServerError, "Failed to store photos", err)
+	case errors.Is(err, svc.ErrOrderIncomplete):
+		return utils.HandleError(c, fiber.StatusInternalServerError, "Failed to complete order", err)
+	case err != nil:
 		return utils.HandleError(c, fiber.StatusBadRequest, "Failed to process files", err)
 	}
 
@@ -60,5 +84,6 @@ func HandleOrderSubmission(c *fiber.Ctx) error {
 		Order:        order,
 		PresignedURL: presignedResponse.URLs,
 		OrderID:      presignedResponse.OrderID,
+		PrintQuality: svc.PrintQualityReport(results),
 	})
 }
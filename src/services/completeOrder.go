@@ -0,0 +1,37 @@
+package services
+
+import (
+	"context"
+	"strconv"
+
+	cfg "github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/upload"
+)
+
+// completeOrder records the photos processed for an order as verified.
+// They were decoded and stored by storeFile, so they count towards
+// the order like verified presigned uploads, and the last one sends
+// the order to print.
+func completeOrder(ctx context.Context, order models.PhotoOrder, orderID string, results []models.FileProcessingResult) error {
+	completion := cfg.UploadCompletion()
+
+	for _, result := range results {
+		if result.Error != nil || result.Path == "" {
+			continue
+		}
+
+		err := completion.PhotoVerified(ctx, upload.Photo{
+			Key:           result.Path,
+			OrderID:       orderID,
+			CustomerEmail: order.Email,
+			Location:      order.Location,
+			Index:         strconv.Itoa(result.PhotoIndex),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/30Piraten/snapflow/imaging"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
+)
+
+// dedupIndexPrefix is where the dedup index lives. It maps the
+// SHA-256 of an original upload to the rendition it produced,
+// wherever the object key template placed that rendition.
+const dedupIndexPrefix = "photos/originals"
+
+// dedupRecord links an original upload to its processed rendition
+type dedupRecord struct {
+	OriginalSHA256  string    `json:"original_sha256"`
+	ProcessedSHA256 string    `json:"processed_sha256"`
+	Key             string    `json:"key"`
+	Size            int64     `json:"size"`
+	CreatedAt       time.Time `json:"created_at"`
+
+	// The print master and the renditions stored next to it
+	Renditions []models.Rendition `json:"renditions,omitempty"`
+
+	// Expected print quality, the same for every upload of the
+	// original processed with the same options
+	Preflight *imaging.Preflight `json:"preflight,omitempty"`
+
+	// Flattening and automatic color correction of the rendition
+	Flattening *imaging.Flattening `json:"flattening,omitempty"`
+
+	ColorCorrection *imaging.ColorCorrection `json:"color_correction,omitempty"`
+}
+
+// hashReader returns the hex SHA-256 of src and
+// rewinds it so it can be read again.
+func hashReader(src io.ReadSeeker) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, src); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind file: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// fingerprintVersion is bumped whenever fingerprintOptions changes,
+// so older index entries stop matching
+const fingerprintVersion = 1
+
+// fingerprintOptions is the canonical form of the processing options
+// hashed into the fingerprint. The output profile is identified by
+// the SHA-256 of its data, as its pointer differs per process.
+type fingerprintOptions struct {
+	Version          int               `json:"v"`
+	MaxWidth         int               `json:"max_width"`
+	MaxHeight        int               `json:"max_height"`
+	Quality          int               `json:"quality"`
+	Sharpen          bool              `json:"sharpen"`
+	Format           string            `json:"format"`
+	PreserveMetadata bool              `json:"preserve_metadata"`
+	OptimiseSizeOnly bool              `json:"optimise_size_only"`
+	TargetSizeBytes  int64             `json:"target_size_bytes"`
+	MaxDimensions    [2]int            `json:"max_dimensions"`
+	MaxPixels        int64             `json:"max_pixels"`
+	PrintSize        string            `json:"print_size"`
+	PrintDPI         int               `json:"print_dpi"`
+	PrintOrientation string            `json:"print_orientation"`
+	FitMode          string            `json:"fit_mode"`
+	Kernel           imaging.Kernel    `json:"kernel"`
+	Background       [4]uint8          `json:"background"`
+	RejectPoorPrints bool              `json:"reject_poor_prints"`
+	KeepCaptureDate  bool              `json:"keep_capture_date"`
+	KeepCopyright    bool              `json:"keep_copyright"`
+	KeepICCProfile   bool              `json:"keep_icc_profile"`
+	SharpenRadius    float64           `json:"sharpen_radius"`
+	SharpenAmount    float64           `json:"sharpen_amount"`
+	SharpenThreshold uint8             `json:"sharpen_threshold"`
+	OutputProfile    string            `json:"output_profile"` // -> hex SHA-256 of the profile, empty for sRGB
+	AutoColor        imaging.AutoColor `json:"auto_color"`
+	Recipe           imaging.Recipe    `json:"recipe"`
+}
+
+// optionsFingerprint returns a short, stable digest of the processing
+// options. The same original processed with different options yields
+// a different rendition, so the fingerprint is part of the index key.
+// It is the same across requests and processes for the same options.
+func optionsFingerprint(opts models.ProcessingOptions) string {
+	canonical := fingerprintOptions{
+		Version:          fingerprintVersion,
+		MaxWidth:         opts.MaxWidth,
+		MaxHeight:        opts.MaxHeight,
+		Quality:          opts.Quality,
+		Sharpen:          opts.Sharpen,
+		Format:           opts.Format,
+		PreserveMetadata: opts.PreserveMetadata,
+		OptimiseSizeOnly: opts.OptimiseSizeOnly,
+		TargetSizeBytes:  opts.TargetSizeBytes,
+		MaxDimensions:    [2]int{opts.MaxDimensions.Width, opts.MaxDimensions.Height},
+		MaxPixels:        opts.MaxPixels,
+		PrintSize:        opts.PrintSize,
+		PrintDPI:         opts.PrintDPI,
+		PrintOrientation: opts.PrintOrientation,
+		FitMode:          opts.FitMode,
+		Kernel:           opts.Kernel,
+		Background:       [4]uint8{opts.Background.R, opts.Background.G, opts.Background.B, opts.Background.A},
+		RejectPoorPrints: opts.RejectPoorPrints,
+		KeepCaptureDate:  opts.KeepCaptureDate,
+		KeepCopyright:    opts.KeepCopyright,
+		KeepICCProfile:   opts.KeepICCProfile,
+		SharpenRadius:    opts.SharpenRadius,
+		SharpenAmount:    opts.SharpenAmount,
+		SharpenThreshold: opts.SharpenThreshold,
+		AutoColor:        opts.AutoColor,
+		Recipe:           opts.Recipe,
+	}
+	if opts.OutputProfile != nil {
+		sum := sha256.Sum256(opts.OutputProfile.Data)
+		canonical.OutputProfile = hex.EncodeToString(sum[:])
+	}
+
+	// -> struct fields marshal in order and map keys sorted
+	data, err := json.Marshal(canonical)
+	if err != nil {
+		// Options JSON cannot hold, like a NaN, fall back to their
+		// printed form, which is stable too as it has no pointers
+		data = []byte(fmt.Sprintf("%d %+v", fingerprintVersion, canonical))
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// dedupIndexKey returns the index entry key for an original upload
+func dedupIndexKey(originalHash, fingerprint string) string {
+	return path.Join(dedupIndexPrefix, originalHash, fingerprint+".json")
+}
+
+// lookupDuplicate returns the record of an earlier upload of the same
+// original with the same options, or nil when there is none or the
+// rendition it points at no longer exists.
+func lookupDuplicate(ctx context.Context, store storage.Storage, originalHash, fingerprint string) (*dedupRecord, error) {
+	body, _, err := store.Get(ctx, dedupIndexKey(originalHash, fingerprint))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dedup index: %w", err)
+	}
+	defer body.Close()
+
+	var record dedupRecord
+	if err := json.NewDecoder(body).Decode(&record); err != nil {
+		return nil, fmt.Errorf("failed to decode dedup index: %w", err)
+	}
+
+	// The index entry is only useful while the rendition exists
+	if _, err := store.Head(ctx, record.Key); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// saveDedupRecord writes the index entry for an original upload
+func saveDedupRecord(ctx context.Context, store storage.Storage, record dedupRecord, fingerprint string) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dedup record: %w", err)
+	}
+
+	return store.Put(ctx, dedupIndexKey(record.OriginalSHA256, fingerprint), bytes.NewReader(data), storage.PutOptions{
+		ContentType: "application/json",
+	})
+}
@@ -1,47 +1,70 @@
 package services
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"mime/multipart"
 
 	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
 	"github.com/30Piraten/snapflow/utils"
-	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
 )
 
-// handleSingleFile validates and processes a single file
-func handleSingleFile(c *fiber.Ctx, file *multipart.FileHeader, opts models.ProcessingOptions) error {
+// handleSingleFile validates and processes a single file of order
+// and links it to the order identified by orderID. It returns the
+// result in a slice, like ProcessMultipleFiles. An image refused
+// from its header fails with imaging.ErrPixelBudget, and one that
+// waited too long for decoding memory with imaging.ErrOverloaded.
+func handleSingleFile(ctx context.Context, file *multipart.FileHeader, opts models.ProcessingOptions, order models.PhotoOrder, store storage.Storage, orderID string) ([]models.FileProcessingResult, error) {
 
-	// Open the file
-	source, err := file.Open()
-	if err != nil {
-		return utils.HandleError(c, fiber.StatusInternalServerError, "Failed to open file", err)
+	// Refuse an oversized image from its header alone
+	processor := SharedImageProcessor()
+	if err := probeUpload(processor, file, opts); err != nil {
+		return nil, fmt.Errorf("file validation failed: %w", err)
 	}
-	defer source.Close()
 
-	// Read the file data into a byte slice
-	fileData, err := io.ReadAll(source)
+	// Read, validate and process the file once, straight
+	// from the upload rather than copying it into memory
+	prepared, err := prepareFile(ctx, file, opts, store, 0)
 	if err != nil {
-		return utils.HandleError(c, fiber.StatusInternalServerError, "Failed to read file data", err)
+		return nil, fmt.Errorf("file validation failed: %w", err)
 	}
+	defer prepared.release()
 
-	// Validate the file before processing
-	processor := NewImageProcessor(utils.Logger)
-	if _, err = processor.ValidateAndProcessImage(fileData, opts); err != nil {
-		return utils.HandleError(c, fiber.StatusBadRequest, "File validation failed", err)
+	// Store the processed file
+	result := storeFile(ctx, prepared, order, store, orderID)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to process file: %w", storeError(result.Error))
 	}
 
-	order := new(models.PhotoOrder)
+	// Link the photo, including a reused duplicate, to the order
+	if err := LinkPhotosToOrder(ctx, store, orderID, order.FullName, order.Email, []models.FileProcessingResult{result}); err != nil {
+		return nil, fmt.Errorf("%w: failed to link photo to order: %w", ErrOrderIncomplete, err)
+	}
 
-	// Process the file
-	result := ProcessFile(c, file, opts, order)
-	if result.Error != nil {
-		return utils.HandleError(c, fiber.StatusInternalServerError, "Failed to process file", fmt.Errorf("%+v", result.Error))
+	// The order goes to print once all of its photos are verified
+	if err := completeOrder(ctx, order, orderID, []models.FileProcessingResult{result}); err != nil {
+		return nil, fmt.Errorf("%w: failed to complete order: %w", ErrOrderIncomplete, err)
+	}
+
+	utils.Logger.Info("File processed successfully",
+		zap.String("file_path", result.Path),
+		zap.Bool("deduplicated", result.Deduplicated),
+	)
+
+	return []models.FileProcessingResult{result}, nil
+}
+
+// probeUpload checks the header of an uploaded file against the
+// pixel budget in opts, without decoding it
+func probeUpload(processor *ImageProcessor, file *multipart.FileHeader, opts models.ProcessingOptions) error {
+	source, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
 	}
+	defer source.Close()
 
-	return c.JSON(fiber.Map{
-		"message":  "File processed successfully",
-		"filePath": result.Path,
-	})
+	_, _, err = processor.ProbeImage(source, opts)
+	return err
 }
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/30Piraten/snapflow/imaging"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
+)
+
+// orderManifestKey returns the key of the manifest listing an order's photos
+func orderManifestKey(orderID string) string {
+	return path.Join("orders", orderID, "photos.json")
+}
+
+// orderExifKey returns the key of a photo's original EXIF
+func orderExifKey(orderID string, photoIndex int) string {
+	return path.Join("orders", orderID, "exif", fmt.Sprintf("%d.json", photoIndex))
+}
+
+// originalExif is the original EXIF of a photo, as saved for editors
+type originalExif struct {
+	Filename       string                    `json:"filename"`
+	OriginalSHA256 string                    `json:"original_sha256"`
+	HasICCProfile  bool                      `json:"has_icc_profile"`
+	Exif           map[string]map[string]any `json:"exif"`
+}
+
+// saveOriginalExif saves the original EXIF of a photo next to the
+// order's manifest, so editors can see it even though the processed
+// photo keeps only what the metadata policy allows. The GPS position,
+// owner and serial numbers are left out, as editors have no use for
+// them. It returns the key.
+func saveOriginalExif(ctx context.Context, store storage.Storage, orderID string, photoIndex int, filename, originalHash string, metadata *imaging.Metadata) (string, error) {
+	data, err := json.Marshal(originalExif{
+		Filename:       filename,
+		OriginalSHA256: originalHash,
+		HasICCProfile:  len(metadata.ICCProfile) > 0,
+		Exif:           metadata.Exif.Redacted().Fields(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal EXIF of %s: %w", filename, err)
+	}
+
+	key := orderExifKey(orderID, photoIndex)
+	err = store.Put(ctx, key, bytes.NewReader(data), storage.PutOptions{
+		ContentType: "application/json",
+	})
+	return key, err
+}
+
+// LoadOrderManifest reads the photo manifest of an order. It
+// returns storage.ErrNotFound when the order has no manifest.
+func LoadOrderManifest(ctx context.Context, store storage.Storage, orderID string) (*models.OrderManifest, error) {
+	body, _, err := store.Get(ctx, orderManifestKey(orderID))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	manifest := new(models.OrderManifest)
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest for order %s: %w", orderID, err)
+	}
+
+	return manifest, nil
+}
+
+// LinkPhotosToOrder records the processed photos of an order in its
+// manifest. Deduplicated photos point at the rendition stored by the
+// earlier upload, so an order never needs its own copy of a photo.
+func LinkPhotosToOrder(ctx context.Context, store storage.Storage, orderID, customerName, customerEmail string, results []models.FileProcessingResult) error {
+	if orderID == "" {
+		return errors.New("order ID is required to link photos")
+	}
+
+	manifest, err := LoadOrderManifest(ctx, store, orderID)
+	if errors.Is(err, storage.ErrNotFound) {
+		manifest = &models.OrderManifest{OrderID: orderID}
+	} else if err != nil {
+		return err
+	}
+	if customerName != "" {
+		manifest.CustomerName = customerName
+	}
+	if customerEmail != "" {
+		manifest.CustomerEmail = customerEmail
+	}
+
+	// Index the photos already linked so resubmitting one is a no-op
+	linked := make(map[string]struct{}, len(manifest.Photos))
+	for _, photo := range manifest.Photos {
+		linked[photo.Key] = struct{}{}
+	}
+
+	for _, result := range results {
+		if result.Error != nil || result.Path == "" {
+			continue
+		}
+		if _, ok := linked[result.Path]; ok {
+			continue
+		}
+		linked[result.Path] = struct{}{}
+
+		manifest.Photos = append(manifest.Photos, models.OrderPhoto{
+			Filename:        result.Filename,
+			Key:             result.Path,
+			Size:            result.ProcessedSize,
+			OriginalSHA256:  result.OriginalSHA256,
+			ProcessedSHA256: result.ProcessedSHA256,
+			Deduplicated:    result.Deduplicated,
+			ExifKey:         result.ExifKey,
+			Renditions:      result.Renditions,
+		})
+	}
+	manifest.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest for order %s: %w", orderID, err)
+	}
+
+	return store.Put(ctx, orderManifestKey(orderID), bytes.NewReader(data), storage.PutOptions{
+		ContentType: "application/json",
+	})
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+
+	"github.com/30Piraten/snapflow/imaging"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
+	"github.com/30Piraten/snapflow/utils"
+	"go.uber.org/zap"
+)
+
+// preparedFile is an uploaded file that has been read, hashed and,
+// unless it duplicates a stored photo, validated, processed and
+// encoded once, ready for storeFile. Nothing has been stored for it.
+type preparedFile struct {
+	file         *multipart.FileHeader
+	photoIndex   int
+	originalHash string
+	fingerprint  string
+
+	// Metadata of the upload, nil when it carries none
+	metadata *imaging.Metadata
+
+	// The stored photo reused for a duplicate upload, else nil
+	duplicate *dedupRecord
+
+	// The processed image, nil for a duplicate
+	processed *ProcessedImage
+
+	// Memory held for the processed image until it is stored,
+	// nil when it was not processed for this upload
+	reservation *imaging.Reservation
+}
+
+// release hands back the memory held for the processed image
+func (f *preparedFile) release() {
+	if f != nil {
+		f.reservation.Release()
+	}
+}
+
+// prepareFile reads the uploaded file at photoIndex of an order and
+// hashes it. When the same original has been stored before with the
+// same options, the stored photo is reused; otherwise the file is
+// decoded once and the decoded image is validated, transformed and
+// encoded. A returned error means the file cannot be printed. The
+// processed image's memory stays reserved until release is called.
+func prepareFile(ctx context.Context, file *multipart.FileHeader, opts models.ProcessingOptions, store storage.Storage, photoIndex int) (*preparedFile, error) {
+	if file == nil {
+		return nil, fmt.Errorf("file is nil")
+	}
+	if err := checkFileSize(file.Size); err != nil {
+		return nil, err
+	}
+
+	// Open the file
+	source, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer source.Close()
+
+	// Hash the original so resubmissions of the same photo are
+	// detected; the processed image cache uses the same hash
+	originalHash, err := hashReader(source)
+	if err != nil {
+		return nil, err
+	}
+
+	prepared := &preparedFile{
+		file:         file,
+		photoIndex:   photoIndex,
+		originalHash: originalHash,
+		fingerprint:  optionsFingerprint(opts),
+	}
+
+	// Reuse the stored rendition when this original has been
+	// processed before with the same options
+	if store != nil {
+		record, err := lookupDuplicate(ctx, store, originalHash, prepared.fingerprint)
+		if err != nil {
+			// A broken index only costs a re-upload, so carry on
+			utils.Logger.Warn("Dedup lookup failed", zap.String("original_sha256", originalHash), zap.Error(err))
+		}
+		if record != nil {
+			// The earlier upload may belong to another order, so
+			// its original EXIF is saved for this one as well
+			metadata, err := imaging.ReadMetadata(source)
+			if err != nil {
+				utils.Logger.Warn("Ignoring unreadable metadata", zap.String("file_name", file.Filename), zap.Error(err))
+			}
+			prepared.duplicate = record
+			prepared.metadata = metadata
+			return prepared, nil
+		}
+	}
+
+	// Decode and process the image straight from the upload
+	processed, reservation, err := SharedImageProcessor().validateAndProcessHashed(ctx, source, file.Size, opts, originalHash)
+	if err != nil {
+		return nil, err
+	}
+	prepared.processed = processed
+	prepared.reservation = reservation
+	prepared.metadata = processed.Metadata
+	return prepared, nil
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/30Piraten/snapflow/models"
+	"go.uber.org/zap"
+)
+
+// benchmarkUpload returns a width x height JPEG with a gradient, so
+// it compresses like a photo rather than a flat image
+func benchmarkUpload(b *testing.B, width, height int) []byte {
+	b.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x ^ y) & 0xFF), 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		b.Fatalf("encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkOptions are the options ProcessUploadedFiles uses, for
+// the given print size
+func benchmarkOptions(printSize string) models.ProcessingOptions {
+	return models.ProcessingOptions{
+		Quality:         models.HighQuality,
+		TargetSizeBytes: models.TargetFileSize,
+		Format:          "jpeg",
+		MaxDimensions: models.Dimensions{
+			Width:  models.MaxImageDimension,
+			Height: models.MaxImageDimension,
+		},
+		MaxPixels: models.MaxImagePixels,
+		PrintSize: printSize,
+		PrintDPI:  300,
+	}
+}
+
+// BenchmarkSinglePass hashes, decodes, validates, processes and
+// encodes an upload once, as prepareFile does for a new photo
+func BenchmarkSinglePass(b *testing.B) {
+	upload := benchmarkUpload(b, 2400, 1600)
+
+	for _, printSize := range []string{"", "4x6"} {
+		name := printSize
+		if name == "" {
+			name = "original"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			processor := NewImageProcessor(zap.NewNop())
+			opts := benchmarkOptions(printSize)
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(upload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src := bytes.NewReader(upload)
+				hash, err := hashReader(src)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := processor.validateAndProcessHashed(ctx, src, int64(len(upload)), opts, hash); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSinglePassCached resubmits an upload already in the
+// processed image cache, which is only hashed
+func BenchmarkSinglePassCached(b *testing.B) {
+	upload := benchmarkUpload(b, 2400, 1600)
+	processor := NewCachedImageProcessor(zap.NewNop(), 64<<20)
+	opts := benchmarkOptions("4x6")
+	ctx := context.Background()
+
+	hash, err := hashReader(bytes.NewReader(upload))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, _, err := processor.validateAndProcessHashed(ctx, bytes.NewReader(upload), int64(len(upload)), opts, hash); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(upload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src := bytes.NewReader(upload)
+		hash, err := hashReader(src)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := processor.validateAndProcessHashed(ctx, src, int64(len(upload)), opts, hash); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,15 +1,25 @@
 package services
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
-	"path/filepath"
-	"strings"
-	"time"
 
+	cfg "github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/imaging"
 	"github.com/30Piraten/snapflow/models"
 	"github.com/30Piraten/snapflow/utils"
 	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Errors returned by ProcessUploadedFiles, for the route to map to
+// a status. Errors that wrap none of these are photos that failed
+// validation or processing.
+var (
+	ErrInvalidOrder    = errors.New("invalid order")
+	ErrMisconfigured   = errors.New("invalid processing configuration")
+	ErrOrderIncomplete = errors.New("order could not be completed")
+	ErrStorage         = errors.New("photos could not be stored")
 )
 
 type NewProcessError struct {
@@ -22,25 +32,26 @@ func (e *NewProcessError) Error() string {
 	return fmt.Sprintf("%s: %s - %s", e.Type, e.Code, e.Message)
 }
 
-// ProcessUploadedFiles parses the uploaded files and processes
-// them accordingly. If there is a single or there are multiple
-// files, a JSON response is returned.
-func ProcessUploadedFiles(c *fiber.Ctx) error {
-
-	// Parse the uploaded files
-	form, err := c.MultipartForm()
-	if err != nil {
-		return utils.HandleError(c, fiber.StatusBadGateway, "Failed to parse multipart form", err)
+// ProcessUploadedFiles processes the photos of an order, parsed once
+// from the request by ParseOrderDetails. The processed photos are
+// linked to the order identified by orderID and returned, with their
+// print quality. When the process has no memory left to decode them
+// in time, the error wraps imaging.ErrOverloaded; a bad order wraps
+// ErrInvalidOrder, a bad configuration ErrMisconfigured, a failure to
+// store the processed photos ErrStorage, and a failure to record them
+// ErrOrderIncomplete.
+func ProcessUploadedFiles(c *fiber.Ctx, order *models.PhotoOrder, orderID string) ([]models.FileProcessingResult, error) {
+	if order == nil || len(order.Photos) == 0 {
+		return nil, fmt.Errorf("%w: no files uploaded", ErrInvalidOrder)
 	}
 
-	files := form.File["photos"]
-	if len(files) == 0 {
-		return utils.HandleError(c, fiber.StatusBadRequest, "No files uploaded", nil)
-	}
+	// The workers share a copy of the order, which none of them change
+	photoOrder := *order
+	files := photoOrder.Photos
 
 	// Validate total file count
 	if len(files) > models.MaxFileCount {
-		return utils.HandleError(c, fiber.StatusBadRequest, fmt.Sprintf("Too many files uploaded. Maximum allowed is %d", models.MaxFileCount), nil)
+		return nil, fmt.Errorf("%w: too many files uploaded, maximum allowed is %d", ErrInvalidOrder, models.MaxFileCount)
 	}
 
 	// Process single or multiple files
@@ -49,42 +60,154 @@ func ProcessUploadedFiles(c *fiber.Ctx) error {
 		TargetSizeBytes: models.TargetFileSize,
 		Format:          "jpeg",
 		MaxDimensions: models.Dimensions{
-			Width:  6000,
-			Height: 6000,
+			Width:  models.MaxImageDimension,
+			Height: models.MaxImageDimension,
 		},
+		MaxPixels:        models.MaxImagePixels,
+		PrintSize:        photoOrder.Size,
+		PrintOrientation: c.FormValue("orientation"),
+		FitMode:          c.FormValue("fitMode"),
+	}
+
+	// Render the photos at the printer's resolution
+	var err error
+	if opts.PrintDPI, err = cfg.PrintDPI(); err != nil {
+		return nil, fmt.Errorf("%w: print DPI: %w", ErrMisconfigured, err)
+	}
+
+	// Resize the photos with the configured kernel
+	if opts.Kernel, err = cfg.ResamplingKernel(); err != nil {
+		return nil, fmt.Errorf("%w: resampling kernel: %w", ErrMisconfigured, err)
+	}
+
+	// Flatten transparency and letterbox onto the paper color
+	if opts.Background, err = cfg.PrintBackground(); err != nil {
+		return nil, fmt.Errorf("%w: print background: %w", ErrMisconfigured, err)
+	}
+
+	// Keep only the metadata the policy allows
+	policy, err := cfg.MetadataPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata policy: %w", ErrMisconfigured, err)
+	}
+	opts.PreserveMetadata = policy.Enabled()
+	opts.KeepCaptureDate = policy.CaptureDate
+	opts.KeepCopyright = policy.Copyright
+	opts.KeepICCProfile = policy.ICCProfile
+
+	// Sharpen the photos once they are resized
+	sharpen, mask, err := cfg.Sharpening()
+	if err != nil {
+		return nil, fmt.Errorf("%w: sharpening: %w", ErrMisconfigured, err)
+	}
+	opts.Sharpen = sharpen
+	opts.SharpenRadius = mask.Radius
+	opts.SharpenAmount = mask.Amount
+	opts.SharpenThreshold = mask.Threshold
+
+	// Convert the print masters for the store's printer and paper
+	profiles, err := cfg.OutputProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("%w: print profiles: %w", ErrMisconfigured, err)
+	}
+	opts.OutputProfile = profiles.For(photoOrder.Location, photoOrder.PaperType)
+
+	// Correct the color of the photos as the editors used to
+	if opts.AutoColor, err = cfg.AutoColor(); err != nil {
+		return nil, fmt.Errorf("%w: color correction: %w", ErrMisconfigured, err)
+	}
+
+	// Flag or reject photos too small for their print, as the store's policy says
+	qualityPolicy, err := cfg.PrintQualityPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("%w: print quality policy: %w", ErrMisconfigured, err)
 	}
+	opts.RejectPoorPrints = qualityPolicy.RejectsPoor(photoOrder.Location)
+
+	// Process the photos with the recipe named on the form, or
+	// else the one for the ordered product, when there is one
+	recipes, err := cfg.Recipes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: processing recipes: %w", ErrMisconfigured, err)
+	}
+	if name := c.FormValue("recipe"); name != "" {
+		recipe, ok := imaging.LookupRecipe(recipes, name)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown processing recipe %q", ErrInvalidOrder, name)
+		}
+		opts.Recipe = recipe
+	} else if recipe, ok := imaging.RecipeFor(recipes, photoOrder.Size, photoOrder.PaperType); ok {
+		opts.Recipe = recipe
+	}
+
+	// Resolve the storage backend once for all files
+	store := cfg.ObjectStore()
+
+	// Validation and processing share the processor's cache
+	defer logCacheStats()
 
-	// Handle single file
+	// Handle single file. Fiber does not cancel the request's
+	// context when the client goes away, so work is only cut short
+	// by the per-item timeout of ProcessMultipleFiles.
+	ctx := c.UserContext()
 	if len(files) == 1 {
-		if err := handleSingleFile(c, files[0], opts); err != nil {
-			return fmt.Errorf("failed to process file %s: %w", files[0].Filename, err)
+		result, err := handleSingleFile(ctx, files[0], opts, photoOrder, store, orderID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process file %s: %w", files[0].Filename, err)
 		}
-		return nil
+		return result, nil
 	}
 
 	// Validate and handle multiple files
-	_, errors := ProcessMultipleFiles(c, files, opts)
-	if len(errors) > 0 {
-		// Collect all errors into one
-		var errMsg []string
-		for _, e := range errors {
-			errMsg = append(errMsg, e.Error())
-		}
-		return utils.HandleError(c, fiber.StatusInternalServerError, "Some files failed to process", errors[0])
+	results, fileErrors := ProcessMultipleFiles(ctx, files, opts, photoOrder, store, orderID)
+	if len(fileErrors) > 0 {
+		// Collect all errors into one, keeping each for errors.Is
+		return nil, fmt.Errorf("some files failed to process: %w", errors.Join(fileErrors...))
+	}
+
+	// Link the photos, including reused duplicates, to the order
+	if err := LinkPhotosToOrder(ctx, store, orderID, photoOrder.FullName, photoOrder.Email, results); err != nil {
+		return nil, fmt.Errorf("%w: failed to link photos to order: %w", ErrOrderIncomplete, err)
+	}
+
+	// The order goes to print once all of its photos are verified
+	if err := completeOrder(ctx, photoOrder, orderID, results); err != nil {
+		return nil, fmt.Errorf("%w: failed to complete order: %w", ErrOrderIncomplete, err)
 	}
 
-	return nil
+	return results, nil
 }
 
-// generateUniqueFileName generates a unique filename
-func generateUniqueFileName(originalName string) string {
-	extension := filepath.Ext(originalName)
-	basename := strings.TrimSuffix(originalName, extension)
+// logCacheStats logs the processed-image cache statistics
+func logCacheStats() {
+	stats := SharedImageProcessor().CacheStats()
+	utils.Logger.Info("Processed image cache",
+		zap.Int64("hits", stats.Hits),
+		zap.Int64("misses", stats.Misses),
+		zap.Int64("evictions", stats.Evictions),
+		zap.Int("entries", stats.Entries),
+		zap.Int64("bytes", stats.Bytes),
+	)
+}
 
-	// Sanitize the basename
-	basename = utils.Sanitize(basename)
+// PrintQualityReport lists the print quality of each processed photo,
+// warning about the ones that are too small for their print size
+func PrintQualityReport(results []models.FileProcessingResult) []models.PhotoPrintQuality {
+	var report []models.PhotoPrintQuality
+	for _, result := range results {
+		if result.PrintQuality == "" {
+			continue
+		}
 
-	randomNumber := rand.Intn(1000)
-	timestamp := time.Now().UnixNano()
-	return fmt.Sprintf("%s_%d_%d%s", basename, timestamp, randomNumber, extension)
+		quality := models.PhotoPrintQuality{
+			Filename:     result.Filename,
+			EffectiveDPI: result.EffectiveDPI,
+			Quality:      result.PrintQuality,
+		}
+		if result.PrintQuality == string(imaging.PrintQualityPoor) {
+			quality.Warning = fmt.Sprintf("%s is only %d DPI at this print size and may print blurry", result.Filename, result.EffectiveDPI)
+		}
+		report = append(report, quality)
+	}
+	return report
 }
@@ -1,113 +1,104 @@
 package services
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"mime/multipart"
 	"sync"
 
 	"github.com/30Piraten/snapflow/models"
-	"github.com/30Piraten/snapflow/utils"
-	"github.com/gofiber/fiber/v2"
+	"github.com/30Piraten/snapflow/storage"
 )
 
-// ProcessMultipleFiles processes multiple uploaded files
-// concurrently using the given processing options.
-func ProcessMultipleFiles(c *fiber.Ctx, files []*multipart.FileHeader, opts models.ProcessingOptions) ([]models.FileProcessingResult, []error) {
-
-	// Define required variables
-	var (
-		results   []models.FileProcessingResult
-		errors    []error
-		wg        sync.WaitGroup
-		semaphore = make(chan struct{}, models.MaxConcurrentProcessing)
-	)
-
-	resultsChan := make(chan models.FileProcessingResult, len(files))
-	errorsChan := make(chan error, len(files))
+// ProcessMultipleFiles processes multiple uploaded files of order
+// concurrently using the given processing options and writes them to
+// store under the order identified by orderID. Each file is read and
+// decoded once, and nothing is stored unless every file is valid.
+// Results are in the order of files; the errors name each file that
+// failed. The memory of each processed file stays reserved until it
+// is stored, so a batch waiting to be stored counts against the budget.
+func ProcessMultipleFiles(ctx context.Context, files []*multipart.FileHeader, opts models.ProcessingOptions, order models.PhotoOrder, store storage.Storage, orderID string) ([]models.FileProcessingResult, []error) {
+
+	// Files are worked on a few at a time, and each one
+	// fails once it runs past the per-item timeout
+	pool := PoolOptions{
+		Workers:     models.MaxConcurrentProcessing,
+		ItemTimeout: models.MaxProcessingTime,
+	}
 
-	// Validate all files upfront
+	// Probe every header first, so an oversized image anywhere in
+	// the batch is refused before any of the others is decoded
+	processor := SharedImageProcessor()
 	for _, file := range files {
-		source, err := file.Open()
-		if err != nil {
-			errorsChan <- fmt.Errorf("failed to open file %s: %v", file.Filename, err)
-			continue
+		if err := probeUpload(processor, file, opts); err != nil {
+			return nil, []error{fmt.Errorf("file %s failed validation: %w", file.Filename, err)}
 		}
-		defer source.Close() // Close the file after reading
+	}
 
-		// fileData, err := io.ReadAll(source)
-		fileData, _, err := image.Decode(source)
-		if err != nil {
-			errorsChan <- fmt.Errorf("file %s failed decoding: %v", file.Filename, err)
-			continue
+	// Every processed file is released once the batch is done, and
+	// one the pool abandoned after it timed out as soon as it is ready
+	var (
+		heldMu   sync.Mutex
+		held     []*preparedFile
+		finished bool
+	)
+	defer func() {
+		heldMu.Lock()
+		defer heldMu.Unlock()
+		finished = true
+		for _, file := range held {
+			file.release()
 		}
+	}()
 
-		// Convert back to []byte
-		var buf bytes.Buffer
-		if err := jpeg.Encode(&buf, fileData, nil); err != nil {
-			errorsChan <- fmt.Errorf("file %s failed encoding; %v", file.Filename, err)
-			continue
+	// Validate, process and encode all files upfront
+	prepared := RunPool(ctx, files, pool, func(ctx context.Context, index int, file *multipart.FileHeader) (*preparedFile, error) {
+		result, err := prepareFile(ctx, file, opts, store, index)
+		if result == nil {
+			return nil, err
 		}
 
-		processor := NewImageProcessor(utils.Logger)
-		if _, err := processor.ValidateAndProcessImage(buf.Bytes(), opts); err != nil {
-			errorsChan <- fmt.Errorf("file %s failed validation: %v", file.Filename, err)
+		heldMu.Lock()
+		defer heldMu.Unlock()
+		if finished || ctx.Err() != nil {
+			result.release()
+			return nil, fmt.Errorf("file %s was abandoned before it was stored", file.Filename)
 		}
-	}
-
-	// // Short-circuit if the validation fails
-	close(errorsChan)
+		held = append(held, result)
+		return result, err
+	})
 
+	// Short-circuit if the validation fails
 	var validationErrors []error
-	for err := range errorsChan {
-		validationErrors = append(validationErrors, err)
+	for _, result := range prepared {
+		if result.Err != nil {
+			validationErrors = append(validationErrors, fmt.Errorf("file %s failed validation: %w", files[result.Index].Filename, result.Err))
+		}
 	}
 	if len(validationErrors) > 0 {
 		return nil, validationErrors
 	}
 
-	// Concurrent processing of validated files
-	for _, file := range files {
-		wg.Add(1)
-
-		go func(file *multipart.FileHeader) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			// Create a separate PhotoOrder for each files
-			order, err := ParseOrderDetails(c)
-			if err != nil {
-				errorsChan <- fmt.Errorf("failed to parse form fields for file %s: %v", file.Filename, err)
-				return
-			}
-
-			// Pass the order to ProcessFile
-			result := ProcessFile(c, file, opts, order)
-			if result.Error != nil {
-				errorsChan <- fmt.Errorf("file: %s processing failed %v", file.Filename, result.Error)
-			} else {
-				resultsChan <- result
-			}
-		}(file)
-	}
-
-	// Close channels only after all goroutines finish
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-		// close(errorsChan)
-	}()
+	// Store the processed files
+	stored := RunPool(ctx, prepared, pool, func(ctx context.Context, _ int, result PoolResult[*preparedFile]) (models.FileProcessingResult, error) {
+		stored := storeFile(ctx, result.Value, order, store, orderID)
+		result.Value.release()
+		if stored.Error != nil {
+			return stored, storeError(stored.Error)
+		}
+		return stored, nil
+	})
 
-	// Collect results and errors
-	for result := range resultsChan {
-		results = append(results, result)
-	}
-	// var processErrors []error
-	for err := range errorsChan {
-		errors = append(errors, err)
+	var (
+		results []models.FileProcessingResult
+		errors  []error
+	)
+	for _, result := range stored {
+		if result.Err != nil {
+			errors = append(errors, fmt.Errorf("file %s processing failed: %w", files[result.Index].Filename, result.Err))
+			continue
+		}
+		results = append(results, result.Value)
 	}
 
 	return results, errors
@@ -3,163 +3,229 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"image/jpeg"
-	"io"
-	"mime/multipart"
-	"os"
-	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	cfg "github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/imaging"
 	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
 	"github.com/30Piraten/snapflow/utils"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 )
 
-// ProcessFile validates and processes a file
-func ProcessFile(c *fiber.Ctx, file *multipart.FileHeader, opts models.ProcessingOptions, order *models.PhotoOrder) models.FileProcessingResult {
+// storeError returns the error of a file storeFile failed to store,
+// wrapping ErrMisconfigured for a configuration error and ErrStorage
+// for any other
+func storeError(err *models.ProcessingError) error {
+	if err.Type == "ConfigError" {
+		return fmt.Errorf("%w: %w", ErrMisconfigured, &NewProcessError{err})
+	}
+	return fmt.Errorf("%w: %w", ErrStorage, &NewProcessError{err})
+}
+
+// storeFile writes a prepared file to the given storage backend,
+// or links the stored photo it duplicates. The object key comes
+// from the configured key template and the order; the file's photo
+// index is its position within the order identified by orderID.
+func storeFile(ctx context.Context, prepared *preparedFile, order models.PhotoOrder, store storage.Storage, orderID string) models.FileProcessingResult {
 
-	region, bucketName := os.Getenv("AWS_REGION"), os.Getenv("BUCKET_NAME")
-	if region == "" || bucketName == "" {
-		utils.Logger.Error("Missing required environment variables")
+	if store == nil {
+		utils.Logger.Error("No storage backend configured")
 		return models.FileProcessingResult{
 			Error: &models.ProcessingError{
 				Type:    "ConfigError",
 				Code:    models.ErrCodeInvalidConfig,
-				Message: "Env config is empty or nil",
+				Message: "storage backend is nil",
 			},
 		}
 	}
 
-	if file == nil {
-		return models.FileProcessingResult{
-			Error: &models.ProcessingError{
-				Type:    "FileError",
-				Code:    models.ErrCodeFileOpen,
-				Message: "file is nil",
-			},
+	file, photoIndex, originalHash := prepared.file, prepared.photoIndex, prepared.originalHash
+
+	if record := prepared.duplicate; record != nil {
+		utils.Logger.Info("Reusing stored photo for duplicate upload",
+			zap.String("object_key", record.Key),
+			zap.String("file_name", file.Filename),
+			zap.String("original_sha256", originalHash),
+		)
+
+		result := models.FileProcessingResult{
+			Path:            record.Key,
+			Filename:        file.Filename,
+			Size:            file.Size,
+			OriginalSize:    file.Size,
+			ProcessedSize:   record.Size,
+			OriginalSHA256:  originalHash,
+			ProcessedSHA256: record.ProcessedSHA256,
+			Deduplicated:    true,
+			PhotoIndex:      photoIndex,
+			ExifKey:         recordOriginalExif(ctx, store, orderID, photoIndex, file.Filename, originalHash, prepared.metadata),
+			Renditions:      record.Renditions,
+			ColorCorrection: record.ColorCorrection,
+			Flattening:      record.Flattening,
 		}
+		setPrintQuality(&result, record.Preflight)
+		return result
 	}
 
-	// Parse the order details
-	parsedOrder, err := ParseOrderDetails(c)
+	processed := prepared.processed
+
+	// Hash the encoded image, so the rendition's {hash}
+	// is known before its key is rendered
+	sum := sha256.Sum256(processed.JPEG)
+	processedHash, processedSize := hex.EncodeToString(sum[:]), int64(len(processed.JPEG))
+
+	objectKey, err := cfg.ObjectKeyTemplate().Render(storage.KeyFields{
+		Store:      order.Location,
+		Time:       time.Now(),
+		OrderID:    orderID,
+		PhotoIndex: photoIndex,
+		Hash:       processedHash,
+		Ext:        "jpg",
+		Customer:   order.FullName,
+		Filename:   strings.TrimSuffix(filepath.Base(file.Filename), filepath.Ext(file.Filename)),
+	})
 	if err != nil {
 		return models.FileProcessingResult{
 			Error: &models.ProcessingError{
-				Type:    "Validation",
-				Code:    models.ErrCodeProcessingFailed,
-				Message: fmt.Sprintf("failed to parse form fields: %v", err),
+				Type:    "ConfigError",
+				Code:    models.ErrCodeInvalidConfig,
+				Message: fmt.Sprintf("failed to build object key: %v", err),
 			},
 		}
 	}
 
-	// order is passed as a pointer, but parsedOrder assigns
-	// a new parsed object instead of modifying the existing reference
-	// this might not update the original object outside the function
-	// hence the pointer reference here!
-	*order = *parsedOrder
-
-	// Open the file
-	source, err := file.Open()
-	if err != nil {
-		return models.FileProcessingResult{
-			Error: &models.ProcessingError{
-				Type:    "FileError",
-				Code:    models.ErrCodeFileOpen,
-				Message: fmt.Sprintf("failed to open file: %v", err),
+	// With a content-addressed template, a different original
+	// can still produce a rendition that is already stored
+	deduplicated := false
+	if _, err := store.Head(ctx, objectKey); err == nil {
+		deduplicated = true
+	} else {
+		// Upload the encoded image to the storage backend
+		err = store.Put(ctx, objectKey, bytes.NewReader(processed.JPEG), storage.PutOptions{
+			ContentType: "image/jpeg",
+			Metadata: map[string]string{
+				"original_sha256": originalHash,
 			},
+		})
+		if err != nil {
+			return models.FileProcessingResult{
+				Error: &models.ProcessingError{
+					Type:    "StorageError",
+					Code:    models.ErrCodeStorageFailed,
+					Message: fmt.Sprintf("failed to store image: %v", err),
+				},
+			}
 		}
 	}
-	defer source.Close()
 
-	// Stream file data into a buffer
-	bufImg := new(bytes.Buffer)
-	_, err = io.Copy(bufImg, source)
+	// Store the preview and thumbnail next to the print master.
+	// They are small, so a rendition stored by an earlier upload
+	// is simply written again in case it was never completed.
+	bounds := processed.Image.Bounds()
+	renditions, err := storeRenditions(ctx, store, models.Rendition{
+		Name:   RenditionPrint,
+		Key:    objectKey,
+		Size:   processedSize,
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}, processed.Renditions, originalHash)
 	if err != nil {
 		return models.FileProcessingResult{
 			Error: &models.ProcessingError{
-				Type:    "FileError",
-				Code:    models.ErrCodeFileRead,
-				Message: fmt.Sprintf("failed to read file: %v", err),
+				Type:    "StorageError",
+				Code:    models.ErrCodeStorageFailed,
+				Message: fmt.Sprintf("failed to store renditions: %v", err),
 			},
 		}
 	}
 
-	imgData := bufImg.Bytes()
-
-	// Process the image without reading it to memory unnecessarily
-	processor := NewImageProcessor(utils.Logger)
-	processedImage, err := processor.ValidateAndProcessImage(imgData, opts)
+	err = saveDedupRecord(ctx, store, dedupRecord{
+		OriginalSHA256:  originalHash,
+		ProcessedSHA256: processedHash,
+		Key:             objectKey,
+		Size:            processedSize,
+		CreatedAt:       time.Now(),
+		Renditions:      renditions,
+		Preflight:       processed.Preflight,
+		ColorCorrection: processed.ColorCorrection,
+		Flattening:      processed.Flattening,
+	}, prepared.fingerprint)
 	if err != nil {
-		return models.FileProcessingResult{
-			Error: &models.ProcessingError{
-				Type:    "Validation",
-				Code:    models.ErrCodeProcessingFailed,
-				Message: fmt.Sprintf("validation or processing failed: %v", err),
-			},
-		}
+		utils.Logger.Warn("Failed to record dedup index", zap.String("object_key", objectKey), zap.Error(err))
 	}
 
-	// Initialise S3 Client
-	s3Config, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		utils.Logger.Error("Failed to load AWS config", zap.Error(err))
-		return models.FileProcessingResult{
-			Error: &models.ProcessingError{
-				Type:    "S3ConfigurationError",
-				Code:    models.ErrCodeProcessingFailed,
-				Message: fmt.Sprintf("failed to load or process AWS config: %v", err),
-			},
-		}
-	}
-	s3Client := s3.NewFromConfig(s3Config)
+	rotation, mirrored := processed.Orientation.Rotation()
 
-	// Construct the the S3 key with the user's folder and date
-	userFolder := utils.Sanitize(order.FullName)
-	uploadDate := time.Now().Format("Jan_02")
-	uniqueFileName := generateUniqueFileName(file.Filename)
-	s3key := path.Join("uploads", userFolder, uploadDate, uniqueFileName)
+	utils.Logger.Info("Successfully processed and uplaoded image",
+		zap.String("object_key", objectKey),
+		zap.String("file_name", file.Filename),
+		zap.Int64("file_size", file.Size),
+		zap.Bool("deduplicated", deduplicated),
+	)
 
-	// Convert processedImage to []byte
-	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, processedImage, nil); err != nil {
-		return models.FileProcessingResult{
-			Error: &models.ProcessingError{
-				Type:    "ImageEncodingError",
-				Code:    models.ErrCodeProcessingFailed,
-				Message: fmt.Sprintf("failed to encode image: %v", err),
-			},
-		}
+	result := models.FileProcessingResult{
+		Path:            objectKey,
+		Filename:        file.Filename,
+		Size:            file.Size,
+		OriginalSize:    file.Size,
+		ProcessedSize:   processedSize,
+		OriginalSHA256:  originalHash,
+		ProcessedSHA256: processedHash,
+		Deduplicated:    deduplicated,
+		PhotoIndex:      photoIndex,
+		Quality:         processed.Quality,
+		Encodes:         processed.Encodes,
+		ExifOrientation: int(processed.Orientation),
+		ExifKey:         recordOriginalExif(ctx, store, orderID, photoIndex, file.Filename, originalHash, prepared.metadata),
+		Rotation:        rotation,
+		Mirrored:        mirrored,
+		Renditions:      renditions,
+		ColorCorrection: processed.ColorCorrection,
+		Flattening:      processed.Flattening,
 	}
+	setPrintQuality(&result, processed.Preflight)
+	return result
+}
 
-	imageBytes := buf.Bytes()
+// setPrintQuality records the expected print quality in result
+func setPrintQuality(result *models.FileProcessingResult, preflight *imaging.Preflight) {
+	if preflight == nil {
+		return
+	}
+	result.EffectiveDPI = preflight.EffectiveDPI
+	result.PrintQuality = string(preflight.Quality)
+}
 
-	// Upload processed image to S3
-	err = cfg.UploadToS3(s3Client, bucketName, s3key, imageBytes, region)
-	if err != nil {
-		return models.FileProcessingResult{
-			Error: &models.ProcessingError{
-				Type:    "S3Error",
-				Code:    models.ErrCodeFileSave,
-				Message: fmt.Sprintf("failed to upload image to S3: %v", err),
-			},
-		}
+// metadataPolicy returns the metadata policy set in opts
+func metadataPolicy(opts models.ProcessingOptions) imaging.MetadataPolicy {
+	if !opts.PreserveMetadata {
+		return imaging.MetadataPolicy{}
 	}
+	return imaging.MetadataPolicy{
+		CaptureDate: opts.KeepCaptureDate,
+		Copyright:   opts.KeepCopyright,
+		ICCProfile:  opts.KeepICCProfile,
+	}
+}
 
-	utils.Logger.Info("Successfully processed and uplaoded image",
-		zap.String("folder_name", userFolder),
-		zap.String("s3_key", s3key),
-		zap.String("file_name", file.Filename),
-		zap.Int64("file_size", file.Size),
-	)
+// recordOriginalExif saves the original EXIF of a photo with its
+// order and returns the key, or "" when there is none. The EXIF is
+// only informative, so a failure to save it is logged, not returned.
+func recordOriginalExif(ctx context.Context, store storage.Storage, orderID string, photoIndex int, filename, originalHash string, metadata *imaging.Metadata) string {
+	if metadata == nil || metadata.Exif == nil || orderID == "" {
+		return ""
+	}
 
-	return models.FileProcessingResult{
-		Path:     s3key,
-		Filename: file.Filename,
-		Size:     file.Size,
+	key, err := saveOriginalExif(ctx, store, orderID, photoIndex, filename, originalHash, metadata)
+	if err != nil {
+		utils.Logger.Warn("Failed to save original EXIF", zap.String("file_name", filename), zap.Error(err))
+		return ""
 	}
+	return key
 }
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"container/list"
+	"image"
+	"sync"
+
+	"github.com/30Piraten/snapflow/imaging"
+)
+
+// CacheStats reports the use of the processed-image cache
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// processedCache is an LRU cache of processed images, keyed by the
+// SHA-256 of the upload and the fingerprint of the options used. It
+// evicts the least recently used images once their estimated memory
+// exceeds maxBytes. Cached images are shared, so must not be changed.
+type processedCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List // -> front is the most recently used
+	entries  map[string]*list.Element
+	stats    CacheStats
+}
+
+// cacheEntry is a processed image and its estimated memory
+type cacheEntry struct {
+	key       string
+	processed *ProcessedImage
+	size      int64
+}
+
+// newProcessedCache returns a cache holding up to maxBytes
+func newProcessedCache(maxBytes int64) *processedCache {
+	return &processedCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// cacheKey returns the key of an upload processed with the options
+// identified by fingerprint, see optionsFingerprint
+func cacheKey(contentHash, fingerprint string) string {
+	return contentHash + "/" + fingerprint
+}
+
+// Get returns the processed image stored under key
+func (c *processedCache) Get(key string) (*ProcessedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).processed, true
+}
+
+// Add stores a processed image under key, evicting the least recently
+// used images to make room. Images larger than the cache are not kept.
+func (c *processedCache) Add(key string, processed *ProcessedImage) {
+	size := processedSize(processed)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, processed: processed, size: size})
+	c.bytes += size
+}
+
+// remove drops an element from the cache
+func (c *processedCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// Stats returns the cache's counters and current size
+func (c *processedCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+// processedSize estimates the memory held by a processed image:
+// its pixels, its encoded JPEG and its metadata
+func processedSize(processed *ProcessedImage) int64 {
+	size := int64(len(processed.JPEG)) + imageSize(processed.Image)
+	for _, rendition := range processed.Renditions {
+		size += int64(len(rendition.JPEG))
+	}
+	if metadata := processed.Metadata; metadata != nil {
+		size += int64(len(metadata.ICCProfile))
+		if x := metadata.Exif; x != nil {
+			for _, entries := range [][]imaging.ExifEntry{x.IFD0, x.ExifIFD, x.GPSIFD} {
+				for _, entry := range entries {
+					size += int64(len(entry.Value))
+				}
+			}
+		}
+	}
+	return size
+}
+
+// imageSize estimates the memory held by the pixels of img
+func imageSize(img image.Image) int64 {
+	switch img := img.(type) {
+	case nil:
+		return 0
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	}
+
+	// Other formats are assumed to hold 4 bytes per pixel
+	bounds := img.Bounds()
+	return int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path"
+	"strings"
+
+	"github.com/30Piraten/snapflow/imaging"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
+)
+
+// Rendition names. The print master is the photo at the rendered
+// object key; the others are stored next to it.
+const (
+	RenditionPrint     = "print"
+	RenditionPreview   = "preview"
+	RenditionThumbnail = "thumbnail"
+)
+
+// renditionSpec describes a rendition made from the print master
+type renditionSpec struct {
+	Name    string
+	MaxSide int // -> longest side in pixels
+	Quality int
+}
+
+// renditionSpecs are the renditions made for every photo, besides
+// the print master, so editors and customers can see a photo
+// without downloading the full-resolution file
+var renditionSpecs = []renditionSpec{
+	{Name: RenditionPreview, MaxSide: 1600, Quality: models.MediumQuality},
+	{Name: RenditionThumbnail, MaxSide: 256, Quality: models.MediumQuality},
+}
+
+// EncodedRendition is a rendition encoded as a JPEG
+type EncodedRendition struct {
+	Name   string
+	JPEG   []byte
+	Width  int
+	Height int
+}
+
+// makeRenditions encodes the renditions of a processed photo from
+// its pixels, so they cost no extra decode. They carry no metadata.
+func (p *ImageProcessor) makeRenditions(img image.Image, opts models.ProcessingOptions) ([]EncodedRendition, error) {
+	renditions := make([]EncodedRendition, 0, len(renditionSpecs))
+	for _, spec := range renditionSpecs {
+		scaled := imaging.FitWithin(img, spec.MaxSide, opts.Kernel)
+		if opts.Sharpen && scaled != img {
+			var err error
+			if scaled, err = imaging.Sharpen(scaled, sharpening(opts, nil)); err != nil {
+				return nil, fmt.Errorf("failed to sharpen %s: %w", spec.Name, err)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: spec.Quality}); err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", spec.Name, err)
+		}
+
+		// The smaller renditions are built from the previous
+		// one, which is faster and just as sharp
+		img = scaled
+		bounds := scaled.Bounds()
+		renditions = append(renditions, EncodedRendition{
+			Name:   spec.Name,
+			JPEG:   buf.Bytes(),
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+		})
+	}
+	return renditions, nil
+}
+
+// renditionKey returns the key of a rendition of the print master
+// stored at masterKey: "a/b/photo.jpg" has its preview at
+// "a/b/photo.preview.jpg"
+func renditionKey(masterKey, name string) string {
+	if name == RenditionPrint {
+		return masterKey
+	}
+	ext := path.Ext(masterKey)
+	return strings.TrimSuffix(masterKey, ext) + "." + name + ext
+}
+
+// storeRenditions writes the renditions next to the print master
+// and returns them, the print master first, as recorded for the order
+func storeRenditions(ctx context.Context, store storage.Storage, master models.Rendition, renditions []EncodedRendition, originalHash string) ([]models.Rendition, error) {
+	stored := []models.Rendition{master}
+	for _, rendition := range renditions {
+		key := renditionKey(master.Key, rendition.Name)
+		err := store.Put(ctx, key, bytes.NewReader(rendition.JPEG), storage.PutOptions{
+			ContentType: "image/jpeg",
+			Metadata: map[string]string{
+				"original_sha256": originalHash,
+				"rendition":       rendition.Name,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to store %s: %w", rendition.Name, err)
+		}
+
+		stored = append(stored, models.Rendition{
+			Name:   rendition.Name,
+			Key:    key,
+			Size:   int64(len(rendition.JPEG)),
+			Width:  rendition.Width,
+			Height: rendition.Height,
+		})
+	}
+	return stored, nil
+}
+
+// FindRendition returns the named rendition of an order photo. Photos
+// linked before renditions were made only have their print master.
+func FindRendition(photo models.OrderPhoto, name string) (models.Rendition, bool) {
+	for _, rendition := range photo.Renditions {
+		if rendition.Name == name {
+			return rendition, true
+		}
+	}
+	if name == RenditionPrint {
+		return models.Rendition{Name: RenditionPrint, Key: photo.Key, Size: photo.Size}, true
+	}
+	return models.Rendition{}, false
+}
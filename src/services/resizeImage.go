@@ -2,121 +2,97 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
-	"math"
 	"os"
-	"sync"
 
+	"github.com/30Piraten/snapflow/imaging"
 	"github.com/30Piraten/snapflow/models"
-	"github.com/nfnt/resize"
 	"go.uber.org/zap"
 )
 
 // ProcessImageWithSizeTarget takes an original image and processes
-// it to meet the target size specified in the ProcessingOptions.
+// it to meet the target size specified in the ProcessingOptions. It
+// returns the image as decoded from the JPEG that met the target.
 func (p *ImageProcessor) ProcessImageWithSizeTarget(originalImage image.Image, opts models.ProcessingOptions) (image.Image, error) {
-
-	var buf bytes.Buffer
-	quality := opts.Quality
-
-	// First, encode at lower quality if file size is large
-	if err := jpeg.Encode(&buf, originalImage, &jpeg.Options{Quality: quality}); err != nil {
-		p.Logger.Error("Failed to encode image", zap.Error(err))
-		return nil, fmt.Errorf("encoding failed: %w", err)
+	sized, err := p.EncodeWithSizeTarget(originalImage, opts, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get current size
-	currentSize := int64(buf.Len())
-
-	// Check if the current size already meets the target
-	if currentSize <= opts.TargetSizeBytes {
-		img, _, err := image.Decode(&buf)
-		if err != nil {
-			p.Logger.Error("Failed to decode image after compression", zap.Error(err))
-			return nil, fmt.Errorf("failed to decode after compression: %w", err)
-		}
-		p.Logger.Info("Image already meets target size",
-			zap.Int64("current_size", currentSize),
-			zap.Int("quality", opts.Quality),
-		)
-		return img, nil
+	img, _, err := image.Decode(bytes.NewReader(sized.Data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode final image: %w", err)
 	}
+	return img, nil
+}
 
-	// Reduce the quality first before resizing
-	for quality > models.LowQuality && currentSize > opts.TargetSizeBytes {
-		buf.Reset()
-		quality -= models.QualityStep
-		if err := jpeg.Encode(&buf, originalImage, &jpeg.Options{Quality: quality}); err != nil {
-			return nil, fmt.Errorf("failed during quality reduction: %w", err)
-		}
-		currentSize = int64(buf.Len())
-		p.Logger.Info("Reduced quality",
-			zap.Int("quality", quality),
-			zap.Int64("current_size", currentSize),
-		)
+// EncodeWithSizeTarget encodes img as a JPEG of at most
+// opts.TargetSizeBytes, with metadata written into it. The quality
+// is searched down from opts.Quality to models.LowQuality, then the
+// image is scaled down, unless opts.OptimiseSizeOnly fixes its
+// dimensions; the quality may then go down to models.MinQuality.
+func (p *ImageProcessor) EncodeWithSizeTarget(img image.Image, opts models.ProcessingOptions, metadata *imaging.Metadata) (*imaging.SizedJPEG, error) {
+	target := imaging.SizeTarget{
+		Bytes:      opts.TargetSizeBytes,
+		MaxQuality: opts.Quality,
+		MinQuality: models.LowQuality,
+		Metadata:   metadata,
 	}
-
-	// Preserve original image before resizing
-	resizedImage := originalImage
-
-	// If the file is still too large, resize
-	if currentSize > opts.TargetSizeBytes {
-		reductionRatio := math.Sqrt(float64(opts.TargetSizeBytes) / float64(currentSize))
-
-		bounds := originalImage.Bounds()
-		originalWidth := bounds.Dx()
-		originalHeight := bounds.Dy()
-
-		newWidth := int(float64(originalWidth) * reductionRatio)
-		newHeight := int(float64(originalHeight) * reductionRatio)
-
-		// Resize with high-quality Lancozos filter
-		resizedImage := resize.Resize(uint(newWidth), uint(newHeight), originalImage, resize.Lanczos3)
-
-		// Encode resized image
-		buf.Reset()
-		if err := jpeg.Encode(&buf, resizedImage, &jpeg.Options{Quality: quality}); err != nil {
-			return nil, fmt.Errorf("failed to encode resized image: %w", err)
+	if opts.OptimiseSizeOnly {
+		target.MinQuality = models.MinQuality
+	} else {
+		target.Resample = func(img image.Image, width, height int) (image.Image, error) {
+			// Resize with the chosen kernel, Lanczos by default
+			resized := imaging.Resize(img, width, height, opts.Kernel)
+
+			// Sharpen what the downscale softened
+			if opts.Sharpen {
+				return imaging.Sharpen(resized, sharpening(opts, nil))
+			}
+			return resized, nil
 		}
-		p.Logger.Info("Resized image",
-			zap.Int("new_width", newWidth),
-			zap.Int("new_height", newHeight),
-			zap.Float64("reduction_ratio", reductionRatio),
-		)
 	}
 
-	// Encode the final resized image with reduced quality
-	for {
-		buf.Reset()
-		quality -= models.QualityStep
-
-		if err := jpeg.Encode(&buf, resizedImage, &jpeg.Options{Quality: opts.Quality}); err != nil {
-			p.Logger.Error("Failed to encode resized image", zap.Error(err))
-			return nil, fmt.Errorf("resized encoding failed: %w", err)
-		}
-
-		finalSize := int64(buf.Len())
-
-		p.Logger.Info("Encoding attempt",
-			zap.Int64("original_size", currentSize),
-			zap.Int64("final_size", finalSize),
-			zap.Int("final_quality", quality),
-			zap.Float64("reduction_ratio", float64(finalSize)/float64(currentSize)),
-		)
-		break
+	sized, err := imaging.EncodeToSize(img, target)
+	if err != nil {
+		p.Logger.Error("Failed to encode image", zap.Error(err))
+		return nil, fmt.Errorf("encoding failed: %w", err)
 	}
 
-	// Return the final decoded image
-	img, _, err := image.Decode(&buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode final image: %w", err)
+	bounds := sized.Image.Bounds()
+	fields := []zap.Field{
+		zap.Int("quality", sized.Quality),
+		zap.Int("encodes", sized.Encodes),
+		zap.Int("size", len(sized.Data)),
+		zap.Int64("target_size", opts.TargetSizeBytes),
+		zap.Float64("scale", sized.Scale),
+		zap.Int("width", bounds.Dx()),
+		zap.Int("height", bounds.Dy()),
+	}
+	if !sized.Fits {
+		p.Logger.Warn("Image could not meet target size", fields...)
+	} else {
+		p.Logger.Info("Encoded image to target size", fields...)
 	}
 
-	return img, nil
+	return sized, nil
+}
+
+// sharpening returns the unsharp mask for opts: the one configured,
+// else the one tuned for the print, else imaging.DefaultUnsharpMask
+func sharpening(opts models.ProcessingOptions, spec *imaging.PrintSpec) imaging.UnsharpMask {
+	switch {
+	case opts.SharpenRadius > 0:
+		return imaging.UnsharpMask{Radius: opts.SharpenRadius, Amount: opts.SharpenAmount, Threshold: opts.SharpenThreshold}
+	case spec != nil:
+		return spec.Sharpening()
+	}
+	return imaging.DefaultUnsharpMask
 }
 
 // SaveImage saves the given image to the specified file path
@@ -131,6 +107,12 @@ func (p *ImageProcessor) SaveImage(img image.Image, path string, opts models.Pro
 
 	switch opts.Format {
 	case "jpeg", "jpg":
+		// JPEG has no alpha, so transparency would come out black
+		background := opts.Background
+		if background.A == 0 {
+			background = imaging.PaperWhite
+		}
+		img, _ = imaging.Flatten(img, background)
 		return jpeg.Encode(file, img, &jpeg.Options{Quality: opts.Quality})
 	case "png":
 		return png.Encode(file, img)
@@ -139,28 +121,30 @@ func (p *ImageProcessor) SaveImage(img image.Image, path string, opts models.Pro
 	}
 }
 
-// ConcurrentProcessImages processes multiple images in parallel
-func (p *ImageProcessor) ConcurrentProcessImages(images []image.Image, opts models.ProcessingOptions) []image.Image {
+// ConcurrentProcessImages processes multiple images in parallel on a
+// bounded worker pool. Both slices are in the order of images; an
+// image that failed, timed out or was cancelled is nil, with its error
+// at the same index.
+func (p *ImageProcessor) ConcurrentProcessImages(ctx context.Context, images []image.Image, opts models.ProcessingOptions) ([]image.Image, []error) {
+
+	pool := PoolOptions{
+		Workers:     models.MaxConcurrentProcessing,
+		ItemTimeout: models.MaxProcessingTime,
+	}
+	results := RunPool(ctx, images, pool, func(_ context.Context, _ int, img image.Image) (image.Image, error) {
+		return p.ProcessImageWithSizeTarget(img, opts)
+	})
 
-	var wg sync.WaitGroup
 	processedImages := make([]image.Image, len(images))
 	errors := make([]error, len(images))
-
-	for i, img := range images {
-		wg.Add(1)
-		go func(index int, img image.Image) {
-			defer wg.Done()
-			result, err := p.ProcessImageWithSizeTarget(img, opts)
-			if err != nil {
-				errors[index] = err
-				p.Logger.Error("Error processing image", zap.Int("index", i), zap.Error(err))
-				return
-			}
-			processedImages[index] = result
-		}(i, img)
+	for _, result := range results {
+		if result.Err != nil {
+			errors[result.Index] = result.Err
+			p.Logger.Error("Error processing image", zap.Int("index", result.Index), zap.Error(result.Err))
+			continue
+		}
+		processedImages[result.Index] = result.Value
 	}
 
-	wg.Wait()
-
-	return processedImages
+	return processedImages, errors
 }
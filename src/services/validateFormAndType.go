@@ -2,23 +2,20 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image"
+	"io"
 	"net/http"
 	"regexp"
 	"strings"
 
+	"github.com/30Piraten/snapflow/imaging"
 	"github.com/30Piraten/snapflow/models"
+	"go.uber.org/zap"
 )
 
-// AllowedFileExtensions defines permitted image file extensions
-var AllowedFileExtensions = map[string]struct{}{
-	".jpg":  {},
-	".jpeg": {},
-	".png":  {},
-}
-
 // ValidateOrder validates a PhotoOrder instance,
 // returning an error if required fields are missing.
 func ValidateOrder(order *models.PhotoOrder) error {
@@ -58,60 +55,526 @@ func ValidateOrder(order *models.PhotoOrder) error {
 	return nil
 }
 
-// ValidateAndProcessImage validates and processes an image.
-// It checks the file size, decodes the image, ensures the file
-// extension is allowed. It validates the MIME type, and enforces
-// maximum dimensions.
+// ValidateAndProcessImage validates and processes an image held
+// in memory. See ValidateAndProcessReader for the checks applied.
 func (p *ImageProcessor) ValidateAndProcessImage(imgData []byte, opts models.ProcessingOptions) (image.Image, error) {
+	return p.ValidateAndProcessReader(bytes.NewReader(imgData), int64(len(imgData)), opts)
+}
 
-	// Validate file size
-	fileSize := int64(len(imgData))
-	if fileSize > models.MaxFileSize {
-		return nil, fmt.Errorf("file size %d bytes exceeds maximum allowed size of %d bytes", fileSize, models.MaxFileSize)
+// ProcessedImage is a validated and processed image, along
+// with the transforms that were applied to it
+type ProcessedImage struct {
+	Image  image.Image
+	Format string
+
+	// EXIF orientation of the upload, undone before any resizing
+	Orientation imaging.ExifOrientation
+
+	// Metadata of the upload, nil when it carries none
+	Metadata *imaging.Metadata
+
+	// The JPEG encoded to the size target, with the metadata the
+	// policy keeps, and the quality and encodes it took
+	JPEG    []byte
+	Quality int
+	Encodes int
+
+	// Smaller renditions made from the same pixels
+	Renditions []EncodedRendition
+
+	// Expected print quality, nil without a print size
+	Preflight *imaging.Preflight
+
+	// Automatic color correction applied, nil when there was none
+	ColorCorrection *imaging.ColorCorrection
+
+	// How the decoded pixels were flattened to opaque 8-bit
+	Flattening *imaging.Flattening
+}
+
+// ValidateAndProcessReader validates and processes an image read
+// from src, which holds size bytes. See ValidateAndProcess.
+func (p *ImageProcessor) ValidateAndProcessReader(src io.ReadSeeker, size int64, opts models.ProcessingOptions) (image.Image, error) {
+	processed, err := p.ValidateAndProcess(src, size, opts)
+	if err != nil {
+		return nil, err
 	}
+	return processed.Image, nil
+}
 
-	// Decode the image securely
-	img, format, err := image.Decode(bytes.NewReader(imgData))
+// ProbeImage reads only the header of the image in src and rejects
+// it when its dimensions exceed opts.MaxDimensions or opts.MaxPixels.
+// It returns the image's config and format, with src rewound.
+func (p *ImageProcessor) ProbeImage(src io.ReadSeeker, opts models.ProcessingOptions) (image.Config, string, error) {
+	config, format, err := imaging.Probe(src, pixelBudget(opts))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+		return image.Config{}, "", err
+	}
+	if _, allowed := imaging.LookupFormat(format); !allowed {
+		return image.Config{}, "", fmt.Errorf("invalid file type: %s, only %s are allowed", format, imaging.FormatNames())
+	}
+	return config, format, nil
+}
+
+// pixelBudget returns the decoding limits set in opts
+func pixelBudget(opts models.ProcessingOptions) imaging.PixelBudget {
+	return imaging.PixelBudget{
+		MaxWidth:  opts.MaxDimensions.Width,
+		MaxHeight: opts.MaxDimensions.Height,
+		MaxPixels: opts.MaxPixels,
+	}
+}
+
+// ValidateAndProcess validates and processes an image read from src,
+// which holds size bytes. It checks the file size, validates the MIME
+// type, probes the header against the pixel budget, decodes the image,
+// ensures the file extension is allowed and enforces maximum dimensions.
+// It then turns the image upright according to its EXIF orientation and
+// fits it to the print, or runs the steps of opts.Recipe when it has
+// one. The image is decoded straight from src, so the
+// raw upload is never copied into memory. With a cache, the same bytes
+// processed with the same options are only decoded once; the returned
+// image is then shared and must not be changed.
+func (p *ImageProcessor) ValidateAndProcess(src io.ReadSeeker, size int64, opts models.ProcessingOptions) (*ProcessedImage, error) {
+
+	// Validate file size
+	if err := checkFileSize(size); err != nil {
+		return nil, err
+	}
+
+	// The image is handed to the caller, whose use of it
+	// is not tracked, so its memory is not kept reserved
+	var (
+		processed   *ProcessedImage
+		reservation *imaging.Reservation
+		err         error
+	)
+	if p.cache == nil {
+		processed, reservation, err = p.validateAndProcess(context.Background(), src, size, opts)
+	} else {
+		// Hashing is far cheaper than decoding and encoding again
+		contentHash, hashErr := hashReader(src)
+		if hashErr != nil {
+			return nil, hashErr
+		}
+		processed, reservation, err = p.validateAndProcessHashed(context.Background(), src, size, opts, contentHash)
+	}
+	reservation.Release()
+	return processed, err
+}
+
+// checkFileSize rejects an upload larger than models.MaxFileSize
+func checkFileSize(size int64) error {
+	if size > models.MaxFileSize {
+		return fmt.Errorf("file size %d bytes exceeds maximum allowed size of %d bytes", size, models.MaxFileSize)
+	}
+	return nil
+}
+
+// validateAndProcessHashed is ValidateAndProcess for an upload whose
+// size has been checked and whose SHA-256 is already known, so it is
+// not read again to find it. The wait for memory ends with ctx. The
+// reservation holds the processed image's memory until the caller
+// releases it; an image from the cache is counted by the cache.
+func (p *ImageProcessor) validateAndProcessHashed(ctx context.Context, src io.ReadSeeker, fileSize int64, opts models.ProcessingOptions, contentHash string) (*ProcessedImage, *imaging.Reservation, error) {
+	if p.cache == nil {
+		return p.validateAndProcess(ctx, src, fileSize, opts)
+	}
+
+	key := cacheKey(contentHash, optionsFingerprint(opts))
+	if processed, ok := p.cache.Get(key); ok {
+		p.Logger.Debug("Reusing processed image from cache", zap.String("original_sha256", contentHash))
+		return processed, nil, nil
 	}
 
-	// Validate file extension
-	extension := fmt.Sprintf(".%s", format)
-	if _, allowed := AllowedFileExtensions[extension]; !allowed {
-		return nil, fmt.Errorf("invalid file type: %s, only JPG and PNG are allowed", extension)
+	processed, reservation, err := p.validateAndProcess(ctx, src, fileSize, opts)
+	if err != nil {
+		return nil, nil, err
 	}
+	p.cache.Add(key, processed)
+	return processed, reservation, nil
+}
 
-	// Validate MIME type using the first 512 bytes
-	buffer := bytes.NewReader(imgData)
+// validateAndProcess does the work of ValidateAndProcess for an
+// upload of fileSize bytes. The returned reservation holds the memory
+// of the processed image until the caller releases it.
+func (p *ImageProcessor) validateAndProcess(ctx context.Context, src io.ReadSeeker, fileSize int64, opts models.ProcessingOptions) (processed *ProcessedImage, reservation *imaging.Reservation, err error) {
+
+	// Validate the file type using the first 512 bytes,
 	header := make([]byte, 512)
-	if _, err := buffer.Read(header); err != nil {
-		return nil, fmt.Errorf("failed to read file data for MIME type validation: %w", err)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("failed to read file data for MIME type validation: %w", err)
+	}
+	// against the formats with a registered decoder
+	if _, ok := imaging.SniffFormat(header[:n]); !ok {
+		return nil, nil, fmt.Errorf("invalid file type detected: %s, only %s are allowed", http.DetectContentType(header[:n]), imaging.FormatNames())
+	}
+
+	// Read the EXIF and ICC profile. A photo with broken metadata
+	// is still printable, so it is treated as having none.
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to rewind file data: %w", err)
+	}
+	metadata, err := imaging.ReadMetadata(src)
+	if err != nil {
+		p.Logger.Warn("Ignoring unreadable metadata", zap.Error(err))
+		metadata = nil
+	}
+
+	orientation := imaging.OrientationNormal
+	if metadata != nil {
+		orientation = metadata.Exif.Orientation()
+	}
+
+	// Check the dimensions in the header before any pixels are
+	// allocated, so a small file claiming a huge image is refused
+	config, _, err := p.ProbeImage(src, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Paper color and the ordered print, nil when the photo keeps
+	// its dimensions, which sets the size of the processed copies
+	background := opts.Background
+	if background.A == 0 {
+		background = imaging.PaperWhite
+	}
+	var spec *imaging.PrintSpec
+	var outputPixels int64
+	if opts.PrintSize != "" {
+		parsed, err := imaging.ParsePrintSpec(opts.PrintSize, opts.PrintDPI, opts.PrintOrientation, opts.FitMode)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid print options: %w", err)
+		}
+		parsed.Background = background
+		parsed.Kernel = opts.Kernel
+		spec = &parsed
+
+		width, height := spec.Pixels(orientedBounds(image.Rect(0, 0, config.Width, config.Height), orientation))
+		outputPixels = int64(width) * int64(height)
+	}
+
+	// Reserve the memory decoding and processing takes from the
+	// process's budget, so concurrent requests cannot use more than
+	// there is. Once processed, only what the image retains stays
+	// reserved, until the caller has stored it.
+	needed := imaging.ProcessingBytes(config, outputPixels)
+	reservation, err = p.governor.Acquire(ctx, needed)
+	if err != nil {
+		if errors.Is(err, imaging.ErrOverloaded) {
+			used, waiting := p.governor.InUse()
+			p.Logger.Warn("Processing memory budget exhausted",
+				zap.Int("width", config.Width),
+				zap.Int("height", config.Height),
+				zap.Int64("bytes_needed", needed),
+				zap.Int64("bytes_in_use", used),
+				zap.Int("images_waiting", waiting),
+			)
+		}
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			reservation.Release()
+			reservation = nil
+			return
+		}
+		reservation.Shrink(processedSize(processed))
+	}()
+
+	// Decode the image securely
+	img, format, err := image.Decode(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode image: %w", err)
 	}
-	mimeType := http.DetectContentType(header)
-	if !strings.HasPrefix(mimeType, "image/") {
-		return nil, fmt.Errorf("invalid file type detected: %s", mimeType)
+
+	// Validate the decoded format; every format is normalised
+	// to the JPEG the printers take when it is encoded
+	if _, allowed := imaging.LookupFormat(format); !allowed {
+		return nil, nil, fmt.Errorf("invalid file type: %s, only %s are allowed", format, imaging.FormatNames())
 	}
 
+	// Composite transparency onto the paper, which the JPEG would
+	// otherwise print black, and round 16-bit and paletted pixels
+	img, flattening := imaging.Flatten(img, background)
+	if flattening.Alpha || flattening.BitDepth != 8 || flattening.Source == "paletted" {
+		p.Logger.Info("Flattened image for print",
+			zap.String("source", flattening.Source),
+			zap.Int("bit_depth", flattening.BitDepth),
+			zap.Bool("alpha", flattening.Alpha),
+			zap.String("background", flattening.Background),
+		)
+	}
+
+	// Bring the pixels into sRGB from the embedded profile, so CMYK
+	// scans and Adobe RGB exports are not printed with the wrong colors
+	img, metadata = p.convertToSRGB(img, metadata)
+
 	// Enforce maximum dimensions to prevent resource exhaustion
 	maxWidth, maxHeight := opts.MaxDimensions.Width, opts.MaxDimensions.Height
 	if maxWidth > 0 && maxHeight > 0 {
 		if img.Bounds().Dx() > maxWidth || img.Bounds().Dy() > maxHeight {
-			return nil, fmt.Errorf("image dimensions exceed maximum allowed size of %dx%d pixels", maxWidth, maxHeight)
+			return nil, nil, fmt.Errorf("image dimensions exceed maximum allowed size of %dx%d pixels", maxWidth, maxHeight)
 		}
 	}
 
+	// Grade the photo's resolution on the paper before it is
+	// enlarged, as the enlarged pixels add no detail
+	preflight, err := p.preflight(orientedBounds(img.Bounds(), orientation), spec, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var correction *imaging.ColorCorrection
+	if opts.Recipe.Name != "" {
+		img, correction, err = p.applyRecipe(img, orientation, spec, &opts)
+	} else {
+		img, correction, err = p.applyOptions(img, orientation, spec, &opts)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Set the format if not already specified
 	if opts.Format == "" {
 		opts.Format = format
 	}
 
-	// Resize the image if the file size exceeds the target size
-	if fileSize > models.TargetFileSize {
+	processed = &ProcessedImage{
+		Image:       img,
+		Format:      format,
+		Orientation: orientation,
+		Metadata:    metadata,
+		Preflight:   preflight,
+
+		ColorCorrection: correction,
+		Flattening:      &flattening,
+	}
+
+	// Encode to the target size, lowering the quality and then the
+	// dimensions only as far as needed. Most photos fit first time.
+	if opts.TargetSizeBytes <= 0 {
 		opts.TargetSizeBytes = models.TargetFileSize
-		return p.ProcessImageWithSizeTarget(img, opts)
+	}
+	if opts.Quality <= 0 {
+		opts.Quality = models.HighQuality
+	}
+	master, encodeMetadata := img, metadata.Filter(metadataPolicy(opts))
+	if opts.OutputProfile != nil {
+		// Convert the print master for the printer and paper, and
+		// tag it with their profile so it is not taken for sRGB
+		if master, err = imaging.ConvertFromSRGB(img, opts.OutputProfile); err != nil {
+			return nil, nil, fmt.Errorf("failed to convert to print profile %q: %w", opts.OutputProfile.Description, err)
+		}
+		encodeMetadata = withICCProfile(encodeMetadata, opts.OutputProfile.Data)
+	}
+	sized, err := p.EncodeWithSizeTarget(master, opts, encodeMetadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	processed.Image = sized.Image
+	processed.JPEG = sized.Data
+	processed.Quality = sized.Quality
+	processed.Encodes = sized.Encodes
+
+	// Renditions are viewed on screens, so are made in sRGB
+	renditionSource := sized.Image
+	if opts.OutputProfile != nil {
+		renditionSource = img
+	}
+	if processed.Renditions, err = p.makeRenditions(renditionSource, opts); err != nil {
+		return nil, nil, err
+	}
+
+	return processed, reservation, nil
+}
+
+// convertToSRGB converts img from the profile embedded in its
+// metadata to sRGB. The profile is then dropped from the returned
+// metadata, as it no longer describes the pixels. Profiles that
+// cannot be read or evaluated leave the image as it is.
+func (p *ImageProcessor) convertToSRGB(img image.Image, metadata *imaging.Metadata) (image.Image, *imaging.Metadata) {
+	if metadata == nil || len(metadata.ICCProfile) == 0 {
+		return img, metadata
+	}
+
+	profile, err := imaging.ParseICCProfile(metadata.ICCProfile)
+	if err != nil {
+		p.Logger.Warn("Ignoring unreadable ICC profile", zap.Error(err))
+		return img, metadata
+	}
+	if profile.IsSRGB() {
+		return img, metadata
+	}
+
+	converted, err := imaging.ConvertToSRGB(img, profile)
+	if err != nil {
+		p.Logger.Warn("Keeping colors of unsupported ICC profile",
+			zap.String("profile", profile.Description),
+			zap.String("color_space", profile.ColorSpace),
+			zap.Error(err),
+		)
+		return img, metadata
+	}
+	p.Logger.Info("Converted image to sRGB",
+		zap.String("profile", profile.Description),
+		zap.String("color_space", profile.ColorSpace),
+	)
+
+	untagged := *metadata
+	untagged.ICCProfile = nil
+	return converted, &untagged
+}
+
+// withICCProfile returns metadata carrying the ICC profile data
+// in place of any it had
+func withICCProfile(metadata *imaging.Metadata, data []byte) *imaging.Metadata {
+	tagged := &imaging.Metadata{}
+	if metadata != nil {
+		*tagged = *metadata
+	}
+	tagged.ICCProfile = data
+	return tagged
+}
+
+// applyOptions turns img upright, fits it to the print, corrects its
+// color and sharpens it, as set in opts. A print fixes the dimensions,
+// so opts is changed to only lower the quality to meet the size target.
+func (p *ImageProcessor) applyOptions(img image.Image, orientation imaging.ExifOrientation, spec *imaging.PrintSpec, opts *models.ProcessingOptions) (image.Image, *imaging.ColorCorrection, error) {
+
+	// Turn the pixels upright before anything is resized. The
+	// re-encoded JPEG carries no EXIF, so this is the only chance.
+	if orientation != imaging.OrientationNormal {
+		img = imaging.ApplyOrientation(img, orientation)
+		rotation, mirrored := orientation.Rotation()
+		p.Logger.Info("Applied EXIF orientation",
+			zap.Int("orientation", int(orientation)),
+			zap.Int("rotation", rotation),
+			zap.Bool("mirrored", mirrored),
+		)
+	}
+
+	// Map the photo onto the pixels of the ordered print
+	var err error
+	if spec != nil {
+		if img, err = imaging.FitToPrint(img, *spec); err != nil {
+			return nil, nil, fmt.Errorf("failed to fit image to %s print: %w", spec.Size.Name, err)
+		}
 	}
 
-	// Accept the image without resizing if <= TargetFileSize
-	return img, nil
+	// Correct the color on the fitted pixels, which are fewer,
+	// and before sharpening so its halos are not stretched
+	img, correction, err := p.CorrectColor(img, *opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if spec == nil {
+		return img, correction, nil
+	}
+
+	// Resampling softens the photo, so restore its edges
+	if opts.Sharpen {
+		if img, err = imaging.Sharpen(img, sharpening(*opts, spec)); err != nil {
+			return nil, nil, fmt.Errorf("failed to sharpen image: %w", err)
+		}
+	}
+
+	// The printer expects exactly these pixels, so
+	// only the quality may be lowered to save bytes
+	opts.OptimiseSizeOnly = true
+	return img, correction, nil
+}
+
+// CorrectColor applies the automatic color correction set in
+// opts.AutoColor to img. It returns img and no correction when
+// none is set.
+func (p *ImageProcessor) CorrectColor(img image.Image, opts models.ProcessingOptions) (image.Image, *imaging.ColorCorrection, error) {
+	if !opts.AutoColor.Enabled() {
+		return img, nil, nil
+	}
+
+	corrected, correction, err := imaging.AutoCorrectColor(img, opts.AutoColor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to correct color: %w", err)
+	}
+	logColorCorrection(p.Logger, correction)
+	return corrected, correction, nil
+}
+
+// logColorCorrection logs the color correction applied to a photo
+func logColorCorrection(logger *zap.Logger, correction *imaging.ColorCorrection) {
+	logger.Info("Applied color correction",
+		zap.Uint8s("black", correction.Black[:]),
+		zap.Uint8s("white", correction.White[:]),
+		zap.Float64s("gain", correction.Gain[:]),
+		zap.Float64("contrast", correction.Contrast),
+		zap.Float64("saturation", correction.Saturation),
+	)
+}
+
+// applyRecipe runs the steps of opts.Recipe on img, and changes opts
+// to encode the result as its encode step asks
+func (p *ImageProcessor) applyRecipe(img image.Image, orientation imaging.ExifOrientation, spec *imaging.PrintSpec, opts *models.ProcessingOptions) (image.Image, *imaging.ColorCorrection, error) {
+	pipeline, err := opts.Recipe.Compile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, correction, err := pipeline.Run(img, imaging.RecipeInput{Orientation: orientation, Print: spec, Kernel: opts.Kernel})
+	if err != nil {
+		return nil, nil, err
+	}
+	if correction != nil {
+		logColorCorrection(p.Logger, correction)
+	}
+	p.Logger.Info("Applied processing recipe",
+		zap.String("recipe", pipeline.Name),
+		zap.Int("width", img.Bounds().Dx()),
+		zap.Int("height", img.Bounds().Dy()),
+	)
+
+	// Without an encode step, the recipe's pixels are kept
+	// and only the quality lowered, as for a print
+	opts.OptimiseSizeOnly = true
+	if encoding := pipeline.Encoding; encoding != nil {
+		if encoding.Quality > 0 {
+			opts.Quality = encoding.Quality
+		}
+		if encoding.TargetBytes > 0 {
+			opts.TargetSizeBytes = encoding.TargetBytes
+		}
+		opts.OptimiseSizeOnly = !encoding.Downscale
+	}
+	return img, correction, nil
+}
+
+// preflight grades the resolution of a photo with the given upright
+// bounds on the print, rejecting a poor one when opts says so
+func (p *ImageProcessor) preflight(bounds image.Rectangle, spec *imaging.PrintSpec, opts models.ProcessingOptions) (*imaging.Preflight, error) {
+	if spec == nil {
+		return nil, nil
+	}
+
+	analysis := imaging.AnalysePrint(bounds, *spec)
+	if analysis.Quality == imaging.PrintQualityPoor {
+		if opts.RejectPoorPrints {
+			return nil, fmt.Errorf("photo of %dx%d pixels is only %d DPI on a %s print, at least %d DPI is required",
+				bounds.Dx(), bounds.Dy(), analysis.EffectiveDPI, spec.Size.Name, imaging.AcceptableDPI)
+		}
+		p.Logger.Warn("Photo will print poorly",
+			zap.Int("effective_dpi", analysis.EffectiveDPI),
+			zap.String("print_size", spec.Size.Name),
+		)
+	}
+	return &analysis, nil
+}
+
+// orientedBounds returns the bounds of an image once the EXIF
+// orientation is undone
+func orientedBounds(bounds image.Rectangle, orientation imaging.ExifOrientation) image.Rectangle {
+	if rotation, _ := orientation.Rotation(); rotation == 90 || rotation == 270 {
+		return image.Rect(0, 0, bounds.Dy(), bounds.Dx())
+	}
+	return bounds
 }
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/30Piraten/snapflow/models"
+)
+
+// PoolOptions limits the work done by RunPool
+type PoolOptions struct {
+	Workers     int           // -> items worked on at once, models.MaxConcurrentProcessing when 0
+	ItemTimeout time.Duration // -> time each item may take, unlimited when 0
+}
+
+// PoolResult is the outcome of one item given to RunPool
+type PoolResult[T any] struct {
+	Index int
+	Value T
+	Err   error
+}
+
+// RunPool calls work for every item, with at most opts.Workers items
+// in progress, and returns their results in the order of items.
+//
+// Cancelling ctx stops items from starting; they fail with the
+// context's error. An item that runs past opts.ItemTimeout fails with
+// context.DeadlineExceeded; its context is cancelled, but it keeps
+// its worker until work returns, so the limit always holds. A panic
+// in work is recovered and fails only its own item.
+func RunPool[In, Out any](ctx context.Context, items []In, opts PoolOptions, work func(ctx context.Context, index int, item In) (Out, error)) []PoolResult[Out] {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = models.MaxConcurrentProcessing
+	}
+
+	results := make([]PoolResult[Out], len(items))
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for index, item := range items {
+		// Wait for a free worker, unless the pool is cancelled
+		err := ctx.Err()
+		if err == nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			for i := index; i < len(items); i++ {
+				results[i] = PoolResult[Out]{Index: i, Err: fmt.Errorf("item %d not started: %w", i, err)}
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(index int, item In) {
+			defer wg.Done()
+			results[index] = runPoolItem(ctx, slots, index, item, opts.ItemTimeout, work)
+		}(index, item)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// runPoolItem runs work for one item, which holds a slot until work
+// returns, and waits for it up to the item timeout
+func runPoolItem[In, Out any](ctx context.Context, slots chan struct{}, index int, item In, timeout time.Duration, work func(context.Context, int, In) (Out, error)) PoolResult[Out] {
+	itemCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		itemCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	done := make(chan PoolResult[Out], 1)
+	go func() {
+		defer func() { <-slots }()
+		defer func() {
+			if r := recover(); r != nil {
+				done <- PoolResult[Out]{Index: index, Err: fmt.Errorf("item %d panicked: %v", index, r)}
+			}
+		}()
+
+		value, err := work(itemCtx, index, item)
+		done <- PoolResult[Out]{Index: index, Value: value, Err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-itemCtx.Done():
+		return PoolResult[Out]{Index: index, Err: fmt.Errorf("item %d abandoned: %w", index, itemCtx.Err())}
+	}
+}
@@ -3,14 +3,19 @@ package services
 import (
 	"sync"
 
+	cfg "github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/imaging"
+	"github.com/30Piraten/snapflow/utils"
 	"go.uber.org/zap"
 )
 
 // ImageProcessor handles all image processing operations
 type ImageProcessor struct {
 	Logger *zap.Logger
-	// Allow cache for processed images
-	cache *sync.Map
+	// Cache of processed images, nil when caching is disabled
+	cache *processedCache
+	// Memory budget shared with other processors, nil for none
+	governor *imaging.MemoryGovernor
 }
 
 // NewImageProcessor creates a new instance of
@@ -20,3 +25,44 @@ func NewImageProcessor(Logger *zap.Logger) *ImageProcessor {
 		Logger: Logger,
 	}
 }
+
+// NewCachedImageProcessor creates an ImageProcessor that keeps up
+// to cacheBytes of processed images, so the same upload processed
+// with the same options is only decoded and encoded once.
+func NewCachedImageProcessor(Logger *zap.Logger, cacheBytes int64) *ImageProcessor {
+	processor := NewImageProcessor(Logger)
+	if cacheBytes > 0 {
+		processor.cache = newProcessedCache(cacheBytes)
+	}
+	return processor
+}
+
+// CacheStats returns the processor's cache statistics
+func (p *ImageProcessor) CacheStats() CacheStats {
+	if p.cache == nil {
+		return CacheStats{}
+	}
+	return p.cache.Stats()
+}
+
+var (
+	sharedProcessor     *ImageProcessor
+	sharedProcessorOnce sync.Once
+)
+
+// SharedImageProcessor returns the processor used by every request,
+// so uploads processed more than once share its cache. The cache
+// size is set by IMAGE_CACHE_MB, and its decodes share the process's
+// pixel budget.
+func SharedImageProcessor() *ImageProcessor {
+	sharedProcessorOnce.Do(func() {
+		cacheBytes, err := cfg.ImageCacheBytes()
+		if err != nil {
+			utils.Logger.Warn("Using default image cache size", zap.Error(err))
+			cacheBytes = cfg.DefaultImageCacheMB << 20
+		}
+		sharedProcessor = NewCachedImageProcessor(utils.Logger, cacheBytes)
+		sharedProcessor.governor = cfg.MemoryGovernor()
+	})
+	return sharedProcessor
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Default key templates. Both keep an order's photos together below
+// its store and upload date, and the order ID keeps two customers
+// with the same name from ever sharing a key.
+const (
+	DefaultObjectKeyTemplate = "{store}/{yyyy}/{mm}/{dd}/{order_id}/{photo_index}-{hash}.{ext}"
+	DefaultUploadKeyTemplate = "uploads/{store}/{yyyy}/{mm}/{dd}/{order_id}/{photo_index}-{filename}.{ext}"
+)
+
+// defaultStore is used for {store} when an order has no location
+const defaultStore = "default"
+
+// Key template fields
+const (
+	FieldStore      = "store"
+	FieldYear       = "yyyy"
+	FieldMonth      = "mm"
+	FieldDay        = "dd"
+	FieldOrderID    = "order_id"
+	FieldPhotoIndex = "photo_index"
+	FieldHash       = "hash"
+	FieldExt        = "ext"
+	FieldCustomer   = "customer"
+	FieldFilename   = "filename"
+)
+
+var knownKeyFields = map[string]bool{
+	FieldStore:      true,
+	FieldYear:       true,
+	FieldMonth:      true,
+	FieldDay:        true,
+	FieldOrderID:    true,
+	FieldPhotoIndex: true,
+	FieldHash:       true,
+	FieldExt:        true,
+	FieldCustomer:   true,
+	FieldFilename:   true,
+}
+
+// KeyFields holds the values substituted into a key template
+type KeyFields struct {
+	Store      string    // -> store location of the order
+	Time       time.Time // -> fills {yyyy}, {mm} and {dd}
+	OrderID    string
+	PhotoIndex int
+	Hash       string // -> SHA-256 of the stored bytes
+	Ext        string // -> without the leading dot
+	Customer   string
+	Filename   string // -> original file name, without extension
+}
+
+// KeyTemplate renders object keys from a layout such as
+// DefaultObjectKeyTemplate. Use ParseKeyTemplate to build one.
+type KeyTemplate struct {
+	raw      string
+	segments []keySegment
+	fields   map[string]bool
+	pattern  *regexp.Regexp // -> matches the keys the template renders
+}
+
+// keySegment is either literal text or a {field} placeholder
+type keySegment struct {
+	literal string
+	field   string
+}
+
+// ParseKeyTemplate parses and validates a key template. Every
+// placeholder must be a known field, and the template must render
+// a distinct key per photo: it needs {hash}, or {order_id} together
+// with {photo_index} or {filename}.
+func ParseKeyTemplate(raw string) (*KeyTemplate, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("key template is empty")
+	}
+	if strings.HasPrefix(raw, "/") || strings.HasSuffix(raw, "/") {
+		return nil, fmt.Errorf("key template %q must not start or end with /", raw)
+	}
+	for _, part := range strings.Split(raw, "/") {
+		if part == "" || part == "." || part == ".." {
+			return nil, fmt.Errorf("key template %q contains an empty or relative path segment", raw)
+		}
+	}
+
+	tmpl := &KeyTemplate{raw: raw, fields: make(map[string]bool)}
+	rest := raw
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			tmpl.segments = append(tmpl.segments, keySegment{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("key template %q has an unmatched }", raw)
+		}
+		if open > 0 {
+			tmpl.segments = append(tmpl.segments, keySegment{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("key template %q has an unclosed {", raw)
+		}
+		field := rest[open+1 : open+1+end]
+		if !knownKeyFields[field] {
+			return nil, fmt.Errorf("key template %q uses unknown field {%s}", raw, field)
+		}
+		tmpl.segments = append(tmpl.segments, keySegment{field: field})
+		tmpl.fields[field] = true
+		rest = rest[open+2+end:]
+	}
+
+	perPhoto := tmpl.fields[FieldPhotoIndex] || tmpl.fields[FieldFilename]
+	if !tmpl.fields[FieldHash] && !(tmpl.fields[FieldOrderID] && perPhoto) {
+		return nil, fmt.Errorf("key template %q does not identify a photo: it needs {hash}, or {order_id} with {photo_index} or {filename}", raw)
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for _, segment := range tmpl.segments {
+		if segment.field == "" {
+			pattern.WriteString(regexp.QuoteMeta(segment.literal))
+			continue
+		}
+		pattern.WriteString(fieldPattern(segment.field))
+	}
+	pattern.WriteString("$")
+	tmpl.pattern = regexp.MustCompile(pattern.String())
+
+	return tmpl, nil
+}
+
+// String returns the template as it was parsed
+func (t *KeyTemplate) String() string {
+	return t.raw
+}
+
+// Uses reports whether the template contains the given field
+func (t *KeyTemplate) Uses(field string) bool {
+	return t.fields[field]
+}
+
+// DirUses reports whether the directory part of the template, before
+// its last /, contains the given field
+func (t *KeyTemplate) DirUses(field string) bool {
+	slash := strings.LastIndex(t.raw, "/")
+	return slash >= 0 && strings.Contains(t.raw[:slash], "{"+field+"}")
+}
+
+// Matches reports whether key has the layout of the template, so it
+// may have been rendered by it. Other objects in the same bucket,
+// such as manifests and processed photos, do not match unless their
+// own template has the same layout.
+func (t *KeyTemplate) Matches(key string) bool {
+	return t.pattern.MatchString(key)
+}
+
+// fieldPattern returns the regular expression matching the
+// rendered values of a template field
+func fieldPattern(field string) string {
+	switch field {
+	case FieldYear:
+		return `[0-9]{4}`
+	case FieldMonth, FieldDay:
+		return `[0-9]{2}`
+	case FieldPhotoIndex:
+		return `-?[0-9]+`
+	}
+	return `[^/]+`
+}
+
+// Render substitutes fields into the template. Values are sanitized
+// so they cannot add path segments, and every field the template
+// uses must be set, apart from {store} which falls back to "default".
+func (t *KeyTemplate) Render(fields KeyFields) (string, error) {
+	if fields.Store == "" {
+		fields.Store = defaultStore
+	}
+	if fields.Time.IsZero() {
+		fields.Time = time.Now()
+	}
+	fields.Time = fields.Time.UTC()
+
+	var key strings.Builder
+	for _, segment := range t.segments {
+		if segment.field == "" {
+			key.WriteString(segment.literal)
+			continue
+		}
+
+		value := fields.value(segment.field)
+		if value == "" {
+			return "", fmt.Errorf("key template %q needs a value for {%s}", t.raw, segment.field)
+		}
+		key.WriteString(value)
+	}
+
+	return path.Clean(key.String()), nil
+}
+
+// value returns the sanitized value of a template field
+func (f KeyFields) value(field string) string {
+	switch field {
+	case FieldStore:
+		return sanitizeKeyValue(f.Store)
+	case FieldYear:
+		return fmt.Sprintf("%04d", f.Time.Year())
+	case FieldMonth:
+		return fmt.Sprintf("%02d", int(f.Time.Month()))
+	case FieldDay:
+		return fmt.Sprintf("%02d", f.Time.Day())
+	case FieldOrderID:
+		return sanitizeKeyValue(f.OrderID)
+	case FieldPhotoIndex:
+		return strconv.Itoa(f.PhotoIndex)
+	case FieldHash:
+		return sanitizeKeyValue(f.Hash)
+	case FieldExt:
+		return sanitizeKeyValue(strings.ToLower(strings.TrimPrefix(f.Ext, ".")))
+	case FieldCustomer:
+		return sanitizeKeyValue(f.Customer)
+	case FieldFilename:
+		return sanitizeKeyValue(f.Filename)
+	}
+	return ""
+}
+
+// sanitizeKeyValue lower-cases value and replaces everything but
+// letters, digits, '-' and '_' with '_', so a value can never add
+// a path segment or a dot-relative component to the key
+func sanitizeKeyValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r), r == '-', r == '_':
+			return unicode.ToLower(r)
+		default:
+			return '_'
+		}
+	}, strings.TrimSpace(value))
+}
@@ -0,0 +1,504 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// metaDir holds the JSON sidecars with each object's content
+	// type and metadata. It lives under the root and is hidden
+	// from List.
+	metaDir = ".meta"
+
+	// tmpPrefix marks partially written files
+	tmpPrefix = ".tmp-"
+
+	// Query parameters of a locally presigned URL
+	paramMethod     = "X-Snapflow-Method"
+	paramExpires    = "X-Snapflow-Expires"
+	paramSignature  = "X-Snapflow-Signature"
+	paramMetaPrefix = "X-Snapflow-Meta-"
+
+	// Form fields of a locally presigned POST
+	fieldPolicy     = "policy"
+	fieldSignature  = "x-snapflow-signature"
+	fieldMetaPrefix = "x-amz-meta-"
+)
+
+// LocalStorage stores objects as files below a root directory.
+// It lets the upload path run on store laptops and dev machines
+// without an AWS account. Presigned URLs point at BaseURL and are
+// signed with an HMAC so the local storage handler can verify them.
+type LocalStorage struct {
+	root    string
+	baseURL string
+	secret  []byte
+}
+
+// localMeta is the sidecar persisted next to every object
+type localMeta struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// NewLocalStorage returns a Storage rooted at root. baseURL is
+// the public URL the local storage handler is mounted on, and
+// secret signs presigned URLs.
+func NewLocalStorage(root, baseURL string, secret []byte) (*LocalStorage, error) {
+	if root == "" {
+		return nil, errors.New("local storage root is empty")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("local storage secret is empty")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage root: %w", err)
+	}
+
+	return &LocalStorage{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+// Root returns the directory objects are stored in
+func (l *LocalStorage) Root() string {
+	return l.root
+}
+
+// Put writes body to a temporary file and renames it into
+// place, so readers never observe a partially written object.
+func (l *LocalStorage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	target, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), tmpPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name()) // -> No-op once renamed
+
+	if _, err := io.Copy(tmp, &ctxReader{ctx: ctx, r: body}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+
+	if err := l.writeMeta(key, localMeta{ContentType: opts.ContentType, Metadata: opts.Metadata}); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Get opens the file stored under key
+func (l *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := l.Head(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	target, _ := l.path(key)
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, nil, l.wrapError("get", key, err)
+	}
+
+	return file, info, nil
+}
+
+// Head returns the info of the file stored under key
+func (l *LocalStorage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	target, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(target)
+	if err != nil {
+		return nil, l.wrapError("head", key, err)
+	}
+
+	meta := l.readMeta(key)
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  contentType,
+		ETag:         fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+		LastModified: stat.ModTime(),
+		Metadata:     meta.Metadata,
+	}, nil
+}
+
+// Delete removes the file stored under key and its sidecar
+func (l *LocalStorage) Delete(ctx context.Context, key string) error {
+	target, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil {
+		return l.wrapError("delete", key, err)
+	}
+	os.Remove(l.metaPath(target))
+	return nil
+}
+
+// List walks the root and returns every object whose key starts with prefix
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == metaDir && filepath.Dir(p) == filepath.Clean(l.root) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+
+	return objects, nil
+}
+
+// Presign returns a URL on the local storage handler that is
+// valid for opts.Expires. Metadata is carried in the query string
+// and covered by the signature, mirroring S3's x-amz-meta headers.
+func (l *LocalStorage) Presign(ctx context.Context, key string, opts PresignOptions) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+	if l.baseURL == "" {
+		return "", errors.New("local storage base URL is not configured")
+	}
+	opts = opts.withDefaults()
+
+	query := url.Values{}
+	query.Set(paramMethod, opts.Method)
+	query.Set(paramExpires, strconv.FormatInt(time.Now().Add(opts.Expires).Unix(), 10))
+	for k, v := range opts.Metadata {
+		query.Set(paramMetaPrefix+k, v)
+	}
+	query.Set(paramSignature, l.sign(key, query))
+
+	return fmt.Sprintf("%s/%s?%s", l.baseURL, escapeKey(key), query.Encode()), nil
+}
+
+// localPostPolicy is the policy document of a locally presigned POST
+type localPostPolicy struct {
+	Expiration  time.Time         `json:"expiration"`
+	Key         string            `json:"key,omitempty"`
+	KeyPrefix   string            `json:"key_prefix,omitempty"`
+	ContentType string            `json:"content_type"`
+	MinSize     int64             `json:"min_size"`
+	MaxSize     int64             `json:"max_size"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// PresignPost returns a POST form targeting the local storage
+// handler. The policy document is signed like an S3 POST policy,
+// and VerifyPost enforces the same conditions S3 would.
+func (l *LocalStorage) PresignPost(ctx context.Context, key string, policy PostPolicy) (*PresignedPost, error) {
+	if _, err := l.path(key); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(key); err != nil {
+		return nil, err
+	}
+	if l.baseURL == "" {
+		return nil, errors.New("local storage base URL is not configured")
+	}
+	if policy.Expires <= 0 {
+		policy.Expires = DefaultPresignExpiry
+	}
+
+	pinned := localPostPolicy{
+		Expiration:  time.Now().Add(policy.Expires).UTC(),
+		KeyPrefix:   policy.KeyPrefix,
+		ContentType: policy.ContentType,
+		MinSize:     policy.MinSize,
+		MaxSize:     policy.MaxSize,
+		Metadata:    policy.Metadata,
+	}
+	if policy.KeyPrefix == "" {
+		pinned.Key = key
+	}
+
+	doc, err := json.Marshal(pinned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal post policy: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(doc)
+
+	fields := map[string]string{
+		"key":          key,
+		"Content-Type": policy.ContentType,
+		fieldPolicy:    encoded,
+		fieldSignature: l.signPolicy(encoded),
+	}
+	for k, v := range policy.Metadata {
+		fields[fieldMetaPrefix+k] = v
+	}
+
+	return &PresignedPost{URL: l.baseURL, Fields: fields}, nil
+}
+
+// VerifyPost checks the fields of a form POST against the policy
+// issued by PresignPost. size is the length of the uploaded file.
+// It returns the key and put options to store the file with.
+func (l *LocalStorage) VerifyPost(fields map[string]string, size int64) (string, PutOptions, error) {
+	encoded := fields[fieldPolicy]
+
+	expected, err := hex.DecodeString(l.signPolicy(encoded))
+	if err != nil {
+		return "", PutOptions{}, err
+	}
+	provided, err := hex.DecodeString(fields[fieldSignature])
+	if err != nil || !hmac.Equal(expected, provided) {
+		return "", PutOptions{}, errors.New("post policy signature does not match")
+	}
+
+	doc, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", PutOptions{}, errors.New("post policy is not valid base64")
+	}
+	var policy localPostPolicy
+	if err := json.Unmarshal(doc, &policy); err != nil {
+		return "", PutOptions{}, errors.New("post policy is not valid JSON")
+	}
+
+	key := fields["key"]
+	switch {
+	case time.Now().After(policy.Expiration):
+		return "", PutOptions{}, errors.New("post policy has expired")
+	case policy.KeyPrefix == "" && key != policy.Key:
+		return "", PutOptions{}, errors.New("key does not match the post policy")
+	case !strings.HasPrefix(key, policy.KeyPrefix):
+		return "", PutOptions{}, errors.New("key does not match the post policy prefix")
+	case fields["Content-Type"] != policy.ContentType:
+		return "", PutOptions{}, errors.New("Content-Type does not match the post policy")
+	case size < policy.MinSize || size > policy.MaxSize:
+		return "", PutOptions{}, fmt.Errorf("file size %d is outside the allowed range %d..%d", size, policy.MinSize, policy.MaxSize)
+	}
+	for k, v := range policy.Metadata {
+		if fields[fieldMetaPrefix+k] != v {
+			return "", PutOptions{}, fmt.Errorf("metadata %q does not match the post policy", k)
+		}
+	}
+
+	return key, PutOptions{ContentType: policy.ContentType, Metadata: policy.Metadata}, nil
+}
+
+// signPolicy computes the HMAC of an encoded post policy
+func (l *LocalStorage) signPolicy(encoded string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte("post\n" + encoded))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPresigned checks a request against a URL issued by Presign.
+// It returns the metadata carried in the URL when the signature is
+// valid, the method matches and the URL has not yet expired.
+func (l *LocalStorage) VerifyPresigned(method, key string, query url.Values) (map[string]string, error) {
+	if query.Get(paramMethod) != method {
+		return nil, errors.New("presigned URL was not issued for this method")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(paramExpires), 10, 64)
+	if err != nil {
+		return nil, errors.New("presigned URL has an invalid expiry")
+	}
+	if time.Now().Unix() > expires {
+		return nil, errors.New("presigned URL has expired")
+	}
+
+	expected, err := hex.DecodeString(l.sign(key, query))
+	if err != nil {
+		return nil, err
+	}
+	provided, err := hex.DecodeString(query.Get(paramSignature))
+	if err != nil || !hmac.Equal(expected, provided) {
+		return nil, errors.New("presigned URL signature does not match")
+	}
+
+	metadata := map[string]string{}
+	for k := range query {
+		if strings.HasPrefix(k, paramMetaPrefix) {
+			metadata[strings.TrimPrefix(k, paramMetaPrefix)] = query.Get(k)
+		}
+	}
+
+	return metadata, nil
+}
+
+// sign computes the HMAC over the key and every signed query parameter
+func (l *LocalStorage) sign(key string, query url.Values) string {
+	var names []string
+	for k := range query {
+		if k != paramSignature {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(key))
+	for _, name := range names {
+		fmt.Fprintf(mac, "\n%s=%s", name, query.Get(name))
+	}
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// path maps a key to a file below the root, rejecting
+// keys that would escape it.
+func (l *LocalStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || cleaned != "/"+key {
+		return "", fmt.Errorf("invalid storage key: %q", key)
+	}
+	if strings.HasPrefix(key, metaDir+"/") {
+		return "", fmt.Errorf("invalid storage key: %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if strings.HasPrefix(segment, tmpPrefix) {
+			return "", fmt.Errorf("invalid storage key: %q", key)
+		}
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// metaPath returns the sidecar location for the file at target
+func (l *LocalStorage) metaPath(target string) string {
+	rel, _ := filepath.Rel(l.root, target)
+	return filepath.Join(l.root, metaDir, rel+".json")
+}
+
+// writeMeta persists the sidecar for key
+func (l *LocalStorage) writeMeta(key string, meta localMeta) error {
+	target, _ := l.path(key)
+	metaFile := l.metaPath(target)
+
+	if err := os.MkdirAll(filepath.Dir(metaFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create metadata directory for %s: %w", key, err)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata for %s: %w", key, err)
+	}
+
+	if err := os.WriteFile(metaFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write metadata for %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// readMeta loads the sidecar for key. Missing or unreadable
+// sidecars yield empty metadata rather than an error.
+func (l *LocalStorage) readMeta(key string) localMeta {
+	var meta localMeta
+
+	target, _ := l.path(key)
+	data, err := os.ReadFile(l.metaPath(target))
+	if err != nil {
+		return meta
+	}
+	json.Unmarshal(data, &meta)
+
+	return meta
+}
+
+// wrapError maps fs.ErrNotExist to ErrNotFound
+func (l *LocalStorage) wrapError(op, key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s %s: %w", op, key, ErrNotFound)
+	}
+	return fmt.Errorf("failed to %s %s: %w", op, key, err)
+}
+
+// escapeKey escapes each path segment of key for use in a URL
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// ctxReader stops reading once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Multipart upload limits imposed by S3
+const (
+	MinPartSize  int64 = 5 * 1024 * 1024
+	MaxPartCount int   = 10000
+
+	DefaultPartSize    int64 = 8 * 1024 * 1024
+	DefaultConcurrency int   = 4
+)
+
+// MultipartConfig controls how large objects are streamed to S3.
+// Objects smaller than PartSize are sent with a single PutObject,
+// larger ones are split into PartSize parts with up to Concurrency
+// parts in flight. At most Concurrency part buffers are held in
+// memory at once, whatever the size of the object.
+type MultipartConfig struct {
+	PartSize    int64
+	Concurrency int
+}
+
+// Validate checks the config against the S3 limits
+func (m MultipartConfig) Validate() error {
+	if m.PartSize < MinPartSize {
+		return fmt.Errorf("multipart part size %d is below the S3 minimum of %d bytes", m.PartSize, MinPartSize)
+	}
+	if m.Concurrency < 1 {
+		return fmt.Errorf("multipart concurrency must be at least 1, got %d", m.Concurrency)
+	}
+	return nil
+}
+
+// putMultipart streams body to S3. The first part is read up front
+// so small objects skip the multipart round trips entirely. Any
+// failure aborts the upload so no orphaned parts are left billed
+// in the bucket.
+func (s *S3Storage) putMultipart(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	cfg := s.Multipart
+
+	// Grow the first buffer as data arrives, so a small
+	// object never costs a whole part-sized allocation
+	var head bytes.Buffer
+	n, err := io.CopyN(&head, body, cfg.PartSize)
+	if err == io.EOF {
+		return s.putObject(ctx, key, bytes.NewReader(head.Bytes()), opts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload body for %s: %w", key, err)
+	}
+	first := head.Bytes()[:n]
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Metadata: opts.Metadata,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+
+	created, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload for %s: %w", key, err)
+	}
+	uploadID := created.UploadId
+
+	parts, err := s.uploadParts(ctx, key, uploadID, first, body)
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return err
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return fmt.Errorf("failed to complete multipart upload for %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// uploadParts reads body part by part and uploads up to
+// Concurrency parts in parallel. It stops at the first error.
+func (s *S3Storage) uploadParts(ctx context.Context, key string, uploadID *string, first []byte, body io.Reader) ([]types.CompletedPart, error) {
+	cfg := s.Multipart
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The buffer pool doubles as the concurrency limit: reading
+	// the next part blocks until an in-flight part hands one back.
+	buffers := make(chan []byte, cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency-1; i++ {
+		buffers <- make([]byte, cfg.PartSize)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	upload := func(partNumber int32, buf []byte, n int) {
+		defer wg.Done()
+		defer func() { buffers <- buf }()
+
+		output, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			fail(fmt.Errorf("failed to upload part %d of %s: %w", partNumber, key, err))
+			return
+		}
+
+		mu.Lock()
+		parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: aws.Int32(partNumber)})
+		mu.Unlock()
+	}
+
+	buf, n := first, len(first)
+	for partNumber := int32(1); ; partNumber++ {
+		if int(partNumber) > MaxPartCount {
+			fail(fmt.Errorf("upload of %s exceeds %d parts, increase the part size", key, MaxPartCount))
+			break
+		}
+
+		wg.Add(1)
+		go upload(partNumber, buf, n)
+
+		// A short read means that was the last part
+		if n < len(buf) {
+			break
+		}
+
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+			buf = nil
+		}
+		if buf == nil {
+			break
+		}
+
+		var err error
+		n, err = io.ReadFull(body, buf)
+		if err == io.EOF {
+			buffers <- buf
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			buffers <- buf
+			fail(fmt.Errorf("failed to read upload body for %s: %w", key, err))
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+
+	return parts, nil
+}
+
+// abortMultipart discards the parts of a failed upload. It uses a
+// fresh context since the request context may already be cancelled.
+func (s *S3Storage) abortMultipart(key string, uploadID *string) {
+	_, err := s.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("failed to abort multipart upload %s for %s: %v", aws.ToString(uploadID), key, err)
+	}
+}
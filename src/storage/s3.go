@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Storage stores objects in a single S3 bucket
+type S3Storage struct {
+	client    *s3.Client
+	presigner *s3.PresignClient
+	bucket    string
+
+	// Multipart controls how Put streams large objects
+	Multipart MultipartConfig
+}
+
+// NewS3Storage returns a Storage backed by the given S3
+// client and bucket name, using the default multipart config.
+func NewS3Storage(client *s3.Client, bucket string) *S3Storage {
+	return &S3Storage{
+		client:    client,
+		presigner: s3.NewPresignClient(client),
+		bucket:    bucket,
+		Multipart: MultipartConfig{
+			PartSize:    DefaultPartSize,
+			Concurrency: DefaultConcurrency,
+		},
+	}
+}
+
+// Bucket returns the name of the bucket objects are stored in
+func (s *S3Storage) Bucket() string {
+	return s.bucket
+}
+
+// Put streams body to the bucket under key. Bodies that report a
+// length below the part size go up in one request, anything else
+// is read part by part with a multipart upload.
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	if sized, ok := body.(interface{ Len() int }); ok && int64(sized.Len()) < s.Multipart.PartSize {
+		return s.putObject(ctx, key, body, opts)
+	}
+	return s.putMultipart(ctx, key, body, opts)
+}
+
+// putObject uploads body with a single PutObject request
+func (s *S3Storage) putObject(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: opts.Metadata,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("error uploading to S3: %w", err)
+	}
+
+	return nil
+}
+
+// Get downloads the object stored under key
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, s.wrapError("get", key, err)
+	}
+
+	info := &ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		LastModified: aws.ToTime(output.LastModified),
+		Metadata:     output.Metadata,
+	}
+
+	return output.Body, info, nil
+}
+
+// Head returns the info of the object stored under key
+func (s *S3Storage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s.wrapError("head", key, err)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		LastModified: aws.ToTime(output.LastModified),
+		Metadata:     output.Metadata,
+	}, nil
+}
+
+// Delete removes the object stored under key
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s.wrapError("delete", key, err)
+	}
+	return nil
+}
+
+// List returns every object in the bucket whose key starts with prefix
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", s.bucket, prefix, err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+// Presign returns a presigned GET or PUT URL for key
+func (s *S3Storage) Presign(ctx context.Context, key string, opts PresignOptions) (string, error) {
+	opts = opts.withDefaults()
+	expires := s3.WithPresignExpires(opts.Expires)
+
+	switch opts.Method {
+	case http.MethodGet:
+		req, err := s.presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}, expires)
+		if err != nil {
+			return "", fmt.Errorf("failed to presign GET for %s: %w", key, err)
+		}
+		return req.URL, nil
+
+	case http.MethodPut:
+		input := &s3.PutObjectInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			Metadata: opts.Metadata,
+		}
+		if opts.ContentType != "" {
+			input.ContentType = aws.String(opts.ContentType)
+		}
+		req, err := s.presigner.PresignPutObject(ctx, input, expires)
+		if err != nil {
+			return "", fmt.Errorf("failed to presign PUT for %s: %w", key, err)
+		}
+		return req.URL, nil
+
+	default:
+		return "", fmt.Errorf("unsupported presign method: %s", opts.Method)
+	}
+}
+
+// PresignPost returns an S3 POST policy for key. The policy pins the
+// key, or its prefix when one is set, the exact Content-Type, the size
+// range and metadata, so S3 itself rejects any upload that does not match.
+func (s *S3Storage) PresignPost(ctx context.Context, key string, policy PostPolicy) (*PresignedPost, error) {
+	if err := policy.validate(key); err != nil {
+		return nil, err
+	}
+	if policy.Expires <= 0 {
+		policy.Expires = DefaultPresignExpiry
+	}
+
+	// -> without a starts-with condition the SDK pins the exact key
+	conditions := []interface{}{
+		[]interface{}{"content-length-range", policy.MinSize, policy.MaxSize},
+		map[string]string{"Content-Type": policy.ContentType},
+	}
+	if policy.KeyPrefix != "" {
+		conditions = append(conditions, []interface{}{"starts-with", "$key", policy.KeyPrefix})
+	}
+	for k, v := range policy.Metadata {
+		conditions = append(conditions, map[string]string{"x-amz-meta-" + k: v})
+	}
+
+	req, err := s.presigner.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, func(opts *s3.PresignPostOptions) {
+		opts.Expires = policy.Expires
+		opts.Conditions = conditions
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign POST for %s: %w", key, err)
+	}
+
+	// The SDK only returns the signing fields, the
+	// conditioned fields have to be sent as well
+	fields := req.Values
+	fields["Content-Type"] = policy.ContentType
+	for k, v := range policy.Metadata {
+		fields["x-amz-meta-"+k] = v
+	}
+
+	return &PresignedPost{URL: req.URL, Fields: fields}, nil
+}
+
+// wrapError maps S3 "not found" errors to ErrNotFound
+func (s *S3Storage) wrapError(op, key string, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%s s3://%s/%s: %w", op, s.bucket, key, ErrNotFound)
+	}
+	return fmt.Errorf("failed to %s s3://%s/%s: %w", op, s.bucket, key, err)
+}
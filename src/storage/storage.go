@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the requested key does not exist
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage abstracts the object store used for uploaded and processed
+// photos. Both the S3 backend and the local filesystem backend satisfy
+// it, so the upload path does not need to know where objects end up.
+type Storage interface {
+	// Put writes the object read from body under key
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+
+	// Get returns a reader for the object stored under key. The
+	// caller is responsible for closing the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+
+	// Head returns the object's info without reading its body
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Presign returns a time-limited URL granting access to key
+	Presign(ctx context.Context, key string, opts PresignOptions) (string, error)
+
+	// PresignPost returns the URL and form fields a browser needs
+	// to upload key with an HTML form POST, constrained by policy
+	PresignPost(ctx context.Context, key string, policy PostPolicy) (*PresignedPost, error)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified time.Time         `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// PutOptions holds optional attributes for Put
+type PutOptions struct {
+	ContentType string
+	Metadata    map[string]string
+}
+
+// PresignOptions configures a presigned URL. Method defaults to
+// GET and Expires to DefaultPresignExpiry when left empty.
+type PresignOptions struct {
+	Method      string
+	Expires     time.Duration
+	ContentType string
+	Metadata    map[string]string
+}
+
+// PostPolicy constrains what a presigned POST may upload. The
+// key must equal the key the policy is issued for, or start with
+// KeyPrefix when one is set, the Content-Type must equal ContentType
+// and the body size must be within MinSize..MaxSize.
+type PostPolicy struct {
+	KeyPrefix   string // -> empty pins the exact key
+	ContentType string
+	MinSize     int64
+	MaxSize     int64
+	Expires     time.Duration
+	Metadata    map[string]string
+}
+
+// PresignedPost is the target and form fields of a presigned
+// POST. The fields must be sent ahead of the file in the form.
+type PresignedPost struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+// validate checks that the policy fits the key it is issued for
+func (p PostPolicy) validate(key string) error {
+	if p.KeyPrefix != "" && !strings.HasPrefix(key, p.KeyPrefix) {
+		return fmt.Errorf("key %q does not start with policy prefix %q", key, p.KeyPrefix)
+	}
+	if p.ContentType == "" {
+		return errors.New("post policy requires a content type")
+	}
+	if p.MaxSize <= 0 || p.MinSize < 0 || p.MinSize > p.MaxSize {
+		return fmt.Errorf("invalid post policy size range %d..%d", p.MinSize, p.MaxSize)
+	}
+	return nil
+}
+
+// DefaultPresignExpiry is the validity of a presigned URL
+// when PresignOptions.Expires is not set
+const DefaultPresignExpiry = 15 * time.Minute
+
+// withDefaults fills in the zero values of PresignOptions
+func (o PresignOptions) withDefaults() PresignOptions {
+	if o.Method == "" {
+		o.Method = http.MethodGet
+	}
+	if o.Expires <= 0 {
+		o.Expires = DefaultPresignExpiry
+	}
+	return o
+}
@@ -0,0 +1,229 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/30Piraten/snapflow/imaging"
+	"github.com/30Piraten/snapflow/models"
+	"github.com/30Piraten/snapflow/storage"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrInvalidUpload marks an uploaded object that can never be
+// accepted, so retrying its event is pointless
+var ErrInvalidUpload = errors.New("invalid upload")
+
+// OrderTracker records which photos of an order have been verified
+type OrderTracker interface {
+	// RecordVerifiedPhoto records photoID as verified and returns
+	// how many photos are verified and how many the order expects
+	RecordVerifiedPhoto(ctx context.Context, customerEmail, orderID, photoID string) (int, int, error)
+
+	// MarkOrderUploaded moves a pending order to uploaded. It
+	// returns false when the order was no longer pending.
+	MarkOrderUploaded(ctx context.Context, customerEmail, orderID string) (bool, error)
+
+	// ResetOrderUpload moves an uploaded order back to pending
+	ResetOrderUpload(ctx context.Context, customerEmail, orderID string) error
+}
+
+// PrintQueue enqueues the print job of a completed order
+type PrintQueue func(customerEmail, orderID, location string) error
+
+// Photo is a verified photo of an order
+type Photo struct {
+	Key           string
+	OrderID       string
+	CustomerEmail string
+	Location      string
+	Index         string // -> photo_index, unique within the order
+}
+
+// CompletionHandler verifies uploaded photos and sends an order to
+// print once all of its photos are present. It handles S3 ObjectCreated
+// events as a Lambda, from an SQS queue, or object by object in-process.
+type CompletionHandler struct {
+	store      storage.Storage
+	uploadKeys *storage.KeyTemplate
+	orders     OrderTracker
+	enqueue    PrintQueue
+	governor   *imaging.MemoryGovernor
+}
+
+// NewCompletionHandler returns a handler reading uploads keyed by
+// uploadKeys from store, whose decodes reserve their memory from
+// governor when it is not nil
+func NewCompletionHandler(store storage.Storage, uploadKeys *storage.KeyTemplate, orders OrderTracker, enqueue PrintQueue, governor *imaging.MemoryGovernor) *CompletionHandler {
+	return &CompletionHandler{
+		store:      store,
+		uploadKeys: uploadKeys,
+		orders:     orders,
+		enqueue:    enqueue,
+		governor:   governor,
+	}
+}
+
+// HandleEvent handles every ObjectCreated record of an S3 event for
+// a key laid out by the upload key template; the manifests, processed
+// photos and other objects written to the same bucket are skipped.
+// Invalid uploads are logged and skipped; any other failure is
+// returned so the event is delivered again.
+func (h *CompletionHandler) HandleEvent(ctx context.Context, event events.S3Event) error {
+	var errs []error
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+
+		key := record.S3.Object.URLDecodedKey
+		if h.uploadKeys != nil && !h.uploadKeys.Matches(key) {
+			continue
+		}
+
+		err := h.HandleObject(ctx, key)
+		if errors.Is(err, ErrInvalidUpload) {
+			log.Printf("Rejected upload %s: %v", key, err)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upload %s: %w", key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// HandleObject verifies the uploaded object stored under key and
+// records it against the order named in its metadata.
+func (h *CompletionHandler) HandleObject(ctx context.Context, key string) error {
+	photo, err := h.verify(ctx, key)
+	if err != nil {
+		return err
+	}
+	return h.PhotoVerified(ctx, *photo)
+}
+
+// verify checks the object's size and metadata with a HEAD, then
+// decodes it to make sure the upload is a complete image.
+func (h *CompletionHandler) verify(ctx context.Context, key string) (*Photo, error) {
+	info, err := h.store.Head(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to head upload: %w", err)
+	}
+
+	if info.Size <= 0 || info.Size > models.MaxFileSize {
+		return nil, fmt.Errorf("%w: size %d is outside 1..%d bytes", ErrInvalidUpload, info.Size, models.MaxFileSize)
+	}
+
+	photo := &Photo{
+		Key:           key,
+		OrderID:       info.Metadata["order_id"],
+		CustomerEmail: info.Metadata["email"],
+		Location:      info.Metadata["location"],
+		Index:         info.Metadata["photo_index"],
+	}
+	if photo.OrderID == "" || photo.CustomerEmail == "" {
+		return nil, fmt.Errorf("%w: missing order_id or email metadata", ErrInvalidUpload)
+	}
+	if photo.Index == "" {
+		photo.Index = key
+	}
+
+	body, _, err := h.store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer body.Close()
+
+	// Check the header before decoding, so an upload claiming a huge
+	// image cannot exhaust memory. The body is spooled so it can be
+	// read again for the full decode.
+	spool, err := spoolUpload(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	config, _, err := imaging.Probe(spool, imaging.PixelBudget{
+		MaxWidth:  models.MaxImageDimension,
+		MaxHeight: models.MaxImageDimension,
+		MaxPixels: models.MaxImagePixels,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+
+	// Wait for the decoded pixels to fit in the process's budget. An
+	// upload refused for capacity is valid, so its event is retried.
+	reservation, err := h.governor.Acquire(ctx, imaging.DecodedBytes(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve decoding memory: %w", err)
+	}
+	defer reservation.Release()
+
+	if _, format, err := image.Decode(spool); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode image: %v", ErrInvalidUpload, err)
+	} else if _, ok := imaging.LookupFormat(format); !ok {
+		return nil, fmt.Errorf("%w: unsupported image format %s", ErrInvalidUpload, format)
+	}
+
+	return photo, nil
+}
+
+// PhotoVerified records a verified photo and, once the order has all
+// of its photos, enqueues its print job. Only the call that moves the
+// order out of pending enqueues it, so concurrent and redelivered
+// events cannot print an order twice.
+func (h *CompletionHandler) PhotoVerified(ctx context.Context, photo Photo) error {
+	verified, expected, err := h.orders.RecordVerifiedPhoto(ctx, photo.CustomerEmail, photo.OrderID, photo.Index)
+	if err != nil {
+		return err
+	}
+
+	if verified < expected {
+		log.Printf("Order %s has %d/%d photos, waiting for the rest", photo.OrderID, verified, expected)
+		return nil
+	}
+
+	claimed, err := h.orders.MarkOrderUploaded(ctx, photo.CustomerEmail, photo.OrderID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return nil
+	}
+
+	if err := h.enqueue(photo.CustomerEmail, photo.OrderID, photo.Location); err != nil {
+		// Put the order back so the next delivery can enqueue it
+		if resetErr := h.orders.ResetOrderUpload(ctx, photo.CustomerEmail, photo.OrderID); resetErr != nil {
+			log.Printf("Failed to reset order %s after print request failure: %v", photo.OrderID, resetErr)
+		}
+		return fmt.Errorf("failed to send print request for order %s: %w", photo.OrderID, err)
+	}
+
+	log.Printf("Order %s has all %d photos, print job sent", photo.OrderID, expected)
+	return nil
+}
+
+// spoolUpload copies an uploaded object to a temporary file, which
+// the caller must close and remove
+func spoolUpload(body io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp("", "snapflow-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(spool, io.LimitReader(body, models.MaxFileSize+1)); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+	return spool, nil
+}
@@ -0,0 +1,68 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// consumerRetryDelay is how long Consume backs off after
+// failing to receive from the queue
+const consumerRetryDelay = 5 * time.Second
+
+// Consume long-polls queueURL for S3 ObjectCreated notifications and
+// hands them to h until ctx is cancelled. It is the in-process
+// alternative to running HandleEvent as a Lambda. A message is deleted
+// once it has been handled; on failure it becomes visible again and
+// is retried by SQS.
+func (h *CompletionHandler) Consume(ctx context.Context, client *sqs.Client, queueURL string) {
+	for ctx.Err() == nil {
+		output, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to receive upload events: %v", err)
+				time.Sleep(consumerRetryDelay)
+			}
+			continue
+		}
+
+		for _, message := range output.Messages {
+			if err := h.handleMessage(ctx, aws.ToString(message.Body)); err != nil {
+				log.Printf("Failed to handle upload event %s: %v", aws.ToString(message.MessageId), err)
+				continue
+			}
+
+			_, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				log.Printf("Failed to delete upload event %s: %v", aws.ToString(message.MessageId), err)
+			}
+		}
+	}
+}
+
+// handleMessage decodes an S3 notification from an SQS message body.
+// The s3:TestEvent S3 sends when notifications are configured has no
+// records and is simply acknowledged.
+func (h *CompletionHandler) handleMessage(ctx context.Context, body string) error {
+	var event events.S3Event
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		// A message that is not an S3 event will never decode,
+		// so acknowledge it instead of redelivering it forever
+		log.Printf("Skipping upload event that is not an S3 notification: %v", err)
+		return nil
+	}
+
+	return h.HandleEvent(ctx, event)
+}
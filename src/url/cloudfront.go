@@ -0,0 +1,182 @@
+package url
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/30Piraten/snapflow/models"
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+)
+
+// DefaultSignedURLTTL is how long a CloudFront signed URL
+// stays valid when CLOUDFRONT_URL_TTL is not set
+const DefaultSignedURLTTL = time.Hour
+
+// CloudFrontSigner issues CloudFront signed URLs for processed
+// photos, so they can be downloaded without the bucket being public.
+type CloudFrontSigner struct {
+	domain    string
+	keyPairID string
+	signer    *sign.URLSigner
+	TTL       time.Duration
+}
+
+// CustomPolicy restricts a signed URL beyond its expiry. Zero
+// values are left out of the policy.
+type CustomPolicy struct {
+	Expires   time.Time
+	NotBefore time.Time
+	SourceIP  string // -> CIDR, e.g. "203.0.113.0/24"
+}
+
+// NewCloudFrontSigner returns a signer for the given CloudFront
+// domain and key pair. The private key can be generated locally,
+// which keeps signing testable without an AWS account.
+func NewCloudFrontSigner(domain, keyPairID string, privateKey *rsa.PrivateKey) (*CloudFrontSigner, error) {
+	if domain == "" || keyPairID == "" {
+		return nil, fmt.Errorf("CloudFront domain and key pair ID are required")
+	}
+	if privateKey == nil {
+		return nil, fmt.Errorf("CloudFront private key is required")
+	}
+
+	return &CloudFrontSigner{
+		domain:    strings.TrimSuffix(strings.TrimPrefix(domain, "https://"), "/"),
+		keyPairID: keyPairID,
+		signer:    sign.NewURLSigner(keyPairID, privateKey),
+		TTL:       DefaultSignedURLTTL,
+	}, nil
+}
+
+// NewCloudFrontSignerFromEnv builds a signer from CLOUDFRONT_DOMAIN,
+// CLOUDFRONT_KEY_PAIR_ID and the PEM key at CLOUDFRONT_PRIVATE_KEY_PATH.
+// CLOUDFRONT_URL_TTL optionally overrides the URL lifetime.
+func NewCloudFrontSignerFromEnv() (*CloudFrontSigner, error) {
+	keyPath := os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH")
+	if keyPath == "" {
+		return nil, fmt.Errorf("CLOUDFRONT_PRIVATE_KEY_PATH environment variable not set")
+	}
+
+	privateKey, err := LoadCloudFrontPrivateKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := NewCloudFrontSigner(os.Getenv("CLOUDFRONT_DOMAIN"), os.Getenv("CLOUDFRONT_KEY_PAIR_ID"), privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if value := os.Getenv("CLOUDFRONT_URL_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid CLOUDFRONT_URL_TTL %q", value)
+		}
+		signer.TTL = ttl
+	}
+
+	return signer, nil
+}
+
+// LoadCloudFrontPrivateKey reads an RSA key in PKCS#1 or PKCS#8 PEM form
+func LoadCloudFrontPrivateKey(path string) (*rsa.PrivateKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CloudFront private key: %w", err)
+	}
+	defer file.Close()
+
+	if key, err := sign.LoadPEMPrivKey(file); err == nil {
+		return key, nil
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("failed to read CloudFront private key: %w", err)
+	}
+	key, err := sign.LoadPEMPrivKeyPKCS8(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CloudFront private key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CloudFront private key must be an RSA key, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+// ResourceURL returns the unsigned CloudFront URL of objectKey
+func (s *CloudFrontSigner) ResourceURL(objectKey string) string {
+	segments := strings.Split(strings.TrimPrefix(objectKey, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = neturl.PathEscape(segment)
+	}
+	return fmt.Sprintf("https://%s/%s", s.domain, strings.Join(segments, "/"))
+}
+
+// SignCanned returns a canned-policy signed URL for objectKey,
+// valid until the signer's TTL elapses.
+func (s *CloudFrontSigner) SignCanned(objectKey string) (*models.SignedURLInfo, error) {
+	expires := time.Now().Add(s.TTL)
+
+	signedURL, err := s.signer.Sign(s.ResourceURL(objectKey), expires)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign CloudFront URL for %s: %w", objectKey, err)
+	}
+
+	return &models.SignedURLInfo{
+		URL:              signedURL,
+		CloudFrontDomain: s.domain,
+		ObjectKey:        objectKey,
+		Expires:          expires.Unix(),
+		KeyPairID:        s.keyPairID,
+	}, nil
+}
+
+// SignCustom returns a custom-policy signed URL for objectKey. The
+// policy JSON is returned in SignedURLInfo.Policy for auditing.
+func (s *CloudFrontSigner) SignCustom(objectKey string, custom CustomPolicy) (*models.SignedURLInfo, error) {
+	if custom.Expires.IsZero() {
+		custom.Expires = time.Now().Add(s.TTL)
+	}
+
+	resource := s.ResourceURL(objectKey)
+	condition := sign.Condition{
+		DateLessThan: sign.NewAWSEpochTime(custom.Expires),
+	}
+	if !custom.NotBefore.IsZero() {
+		condition.DateGreaterThan = sign.NewAWSEpochTime(custom.NotBefore)
+	}
+	if custom.SourceIP != "" {
+		condition.IPAddress = &sign.IPAddress{SourceIP: custom.SourceIP}
+	}
+
+	policy := &sign.Policy{
+		Statements: []sign.Statement{{Resource: resource, Condition: condition}},
+	}
+
+	signedURL, err := s.signer.SignWithPolicy(resource, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign CloudFront URL for %s: %w", objectKey, err)
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CloudFront policy: %w", err)
+	}
+
+	return &models.SignedURLInfo{
+		URL:              signedURL,
+		CloudFrontDomain: s.domain,
+		ObjectKey:        objectKey,
+		Expires:          custom.Expires.Unix(),
+		KeyPairID:        s.keyPairID,
+		Policy:           base64.StdEncoding.EncodeToString(policyJSON),
+	}, nil
+}
@@ -0,0 +1,191 @@
+package url
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner returns a signer with a freshly generated key
+func testSigner(t *testing.T) (*CloudFrontSigner, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := NewCloudFrontSigner("https://d111111abcdef8.cloudfront.net/", "K2JCJMDEHXQW5F", key)
+	if err != nil {
+		t.Fatalf("NewCloudFrontSigner: %v", err)
+	}
+	return signer, key
+}
+
+// decodeCloudFront reverses CloudFront's URL-safe base64
+func decodeCloudFront(t *testing.T, value string) []byte {
+	t.Helper()
+
+	value = strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(value)
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatalf("decode %q: %v", value, err)
+	}
+	return data
+}
+
+// verifySignature checks that signature is the key's SHA-1 RSA
+// signature of policy, as CloudFront checks it
+func verifySignature(t *testing.T, key *rsa.PrivateKey, policy []byte, signature string) {
+	t.Helper()
+
+	digest := sha1.Sum(policy)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], decodeCloudFront(t, signature)); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+}
+
+// parseSignedURL splits a signed URL into its resource and query
+func parseSignedURL(t *testing.T, signedURL string) (string, neturl.Values) {
+	t.Helper()
+
+	parsed, err := neturl.Parse(signedURL)
+	if err != nil {
+		t.Fatalf("parse %q: %v", signedURL, err)
+	}
+	query := parsed.Query()
+	parsed.RawQuery = ""
+	return parsed.String(), query
+}
+
+func TestSignCanned(t *testing.T) {
+	signer, key := testSigner(t)
+
+	info, err := signer.SignCanned("orders/42/print/photo one.jpg")
+	if err != nil {
+		t.Fatalf("SignCanned: %v", err)
+	}
+
+	resource, query := parseSignedURL(t, info.URL)
+	if want := "https://d111111abcdef8.cloudfront.net/orders/42/print/photo%20one.jpg"; resource != want {
+		t.Errorf("resource = %q, want %q", resource, want)
+	}
+	if got := query.Get("Key-Pair-Id"); got != "K2JCJMDEHXQW5F" {
+		t.Errorf("Key-Pair-Id = %q", got)
+	}
+	if query.Has("Policy") {
+		t.Errorf("canned URL carries a Policy parameter")
+	}
+
+	expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("Expires = %q: %v", query.Get("Expires"), err)
+	}
+	if expires != info.Expires {
+		t.Errorf("Expires = %d, info says %d", expires, info.Expires)
+	}
+	if ttl := time.Until(time.Unix(expires, 0)); ttl <= 0 || ttl > DefaultSignedURLTTL {
+		t.Errorf("URL expires in %s, want within %s", ttl, DefaultSignedURLTTL)
+	}
+
+	// CloudFront rebuilds the canned policy from the URL and expiry
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":%q,"Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resource, expires)
+	verifySignature(t, key, []byte(policy), query.Get("Signature"))
+}
+
+func TestSignCustom(t *testing.T) {
+	signer, key := testSigner(t)
+
+	notBefore := time.Unix(1_700_000_000, 0)
+	expires := notBefore.Add(2 * time.Hour)
+	info, err := signer.SignCustom("orders/42/preview/photo.jpg", CustomPolicy{
+		Expires:   expires,
+		NotBefore: notBefore,
+		SourceIP:  "203.0.113.7/32",
+	})
+	if err != nil {
+		t.Fatalf("SignCustom: %v", err)
+	}
+
+	resource, query := parseSignedURL(t, info.URL)
+	if query.Has("Expires") {
+		t.Errorf("custom URL carries an Expires parameter")
+	}
+	if got := query.Get("Key-Pair-Id"); got != "K2JCJMDEHXQW5F" {
+		t.Errorf("Key-Pair-Id = %q", got)
+	}
+	if info.Expires != expires.Unix() {
+		t.Errorf("info.Expires = %d, want %d", info.Expires, expires.Unix())
+	}
+
+	policy := decodeCloudFront(t, query.Get("Policy"))
+	verifySignature(t, key, policy, query.Get("Signature"))
+
+	var decoded struct {
+		Statement []struct {
+			Resource  string
+			Condition struct {
+				DateLessThan struct {
+					EpochTime int64 `json:"AWS:EpochTime"`
+				}
+				DateGreaterThan struct {
+					EpochTime int64 `json:"AWS:EpochTime"`
+				}
+				IPAddress struct {
+					SourceIP string `json:"AWS:SourceIp"`
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(policy, &decoded); err != nil {
+		t.Fatalf("policy %s: %v", policy, err)
+	}
+	if len(decoded.Statement) != 1 {
+		t.Fatalf("policy has %d statements, want 1", len(decoded.Statement))
+	}
+	statement := decoded.Statement[0]
+	if statement.Resource != resource {
+		t.Errorf("policy resource = %q, want %q", statement.Resource, resource)
+	}
+	if got := statement.Condition.DateLessThan.EpochTime; got != expires.Unix() {
+		t.Errorf("DateLessThan = %d, want %d", got, expires.Unix())
+	}
+	if got := statement.Condition.DateGreaterThan.EpochTime; got != notBefore.Unix() {
+		t.Errorf("DateGreaterThan = %d, want %d", got, notBefore.Unix())
+	}
+	if got := statement.Condition.IPAddress.SourceIP; got != "203.0.113.7/32" {
+		t.Errorf("SourceIp = %q", got)
+	}
+
+	// The audited policy is the one that was signed
+	audited, err := base64.StdEncoding.DecodeString(info.Policy)
+	if err != nil {
+		t.Fatalf("info.Policy: %v", err)
+	}
+	verifySignature(t, key, audited, query.Get("Signature"))
+}
+
+func TestSignatureRejectsOtherKey(t *testing.T) {
+	signer, _ := testSigner(t)
+	_, otherKey := testSigner(t)
+
+	info, err := signer.SignCanned("orders/42/print/photo.jpg")
+	if err != nil {
+		t.Fatalf("SignCanned: %v", err)
+	}
+	resource, query := parseSignedURL(t, info.URL)
+
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":%q,"Condition":{"DateLessThan":{"AWS:EpochTime":%s}}}]}`, resource, query.Get("Expires"))
+	digest := sha1.Sum([]byte(policy))
+	if rsa.VerifyPKCS1v15(&otherKey.PublicKey, crypto.SHA1, digest[:], decodeCloudFront(t, query.Get("Signature"))) == nil {
+		t.Fatal("signature verified with a different key")
+	}
+}
@@ -4,27 +4,77 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	cfg "github.com/30Piraten/snapflow/config"
+	"github.com/30Piraten/snapflow/imaging"
 	"github.com/30Piraten/snapflow/models"
-	"github.com/30Piraten/snapflow/utils"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/30Piraten/snapflow/storage"
 	"github.com/google/uuid"
 )
 
+// PresignedURLResponse holds one upload URL per photo. For presigned
+// POSTs, Fields[i] holds the form fields to send with URLs[i].
 type PresignedURLResponse struct {
-	URLs    []string          `json:"urls"`
-	OrderID string            `json:"order_id"`
-	Fields  map[string]string `json:"fields,omitempty"`
+	URLs    []string            `json:"urls"`
+	OrderID string              `json:"order_id"`
+	Fields  []map[string]string `json:"fields,omitempty"`
 }
 
+// presignFunc presigns the upload of a single photo under key. It
+// returns the upload URL and, for presigned POSTs, the form fields.
+type presignFunc func(key string, photo *multipart.FileHeader, metadata map[string]string) (string, map[string]string, error)
+
 // GeneratePresignedURL generates a presigned URL for the given order details.
 // The generated presigned URL is valid for 15 minutes.
 // The generated presigned URL will contain the defined metadata
-func GeneratePresignedURL(order *models.PhotoOrder) (*PresignedURLResponse, error) {
+func GeneratePresignedURL(order *models.PhotoOrder, store storage.Storage) (*PresignedURLResponse, error) {
+	return generateUploads(order, func(key string, photo *multipart.FileHeader, metadata map[string]string) (string, map[string]string, error) {
+		presignedPut, err := store.Presign(context.TODO(), key, storage.PresignOptions{
+			Method:   http.MethodPut,
+			Expires:  time.Minute * 15,
+			Metadata: metadata,
+		})
+		return presignedPut, nil, err
+	})
+}
+
+// GeneratePresignedPost generates a presigned POST policy for each photo
+// of the given order. Unlike a presigned PUT, the policy caps the upload
+// at models.MaxFileSize, only allows the Content-Type of the supported
+// format that matches the photo's extension and pins the photo's exact key, so the
+// bucket itself rejects anything else. The policy is valid for 15 minutes.
+func GeneratePresignedPost(order *models.PhotoOrder, store storage.Storage) (*PresignedURLResponse, error) {
+	return generateUploads(order, func(key string, photo *multipart.FileHeader, metadata map[string]string) (string, map[string]string, error) {
+		// Only the Content-Type of the format the
+		// photo's extension stands for is allowed
+		format, ok := imaging.FormatForFilename(photo.Filename)
+		if !ok {
+			return "", nil, fmt.Errorf("file %s is not one of %s", photo.Filename, imaging.FormatNames())
+		}
+
+		post, err := store.PresignPost(context.TODO(), key, storage.PostPolicy{
+			ContentType: format.MIMEType,
+			MinSize:     1,
+			MaxSize:     models.MaxFileSize,
+			Expires:     time.Minute * 15,
+			Metadata:    metadata,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		return post.URL, post.Fields, nil
+	})
+}
+
+// generateUploads records the order and presigns
+// the upload of each of its photos with presign.
+func generateUploads(order *models.PhotoOrder, presign presignFunc) (*PresignedURLResponse, error) {
 
 	// Confirm if fullname and email are available
 	if order.FullName == "" || order.Email == "" {
@@ -39,32 +89,12 @@ func GeneratePresignedURL(order *models.PhotoOrder) (*PresignedURLResponse, erro
 	orderID := uuid.New().String()
 	uploadTimestamp := time.Now().Unix()
 
-	// Sanitize fullname for S3 path
-	sanitizedName := utils.Sanitize(order.FullName)
-	folderKey := fmt.Sprintf("%s/%s", sanitizedName, orderID)
-
-	// Initialize DyanmoDB client
-	cfg.InitDynamoDB()
-
-	// Insert metadata into DynamoDB
-	err := cfg.InsertMetadata(order.FullName, order.Email, order.PaperType, order.Size, orderID, uploadTimestamp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to insert metadata into DynamoDB: %v", err)
-	}
-
-	// Initialize S3 client
-	s3Client, err := cfg.S3Client()
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize s3 client: %v", err)
-	}
-
-	// Get bucket name from .env file
-	bucketName := os.Getenv("BUCKET_NAME")
-
-	presignedClient := s3.NewPresignClient(s3Client)
+	// Photos are keyed by the configured upload key template
+	keys := cfg.UploadKeyTemplate()
 
 	// Generate presigned URLs for each photo
 	var presignedURLs []string
+	var presignedFields []map[string]string
 	for i, photo := range order.Photos {
 
 		// Validate photo
@@ -73,28 +103,37 @@ func GeneratePresignedURL(order *models.PhotoOrder) (*PresignedURLResponse, erro
 			continue
 		}
 
-		photoKey := fmt.Sprintf("%s/%s", folderKey, photo.Filename)
-
-		presignedPut, err := presignedClient.PresignPutObject(context.TODO(),
-			&s3.PutObjectInput{
-				Bucket: aws.String(bucketName),
-				Key:    aws.String(photoKey),
-				Metadata: map[string]string{
-					"full_name":  order.FullName,
-					"location":   order.Location,
-					"size":       order.Size,
-					"paper_type": order.PaperType,
-					"order_id":   orderID,
-					"email":      order.Email,
-				},
-			},
-			s3.WithPresignExpires(time.Minute*15),
-		)
+		ext := filepath.Ext(photo.Filename)
+		photoKey, err := keys.Render(storage.KeyFields{
+			Store:      order.Location,
+			Time:       time.Unix(uploadTimestamp, 0),
+			OrderID:    orderID,
+			PhotoIndex: i,
+			Ext:        ext,
+			Customer:   order.FullName,
+			Filename:   strings.TrimSuffix(filepath.Base(photo.Filename), ext),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build key for %s: %v", photo.Filename, err)
+		}
+
+		presignedURL, fields, err := presign(photoKey, photo, map[string]string{
+			"full_name":   order.FullName,
+			"location":    order.Location,
+			"size":        order.Size,
+			"paper_type":  order.PaperType,
+			"order_id":    orderID,
+			"email":       order.Email,
+			"photo_index": strconv.Itoa(i),
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate presigned URL: %v", err)
 		}
 
-		presignedURLs = append(presignedURLs, presignedPut.URL)
+		presignedURLs = append(presignedURLs, presignedURL)
+		if fields != nil {
+			presignedFields = append(presignedFields, fields)
+		}
 		log.Printf("Successfully generated presigned URL %d/%d", i+1, len(order.Photos))
 	}
 
@@ -108,13 +147,18 @@ func GeneratePresignedURL(order *models.PhotoOrder) (*PresignedURLResponse, erro
 	// 	log.Printf("URL %d: %s", i+1, url)
 	// }
 
-	// Send SQS print job
-	err = cfg.SendPrintRequest(order.Email, orderID, order.Location)
+	// Initialize DyanmoDB client
+	cfg.InitDynamoDB()
+
+	// Insert metadata into DynamoDB. The order stays pending until the
+	// upload-completion handler has verified every expected photo, and
+	// only then is the print job sent to SQS.
+	err := cfg.InsertMetadata(order.FullName, order.Email, order.PaperType, order.Size, orderID, len(presignedURLs), uploadTimestamp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send SQS print job: %v", err)
+		return nil, fmt.Errorf("failed to insert metadata into DynamoDB: %w", err)
 	}
 
-	// Uncomment if needed: 
+	// Uncomment if needed:
 	// Removed SNS Notification for initial confirmation. Since
 	// We only need to send it once, after the print has been completed.
 	// Not before and after print - customers wait in-store to collect.
@@ -129,5 +173,6 @@ func GeneratePresignedURL(order *models.PhotoOrder) (*PresignedURLResponse, erro
 	return &PresignedURLResponse{
 		URLs:    presignedURLs,
 		OrderID: orderID,
+		Fields:  presignedFields,
 	}, nil
 }